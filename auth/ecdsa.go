@@ -9,6 +9,7 @@ package auth
 
 import (
 	"crypto/ecdsa"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
@@ -177,3 +178,71 @@ func verifyToken(encodedToken, subject string) (bool, error) {
 	validSignature := ecdsa.Verify(&signingKey.PublicKey, tokenHash.Sum(nil), ecdsaSignature.R, ecdsaSignature.S)
 	return validSignature, nil
 }
+
+// SignDerivativeParams signs the parameters for a resized or cropped derivative of an
+// image, so that only derivatives we have issued URLs for can be made on request. These
+// signatures do not expire, as derivative URLs are embedded and cached like the images.
+// They are MACs rather than ECDSA signatures, so that the URL of a derivative stays the
+// same every time it is issued, and is cheap to issue for every image in a listing.
+func SignDerivativeParams(imagePath, params string) (string, error) {
+	if imagePath == "" {
+		return "", terrors.BadRequest("invalid_image_path", "Image path for derivative cannot be empty", nil)
+	}
+
+	mac, err := derivativeMAC(imagePath, params)
+	if err != nil {
+		return "", terrors.Wrap(err, nil)
+	}
+
+	return hex.EncodeToString(mac), nil
+}
+
+func VerifyDerivativeParams(encodedSignature, imagePath, params string) (bool, error) {
+	signature, err := hex.DecodeString(encodedSignature)
+	if err != nil {
+		return false, terrors.BadRequest("invalid_signature", fmt.Sprintf("Derivative signature is malformed: %v", err), nil)
+	}
+
+	if len(signature) == sha256.Size {
+		mac, err := derivativeMAC(imagePath, params)
+		if err != nil {
+			return false, terrors.Wrap(err, nil)
+		}
+		return hmac.Equal(signature, mac), nil
+	}
+
+	// Derivative URLs issued before they were signed with MACs carry ECDSA signatures,
+	// which are still accepted as the URLs may be embedded elsewhere.
+	ecdsaSignature := &ECDSASignature{}
+	_, err = asn1.Unmarshal(signature, ecdsaSignature)
+	if err != nil {
+		return false, terrors.BadRequest("invalid_signature", fmt.Sprintf("Derivative signature is unparsable: %v", err), nil)
+	}
+
+	payloadHash := sha256.Sum256([]byte(derivativeSubject(imagePath, params)))
+
+	signingKey, err := getSigningKey()
+	if err != nil {
+		return false, terrors.Wrap(err, nil)
+	}
+	validSignature := ecdsa.Verify(&signingKey.PublicKey, payloadHash[:], ecdsaSignature.R, ecdsaSignature.S)
+	return validSignature, nil
+}
+
+// derivativeMAC authenticates the derivative with a key derived from the signing key, so
+// that no other secret needs to be configured.
+func derivativeMAC(imagePath, params string) ([]byte, error) {
+	signingKey, err := getSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	macKey := sha256.Sum256(append([]byte("derivative:"), signingKey.D.Bytes()...))
+	mac := hmac.New(sha256.New, macKey[:])
+	mac.Write([]byte(derivativeSubject(imagePath, params)))
+	return mac.Sum(nil), nil
+}
+
+func derivativeSubject(imagePath, params string) string {
+	return fmt.Sprintf("derivative/%s?%s", imagePath, params)
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"testing"
 	"time"
 )
@@ -88,3 +90,80 @@ func TestImageToken(t *testing.T) {
 		t.Fatal("Verifying image token with VerifyAdminToken should not succeed")
 	}
 }
+
+func TestDerivativeParams(t *testing.T) {
+	testKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating P256 ECDSA key: %+v", err)
+	}
+
+	cachedSigningKey = testKey
+
+	testImagePath := "public/test000.jpg"
+	testParams := "w=400&h=300&fit=cover&gravity=center"
+
+	_, err = SignDerivativeParams("", testParams)
+	if err == nil {
+		t.Fatal("Unexpected derivative signing success with empty image path")
+	}
+
+	signature, err := SignDerivativeParams(testImagePath, testParams)
+	if err != nil {
+		t.Fatalf("Unexpected error signing derivative params: %+v", err)
+	}
+
+	verified, err := VerifyDerivativeParams(signature, testImagePath, testParams)
+	if err != nil {
+		t.Fatalf("Unexpected error verifying valid derivative signature: %+v", err)
+	}
+
+	if !verified {
+		t.Fatal("Valid derivative signature cannot be verified")
+	}
+
+	// Derivative URLs stay the same each time they are issued, so they can be cached.
+	resigned, err := SignDerivativeParams(testImagePath, testParams)
+	if err != nil {
+		t.Fatalf("Unexpected error signing derivative params again: %+v", err)
+	}
+	if resigned != signature {
+		t.Fatalf("Expected derivative signature %s to be issued again, got %s", signature, resigned)
+	}
+
+	// Signatures issued before derivatives were signed with MACs are still accepted.
+	payloadHash := sha256.Sum256([]byte(derivativeSubject(testImagePath, testParams)))
+	ecdsaSignature, err := testKey.Sign(rand.Reader, payloadHash[:], nil)
+	if err != nil {
+		t.Fatalf("Error signing derivative with ECDSA: %+v", err)
+	}
+	verified, err = VerifyDerivativeParams(hex.EncodeToString(ecdsaSignature), testImagePath, testParams)
+	if err != nil || !verified {
+		t.Fatalf("ECDSA derivative signature cannot be verified: %+v", err)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating P256 ECDSA key: %+v", err)
+	}
+	cachedSigningKey = otherKey
+	verified, _ = VerifyDerivativeParams(signature, testImagePath, testParams)
+	if verified {
+		t.Fatal("Derivative signature should not verify with a different signing key")
+	}
+	cachedSigningKey = testKey
+
+	verified, _ = VerifyDerivativeParams(signature, testImagePath, "w=4000&h=3000&fit=cover&gravity=center")
+	if verified {
+		t.Fatal("Derivative signature should not verify for different params")
+	}
+
+	verified, _ = VerifyDerivativeParams(signature, "public/test001.jpg", testParams)
+	if verified {
+		t.Fatal("Derivative signature should not verify for a different image")
+	}
+
+	verified, err = VerifyDerivativeParams("invalid", testImagePath, testParams)
+	if verified || err == nil {
+		t.Fatal("Verifying invalid derivative signature should trigger an error")
+	}
+}
@@ -12,16 +12,73 @@ var (
 	ConfigStorageDirectoryUnlisted  = getConfigFromOSEnv("YRONWOOD_STORAGE_DIRECTORY_UNLISTED", "/images/uploads/big")
 	ConfigStorageDirectoryPrivate   = getConfigFromOSEnv("YRONWOOD_STORAGE_DIRECTORY_PRIVATE", "/images/uploads/private")
 	ConfigStorageDirectoryThumbnail = getConfigFromOSEnv("YRONWOOD_STORAGE_DIRECTORY_THUMBNAIL", "/images/uploads/thumbnail")
+	ConfigStorageDirectoryVersions  = getConfigFromOSEnv("YRONWOOD_STORAGE_DIRECTORY_VERSIONS", "/images/uploads/versions")
+	ConfigStorageDirectoryRendition = getConfigFromOSEnv("YRONWOOD_STORAGE_DIRECTORY_RENDITION", "/images/uploads/rendition")
+	ConfigStorageDirectoryMetadata  = getConfigFromOSEnv("YRONWOOD_STORAGE_DIRECTORY_METADATA", "/images/uploads/metadata")
+	ConfigStorageDirectoryOriginals = getConfigFromOSEnv("YRONWOOD_STORAGE_DIRECTORY_ORIGINALS", "/images/uploads/originals") // Images as uploaded, kept when stored optimized and served to admins under /originals/
+	ConfigStorageDirectoryShares    = getConfigFromOSEnv("YRONWOOD_STORAGE_DIRECTORY_SHARES", "/images/uploads/shares")
+	ConfigStorageDirectorySlugs     = getConfigFromOSEnv("YRONWOOD_STORAGE_DIRECTORY_SLUGS", "/images/uploads/slugs")
 	ConfigAccessTypePublic          = getConfigFromOSEnv("YRONWOOD_ACCESS_TYPE_PUBLIC", "public")
 	ConfigAccessTypeUnlisted        = getConfigFromOSEnv("YRONWOOD_ACCESS_TYPE_UNLISTED", "big")
 	ConfigAccessTypePrivate         = getConfigFromOSEnv("YRONWOOD_ACCESS_TYPE_PRIVATE", "private")
 	ConfigMaxFileSize               = getConfigFromOSEnv("YRONWOOD_MAX_FILE_SIZE", "25165824")  // 24MB
 	ConfigMaxFileNameSize           = getConfigFromOSEnv("YRONWOOD_MAX_FILE_NAME_SIZE", "1024") // GCP max
-	ConfigPermittedExtensions       = getConfigFromOSEnv("YRONWOOD_PERMITTED_EXTENSIONS", "jpeg|jpg|png|gif")
+	ConfigPermittedExtensions       = getConfigFromOSEnv("YRONWOOD_PERMITTED_EXTENSIONS", "jpeg|jpg|png|gif|webp|bmp|tiff|tif|svg")
 	ConfigAuthenticationSigningKey  = getConfigFromOSEnv("YRONWOOD_AUTHENTICATION_SIGHNING_KEY", "unit_test")
 	ConfigAuthenticationBasicSecret = getConfigFromOSEnv("YRONWOOD_AUTHENTICATION_BASIC_SECRET", "unit_test")
 	ConfigAuthenticationBasicSalt   = getConfigFromOSEnv("YRONWOOD_AUTHENTICATION_BASIC_SALT", "unit_test")
 	ConfigCORSAllowedOrigin         = getConfigFromOSEnv("YRONWOOD_CORS_ALLOWED_ORIGIN", "https://images.chongya.ng")
+	ConfigWebRenditionFormat        = getConfigFromOSEnv("YRONWOOD_WEB_RENDITION_FORMAT", "png") // png or jpeg
+	ConfigResizeKernel              = getConfigFromOSEnv("YRONWOOD_RESIZE_KERNEL", "catmullrom") // nearest, bilinear, catmullrom or lanczos3
+	ConfigJPEGQuality               = getConfigFromOSEnv("YRONWOOD_JPEG_QUALITY", "85")          // Of resized, watermarked and converted images
+	ConfigFormatNegotiation         = getConfigFromOSEnv("YRONWOOD_FORMAT_NEGOTIATION", "false") // Convert images into a format clients accept, per their Accept header
+
+	ConfigThumbnailMaxAnimationFrames = getConfigFromOSEnv("YRONWOOD_THUMBNAIL_MAX_ANIMATION_FRAMES", "300")
+	ConfigThumbnailMaxAnimationPixels = getConfigFromOSEnv("YRONWOOD_THUMBNAIL_MAX_ANIMATION_PIXELS", "100000000") // Canvas pixels across all frames
+
+	ConfigDerivativeMaxDimension = getConfigFromOSEnv("YRONWOOD_DERIVATIVE_MAX_DIMENSION", "4096")
+	ConfigDerivativePresets      = getConfigFromOSEnv("YRONWOOD_DERIVATIVE_PRESETS", "small:400x0:contain|medium:800x0:contain|large:1600x0:contain|square:400x400:cover") // name:widthxheight:fit[:gravity]
+
+	ConfigThumbnailWorkers           = getConfigFromOSEnv("YRONWOOD_THUMBNAIL_WORKERS", "2")
+	ConfigThumbnailQueueSize         = getConfigFromOSEnv("YRONWOOD_THUMBNAIL_QUEUE_SIZE", "1000")
+	ConfigThumbnailBackfillOnStartup = getConfigFromOSEnv("YRONWOOD_THUMBNAIL_BACKFILL_ON_STARTUP", "false")
+	ConfigDerivativeMemoryBudget     = getConfigFromOSEnv("YRONWOOD_DERIVATIVE_MEMORY_BUDGET", "536870912") // Estimated bytes of images being resized at once, 512MB
+
+	ConfigThumbnailCacheBudget           = getConfigFromOSEnv("YRONWOOD_THUMBNAIL_CACHE_BUDGET", "2147483648") // Bytes of derivatives kept on disk, 2GB
+	ConfigThumbnailCacheEvictionInterval = getConfigFromOSEnv("YRONWOOD_THUMBNAIL_CACHE_EVICTION_INTERVAL", "5m")
+	ConfigThumbnailHotCacheBudget        = getConfigFromOSEnv("YRONWOOD_THUMBNAIL_HOT_CACHE_BUDGET", "33554432") // Bytes of most viewed derivatives kept in memory, 32MB
+	ConfigThumbnailHotCacheMinViews      = getConfigFromOSEnv("YRONWOOD_THUMBNAIL_HOT_CACHE_MIN_VIEWS", "3")
+
+	ConfigSrcsetWidths    = getConfigFromOSEnv("YRONWOOD_SRCSET_WIDTHS", "400|800|1200|1600")
+	ConfigSrcsetBaseWidth = getConfigFromOSEnv("YRONWOOD_SRCSET_BASE_WIDTH", "400") // Display width in CSS pixels which srcset densities are relative to
+
+	ConfigWatermarkText     = getConfigFromOSEnv("YRONWOOD_WATERMARK_TEXT", "")              // Watermarks public and unlisted images if set, unless an image is set
+	ConfigWatermarkImage    = getConfigFromOSEnv("YRONWOOD_WATERMARK_IMAGE", "")             // Path to a PNG image, used in place of text
+	ConfigWatermarkPosition = getConfigFromOSEnv("YRONWOOD_WATERMARK_POSITION", "southeast") // center or a compass direction
+	ConfigWatermarkOpacity  = getConfigFromOSEnv("YRONWOOD_WATERMARK_OPACITY", "0.5")
+	ConfigWatermarkScale    = getConfigFromOSEnv("YRONWOOD_WATERMARK_SCALE", "0.25") // Fraction of the image width the watermark spans, and at most of its height
+
+	ConfigOptimizePolicies       = getConfigFromOSEnv("YRONWOOD_OPTIMIZE_POLICIES", "")            // accesstype:none|lossless|lossy[:keep], separated by "|", with keep retaining the uploaded original
+	ConfigOptimizeJPEGQuality    = getConfigFromOSEnv("YRONWOOD_OPTIMIZE_JPEG_QUALITY", "85")      // Of JPEG images optimized lossily
+	ConfigOptimizePNGCompression = getConfigFromOSEnv("YRONWOOD_OPTIMIZE_PNG_COMPRESSION", "best") // default, speed or best
+	ConfigOptimizeMinSavings     = getConfigFromOSEnv("YRONWOOD_OPTIMIZE_MIN_SAVINGS", "0.1")      // Fraction of the uploaded size an optimized image must save to be stored instead
+
+	// Images are served under the same URL when replaced or rolled back, so caches are
+	// not told to keep them indefinitely. Public images are cached for an hour by default,
+	// after which caches revalidate them with their ETag and are served the new image if
+	// it changed, or a 304 otherwise. Unlisted images are rarely replaced once their links
+	// are given out, so are cached for longer.
+	ConfigCacheControlPublic   = getConfigFromOSEnv("YRONWOOD_CACHE_CONTROL_PUBLIC", "public, max-age=3600")
+	ConfigCacheControlUnlisted = getConfigFromOSEnv("YRONWOOD_CACHE_CONTROL_UNLISTED", "public, max-age=86400")
+	ConfigCacheControlPrivate  = getConfigFromOSEnv("YRONWOOD_CACHE_CONTROL_PRIVATE", "private, no-store") // Also for images served to admins, such as without watermarks, and through share links
+
+	ConfigHotlinkRules       = getConfigFromOSEnv("YRONWOOD_HOTLINK_RULES", "")       // accesstype:deny|placeholder:host,*.host[:noempty], separated by "|", with noempty also blocking requests without a referrer
+	ConfigHotlinkPlaceholder = getConfigFromOSEnv("YRONWOOD_HOTLINK_PLACEHOLDER", "") // Path to an image served in place of those hotlinked, or a plain grey image if unset
+
+	ConfigPublicURL        = getConfigFromOSEnv("YRONWOOD_PUBLIC_URL", "")              // URL this API is reached at, for links given out, which are relative to it if unset
+	ConfigShareMaxValidity = getConfigFromOSEnv("YRONWOOD_SHARE_MAX_VALIDITY", "2160h") // 90 days
+
+	ConfigPreviewSiteName = getConfigFromOSEnv("YRONWOOD_PREVIEW_SITE_NAME", "Yronwood") // Named as where images are from in previews of links to them
 )
 
 // This is intended to run inside Kubernetes as a pod, so we just set service Configurations from deployment Configuration.
@@ -43,7 +100,38 @@ func FileExtensionToContentType(extension string) string {
 		return "image/png"
 	case "gif":
 		return "image/gif"
+	case "webp":
+		return "image/webp"
+	case "bmp":
+		return "image/bmp"
+	case "tif", "tiff":
+		return "image/tiff"
+	case "svg":
+		return "image/svg+xml"
 	}
 
 	return "application/octet-stream"
 }
+
+// ContentTypeToFileExtension returns the extension of files of a given HTTP content type,
+// or an empty string for content types which are not of images.
+func ContentTypeToFileExtension(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return "jpg"
+	case "image/png":
+		return "png"
+	case "image/gif":
+		return "gif"
+	case "image/webp":
+		return "webp"
+	case "image/bmp":
+		return "bmp"
+	case "image/tiff":
+		return "tiff"
+	case "image/svg+xml":
+		return "svg"
+	}
+
+	return ""
+}
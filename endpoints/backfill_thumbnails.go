@@ -0,0 +1,73 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/thumbnail"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func backfillThumbnails(req typhon.Request) typhon.Response {
+	thumbnailBackfillRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ThumbnailBackfillRequest{}
+	err = json.Unmarshal(thumbnailBackfillRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	// Listing private images covers all access types.
+	storagePaths := accessTypeToPaths(config.ConfigAccessTypePrivate)
+	if body.AccessType != "" {
+		validAccessType, storagePath := validateAccessType(body.AccessType)
+		if !validAccessType {
+			return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
+		}
+		storagePaths = map[string]string{body.AccessType: storagePath}
+	}
+
+	// Backfill carries on after the response is sent, so it can't use the request context.
+	queued, err := thumbnail.BackfillThumbnails(context.Background(), storagePaths)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered finding images to thumbnail", nil)}
+	}
+
+	return req.Response(types.ThumbnailBackfillResponse{
+		Queued: queued,
+	})
+}
+
+// BackfillThumbnails queues thumbnails to be made for all images which have none yet.
+func BackfillThumbnails(ctx context.Context) {
+	queued, err := thumbnail.BackfillThumbnails(ctx, accessTypeToPaths(config.ConfigAccessTypePrivate))
+	if err != nil {
+		slog.Error(ctx, "Could not backfill thumbnails: %v", err)
+		return
+	}
+
+	slog.Info(ctx, "Found %d images without thumbnails to backfill", queued)
+}
@@ -0,0 +1,124 @@
+package endpoints
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+// Images are served with validators so that browsers and caches in front of us can ask
+// whether an image they hold has changed, rather than downloading it again. ETags are
+// hashes of exactly what is served, so they differ between renditions of an image and
+// change whenever an image is replaced or served differently.
+
+// contentETag returns the strong entity tag of the content, hashing it without reading it
+// into memory.
+func contentETag(content *imageContent) (string, error) {
+	contentHash := sha256.New()
+	if _, err := io.Copy(contentHash, io.NewSectionReader(content, 0, content.size)); err != nil {
+		return "", err
+	}
+
+	return checksumETag(hex.EncodeToString(contentHash.Sum(nil))), nil
+}
+
+// checksumETag returns the entity tag of content with the given SHA-256 checksum.
+func checksumETag(checksum string) string {
+	return fmt.Sprintf(`"%s"`, checksum)
+}
+
+// storedImageETag returns the entity tag of the stored image, from the checksum recorded
+// in its metadata unless the record does not match the file.
+func storedImageETag(ctx context.Context, fileName, accessType string, content *imageContent) (string, error) {
+	_, storagePath := validateAccessType(accessType)
+	record, err := getImageDetails(ctx, fileName, storagePath, accessType)
+	if err == nil && record.SHA256 != "" && record.Size == content.size {
+		return checksumETag(record.SHA256), nil
+	}
+
+	return contentETag(content)
+}
+
+// cacheControlForAccessType returns the configured caching policy for images of the
+// access type, which is the private one for images served privately, such as to admins.
+func cacheControlForAccessType(accessType string, private bool) string {
+	if private {
+		return config.ConfigCacheControlPrivate
+	}
+
+	switch accessType {
+	case config.ConfigAccessTypePublic:
+		return config.ConfigCacheControlPublic
+	case config.ConfigAccessTypeUnlisted:
+		return config.ConfigCacheControlUnlisted
+	}
+
+	return config.ConfigCacheControlPrivate
+}
+
+// storedImageModTime returns when the stored image was last written, or zero if unknown.
+// The fileName MUST be validated by validateFilename() before passing in.
+func storedImageModTime(fileName, accessType string) time.Time {
+	validAccessType, storagePath := validateAccessType(accessType)
+	if !validAccessType {
+		return time.Time{}
+	}
+
+	fileInfo, err := os.Stat(path.Join(storagePath, fileName))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return fileInfo.ModTime()
+}
+
+// setValidators sets the caching policy and validators of the response.
+func setValidators(response typhon.Response, cacheControl, etag string, lastModified time.Time) {
+	response.Header.Set("Cache-Control", cacheControl)
+	response.Header.Set("ETag", etag)
+	if !lastModified.IsZero() {
+		response.Header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified returns whether the client already holds the content, per its conditional
+// request headers. If-None-Match takes precedence over If-Modified-Since when both are
+// sent, as dates are only precise to the second.
+func notModified(req typhon.Request, etag string, lastModified time.Time) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			// Weak comparison applies, so ETags held as weak still match.
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince := req.Header.Get("If-Modified-Since")
+	if ifModifiedSince == "" || lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.Truncate(time.Second).After(since)
+}
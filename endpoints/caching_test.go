@@ -0,0 +1,121 @@
+package endpoints
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+func requestView(t *testing.T, accessType, fileName, token string, header map[string]string) typhon.Response {
+	t.Helper()
+
+	query := url.Values{}
+	if token != "" {
+		query.Set("token", token)
+	}
+	req := typhon.NewRequest(context.Background(), http.MethodGet, "https://images.example/uploads/"+accessType+"/"+fileName+"?"+query.Encode(), nil)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+
+	rsp := viewImage(req)
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	return rsp
+}
+
+func storedImageChecksum(t *testing.T, accessType, fileName string) string {
+	t.Helper()
+
+	_, storagePath := validateAccessType(accessType)
+	content, err := ioutil.ReadFile(path.Join(storagePath, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := sha256.Sum256(content)
+	return hex.EncodeToString(checksum[:])
+}
+
+func TestViewImageValidators(t *testing.T) {
+	useTestImages(t)
+	modified := time.Date(2024, 5, 1, 12, 30, 15, 0, time.UTC)
+	writeTestImage(t, config.ConfigAccessTypePublic, "cat.png", 10, 10)
+	if err := os.Chtimes(path.Join(config.ConfigStorageDirectoryPublic, "cat.png"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	rsp := requestView(t, config.ConfigAccessTypePublic, "cat.png", "", nil)
+	etag := `"` + storedImageChecksum(t, config.ConfigAccessTypePublic, "cat.png") + `"`
+	if rsp.StatusCode != http.StatusOK || rsp.Header.Get("ETag") != etag {
+		t.Fatalf("Expected image served with ETag %s, got %d with %s", etag, rsp.StatusCode, rsp.Header.Get("ETag"))
+	}
+	if lastModified := rsp.Header.Get("Last-Modified"); lastModified != "Wed, 01 May 2024 12:30:15 GMT" {
+		t.Fatalf("Expected image served as last modified when stored, got %s", lastModified)
+	}
+	if cacheControl := rsp.Header.Get("Cache-Control"); cacheControl != config.ConfigCacheControlPublic {
+		t.Fatalf("Expected public image to be cached publicly, got %s", cacheControl)
+	}
+	if again := requestView(t, config.ConfigAccessTypePublic, "cat.png", "", nil); again.Header.Get("ETag") != etag {
+		t.Fatalf("Expected the same ETag serving the image again, got %s", again.Header.Get("ETag"))
+	}
+
+	for _, testCase := range []struct {
+		name   string
+		header map[string]string
+		status int
+	}{
+		{"matching ETag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"matching weak ETag", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{"any ETag", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"other ETag", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"unmodified since", map[string]string{"If-Modified-Since": "Wed, 01 May 2024 12:30:15 GMT"}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": "Wed, 01 May 2024 12:30:14 GMT"}, http.StatusOK},
+		{"invalid date", map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK},
+		// Dates are only precise to the second, so ETags are trusted over them.
+		{"other ETag unmodified since", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": "Wed, 01 May 2024 12:30:15 GMT"}, http.StatusOK},
+	} {
+		rsp := requestView(t, config.ConfigAccessTypePublic, "cat.png", "", testCase.header)
+		if rsp.StatusCode != testCase.status {
+			t.Fatalf("Expected %d with %s, got %d", testCase.status, testCase.name, rsp.StatusCode)
+		}
+		if rsp.Header.Get("ETag") != etag || rsp.Header.Get("Cache-Control") != config.ConfigCacheControlPublic {
+			t.Fatalf("Expected validators to be sent with %s, got %v", testCase.name, rsp.Header)
+		}
+		if testCase.status == http.StatusNotModified && rsp.Body != nil {
+			t.Fatalf("Expected no content with %s", testCase.name)
+		}
+	}
+
+	// Images replaced in place are served again to clients holding them.
+	writeTestImage(t, config.ConfigAccessTypePublic, "cat.png", 20, 10)
+	replaced := `"` + storedImageChecksum(t, config.ConfigAccessTypePublic, "cat.png") + `"`
+	rsp = requestView(t, config.ConfigAccessTypePublic, "cat.png", "", map[string]string{"If-None-Match": etag})
+	if rsp.StatusCode != http.StatusOK || rsp.Header.Get("ETag") != replaced || replaced == etag {
+		t.Fatalf("Expected replaced image served with ETag %s, got %d with %s", replaced, rsp.StatusCode, rsp.Header.Get("ETag"))
+	}
+}
+
+func TestViewPrivateImageCachedPrivately(t *testing.T) {
+	useTestImages(t)
+	writeTestImage(t, config.ConfigAccessTypePrivate, "cat.png", 10, 10)
+
+	rsp := requestView(t, config.ConfigAccessTypePrivate, "cat.png", testImageToken(t, "cat.png"), nil)
+	if cacheControl := rsp.Header.Get("Cache-Control"); cacheControl != config.ConfigCacheControlPrivate {
+		t.Fatalf("Expected private image to be cached privately, got %s", cacheControl)
+	}
+	if rsp.Header.Get("ETag") == "" || rsp.Header.Get("Last-Modified") == "" {
+		t.Fatalf("Expected private image to be served with validators, got %v", rsp.Header)
+	}
+}
@@ -0,0 +1,85 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/share"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+var maxShareValidity = time.Hour * 24 * 90
+
+func init() {
+	maxShareValidityParsed, err := time.ParseDuration(config.ConfigShareMaxValidity)
+	if err == nil && maxShareValidityParsed > 0 {
+		maxShareValidity = maxShareValidityParsed
+	}
+}
+
+func createShare(req typhon.Request) typhon.Response {
+	shareCreateRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ShareCreateRequest{}
+	err = json.Unmarshal(shareCreateRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	if !validateFilename(body.FileName) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", body.FileName), nil)}
+	}
+
+	validAccessType, storagePath := validateAccessType(body.AccessType)
+	if !validAccessType {
+		return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
+	}
+
+	if !fileExists(storagePath, body.FileName) {
+		return typhon.Response{Error: terrors.NotFound("not_found", fmt.Sprintf("Requested image %s is not found", body.FileName), nil)}
+	}
+
+	validity := time.Duration(body.ExpiresIn) * time.Second
+	if body.ExpiresIn <= 0 || validity > maxShareValidity {
+		return typhon.Response{Error: terrors.BadRequest("invalid_expiry", fmt.Sprintf("Share links must expire within %s", maxShareValidity), nil)}
+	}
+
+	if body.MaxViews < 0 {
+		return typhon.Response{Error: terrors.BadRequest("invalid_max_views", "Maximum views of share links cannot be negative", nil)}
+	}
+
+	if len(body.Password) > share.MaxPasswordLength {
+		return typhon.Response{Error: terrors.BadRequest("invalid_password", fmt.Sprintf("Share link passwords cannot be longer than %d bytes", share.MaxPasswordLength), nil)}
+	}
+
+	link, err := share.Create(req, body.FileName, body.AccessType, validity, body.MaxViews, body.Password)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered creating share link", nil)}
+	}
+
+	return req.Response(shareToResponse(link))
+}
@@ -0,0 +1,76 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/shortlink"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func createShortLink(req typhon.Request) typhon.Response {
+	shortLinkCreateRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ShortLinkCreateRequest{}
+	err = json.Unmarshal(shortLinkCreateRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	if !validateFilename(body.FileName) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", body.FileName), nil)}
+	}
+
+	validAccessType, storagePath := validateAccessType(body.AccessType)
+	if !validAccessType {
+		return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
+	}
+
+	if !fileExists(storagePath, body.FileName) {
+		return typhon.Response{Error: terrors.NotFound("not_found", fmt.Sprintf("Requested image %s is not found", body.FileName), nil)}
+	}
+
+	if body.Slug != "" && !shortlink.ValidSlug(body.Slug) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_slug", "Slugs must be up to 64 letters, digits, dashes or underscores", nil)}
+	}
+
+	if body.Mode == "" {
+		body.Mode = shortlink.ModeRedirect
+	}
+	if !shortlink.ValidMode(body.Mode) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_mode", fmt.Sprintf("Short links must be of mode %s or %s", shortlink.ModeRedirect, shortlink.ModeInline), nil)}
+	}
+
+	link, err := shortlink.Create(req, body.Slug, body.FileName, body.AccessType, body.Mode)
+	switch err {
+	case nil:
+	case shortlink.ErrSlugExists:
+		return typhon.Response{Error: terrors.BadRequest("slug_exists", fmt.Sprintf("Slug %s is already in use", body.Slug), nil)}
+	default:
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered creating short link", nil)}
+	}
+
+	return req.Response(shortLinkToResponse(link))
+}
@@ -11,7 +11,13 @@ import (
 
 	"github.com/chongyangshi/yronwood/auth"
 	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/metadata"
+	"github.com/chongyangshi/yronwood/optimize"
+	"github.com/chongyangshi/yronwood/share"
+	"github.com/chongyangshi/yronwood/shortlink"
+	"github.com/chongyangshi/yronwood/thumbnail"
 	"github.com/chongyangshi/yronwood/types"
+	"github.com/chongyangshi/yronwood/versions"
 )
 
 func deleteImage(req typhon.Request) typhon.Response {
@@ -46,12 +52,49 @@ func deleteImage(req typhon.Request) typhon.Response {
 		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", body.FileName), nil)}
 	}
 
+	if validAccessType, _ := validateAccessType(body.AccessType); !validAccessType {
+		return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
+	}
+
 	err = deleteStoredImageByAccessType(req, body.FileName, body.AccessType)
 	if err != nil {
 		slog.Error(req, "Could not delete file %s of type %s: %+v", body.FileName, body.AccessType, err)
 		return typhon.Response{Error: err}
 	}
 
+	// Previous versions and derived images are of no use once the image is gone, and
+	// must not resurface if a new image is uploaded under the same name.
+	err = versions.DeleteVersions(req, body.FileName, body.AccessType)
+	if err != nil {
+		slog.Error(req, "Could not delete versions of file %s of type %s: %v", body.FileName, body.AccessType, err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered deleting previous versions", nil)}
+	}
+
+	err = thumbnail.InvalidateDerivatives(req, body.FileName, body.AccessType)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered deleting derived images", nil)}
+	}
+
+	err = metadata.Delete(req, body.FileName, body.AccessType)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered deleting image metadata", nil)}
+	}
+
+	err = optimize.RemoveOriginal(req, body.FileName, body.AccessType)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered deleting original of image", nil)}
+	}
+
+	err = share.RevokeForImage(req, body.FileName, body.AccessType)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered revoking share links of image", nil)}
+	}
+
+	err = shortlink.DeleteForImage(req, body.FileName, body.AccessType)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered deleting short links of image", nil)}
+	}
+
 	return req.Response(nil)
 }
 
@@ -0,0 +1,50 @@
+package endpoints
+
+import (
+	"encoding/json"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/shortlink"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func deleteShortLink(req typhon.Request) typhon.Response {
+	shortLinkDeleteRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ShortLinkDeleteRequest{}
+	err = json.Unmarshal(shortLinkDeleteRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	deleted, err := shortlink.Delete(req, body.Slug)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered deleting short link", nil)}
+	}
+	if !deleted {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Short link is not found", nil)}
+	}
+
+	return req.Response(nil)
+}
@@ -0,0 +1,79 @@
+package endpoints
+
+import (
+	"context"
+	"sync"
+
+	"github.com/monzo/slog"
+)
+
+// Details of images uploaded before they were recorded are recorded when the images are
+// first described. Listings sorted by details of every image rather than just those
+// returned queue the images missing them, so that they are recorded in the background one
+// at a time by a worker started with the service, rather than by reading every image
+// within the request.
+
+const imageDetailsQueueSize = 1000
+
+var (
+	imageDetailsQueue      = make(chan imageDetailsJob, imageDetailsQueueSize)
+	imageDetailsWorkerOnce = sync.Once{}
+
+	queuedImageDetailsMutex sync.Mutex
+	queuedImageDetails      = map[imageDetailsJob]bool{}
+)
+
+type imageDetailsJob struct {
+	fileName    string
+	storagePath string
+	accessType  string
+}
+
+// queueImageDetails queues the details of the image to be recorded in the background,
+// unless already queued. If the queue is full the image is skipped, and its details will
+// be recorded when it is next described or queued.
+func queueImageDetails(ctx context.Context, fileName, storagePath, accessType string) {
+	job := imageDetailsJob{fileName: fileName, storagePath: storagePath, accessType: accessType}
+	queuedImageDetailsMutex.Lock()
+	defer queuedImageDetailsMutex.Unlock()
+	if queuedImageDetails[job] {
+		return
+	}
+
+	select {
+	case imageDetailsQueue <- job:
+		queuedImageDetails[job] = true
+	default:
+		slog.Warn(ctx, "Image details queue is full, details of %s will be recorded when described", fileName)
+	}
+}
+
+// StartImageDetailsWorker starts recording the details of queued images in the
+// background, until the context is done.
+func StartImageDetailsWorker(ctx context.Context) {
+	imageDetailsWorkerOnce.Do(func() {
+		slog.Info(ctx, "Starting image details worker")
+		go runImageDetailsWorker(ctx)
+	})
+}
+
+func runImageDetailsWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-imageDetailsQueue:
+			recordQueuedImageDetails(ctx, job)
+		}
+	}
+}
+
+func recordQueuedImageDetails(ctx context.Context, job imageDetailsJob) {
+	if _, err := getImageDetails(ctx, job.fileName, job.storagePath, job.accessType); err != nil {
+		slog.Error(ctx, "Could not record queued details of image %s of access type %s: %v", job.fileName, job.accessType, err)
+	}
+
+	queuedImageDetailsMutex.Lock()
+	delete(queuedImageDetails, job)
+	queuedImageDetailsMutex.Unlock()
+}
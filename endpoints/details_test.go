@@ -0,0 +1,176 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/exif"
+	"github.com/chongyangshi/yronwood/metadata"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+// writeTestPhoto stores a JPEG image with EXIF data recording when it was taken, if given,
+// and when it was uploaded.
+func writeTestPhoto(t *testing.T, fileName, taken string, uploaded time.Time) {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	photo := encoded.Bytes()
+	if taken != "" {
+		// A little-endian TIFF header, followed by the image directory pointing to the
+		// photo directory, which holds only when the photo was taken.
+		var tiff bytes.Buffer
+		tiff.Write([]byte{'I', 'I', 0x2A, 0})
+		for _, value := range []interface{}{
+			uint32(8),
+			uint16(1), uint16(exif.TagExifPointer), uint16(4), uint32(1), uint32(26), uint32(0),
+			uint16(1), uint16(exif.TagDateTimeOriginal), uint16(2), uint32(len(taken) + 1), uint32(44), uint32(0),
+		} {
+			binary.Write(&tiff, binary.LittleEndian, value)
+		}
+		tiff.WriteString(taken + "\x00")
+
+		var segment bytes.Buffer
+		segment.Write([]byte{0xFF, 0xE1})
+		binary.Write(&segment, binary.BigEndian, uint16(2+6+tiff.Len()))
+		segment.WriteString("Exif\x00\x00")
+		segment.Write(tiff.Bytes())
+		photo = append(append(append([]byte{}, photo[:2]...), segment.Bytes()...), photo[2:]...)
+	}
+
+	filePath := path.Join(config.ConfigStorageDirectoryPublic, fileName)
+	if err := ioutil.WriteFile(filePath, photo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filePath, uploaded, uploaded); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func requestListByTaken(t *testing.T) []string {
+	t.Helper()
+
+	rsp := listImages(typhon.NewRequest(context.Background(), http.MethodPost, "https://images.example/list", types.ImageListRequest{
+		AccessType: config.ConfigAccessTypePublic,
+		Sort:       sortTaken,
+	}))
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	listed := types.ImageListResponse{}
+	if err := rsp.Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+
+	fileNames := []string{}
+	for _, image := range listed.Images {
+		fileNames = append(fileNames, image.FileName)
+	}
+	return fileNames
+}
+
+// recordQueuedImageDetailsNow records the details of every queued image as the worker
+// would, returning the images recorded.
+func recordQueuedImageDetailsNow(t *testing.T) []imageDetailsJob {
+	t.Helper()
+
+	jobs := []imageDetailsJob{}
+	for {
+		select {
+		case job := <-imageDetailsQueue:
+			recordQueuedImageDetails(context.Background(), job)
+			jobs = append(jobs, job)
+		default:
+			return jobs
+		}
+	}
+}
+
+func TestListImagesByTaken(t *testing.T) {
+	useTestImages(t)
+	recordQueuedImageDetailsNow(t)
+	t.Cleanup(func() { recordQueuedImageDetailsNow(t) })
+
+	writeTestPhoto(t, "first.jpg", "2020:01:02 03:04:05", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	writeTestPhoto(t, "second.jpg", "", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	writeTestPhoto(t, "third.jpg", "2022:01:02 03:04:05", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// Until their details are recorded, images are sorted by when they were uploaded.
+	if listed := fmt.Sprint(requestListByTaken(t)); listed != "[first.jpg third.jpg second.jpg]" {
+		t.Fatalf("Expected images to be sorted by when they were uploaded, got %s", listed)
+	}
+
+	// Images without a taken time are sorted by when they were uploaded among the rest.
+	if listed := fmt.Sprint(requestListByTaken(t)); listed != "[third.jpg second.jpg first.jpg]" {
+		t.Fatalf("Expected images to be sorted by when they were taken, got %s", listed)
+	}
+
+	record, err := metadata.Get(context.Background(), "first.jpg", config.ConfigAccessTypePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Exif == nil || record.Exif.Taken == nil || !record.Exif.Taken.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("Expected when the image was taken to be recorded, got %+v", record.Exif)
+	}
+}
+
+func TestListImagesByTakenRecordsMissingDetails(t *testing.T) {
+	useTestImages(t)
+	recordQueuedImageDetailsNow(t)
+	t.Cleanup(func() { recordQueuedImageDetailsNow(t) })
+
+	uploaded := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < pagingCount; i++ {
+		writeTestPhoto(t, fmt.Sprintf("recent-%02d.jpg", i), "", uploaded.Add(time.Duration(i)*time.Hour))
+	}
+	// Uploaded long ago, but taken after every other image.
+	writeTestPhoto(t, "scanned.jpg", "2025:01:02 03:04:05", time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	listed := requestListByTaken(t)
+	if len(listed) != pagingCount || listed[0] != "recent-20.jpg" {
+		t.Fatalf("Expected the most recently uploaded page of images, got %v", listed)
+	}
+
+	// The image beyond the page returned is left to be recorded in the background.
+	if record, err := metadata.Get(context.Background(), "scanned.jpg", config.ConfigAccessTypePublic); err != nil || record.DetailsVersion != 0 {
+		t.Fatalf("Expected details of image beyond the page to not be recorded while listing, got %+v and %v", record, err)
+	}
+	_, storagePath := validateAccessType(config.ConfigAccessTypePublic)
+	queueImageDetails(context.Background(), "scanned.jpg", storagePath, config.ConfigAccessTypePublic)
+	jobs := recordQueuedImageDetailsNow(t)
+	if len(jobs) != pagingCount+1 {
+		t.Fatalf("Expected every image to be queued once, got %+v", jobs)
+	}
+
+	record, err := metadata.Get(context.Background(), "scanned.jpg", config.ConfigAccessTypePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.DetailsVersion != imageDetailsVersion || record.Width != 8 || record.Height != 8 || record.Exif == nil || record.Exif.Taken == nil {
+		t.Fatalf("Expected details of queued image to be recorded, got %+v", record)
+	}
+
+	if listed := requestListByTaken(t); listed[0] != "scanned.jpg" {
+		t.Fatalf("Expected image taken most recently to be listed first once recorded, got %v", listed)
+	}
+	if jobs := recordQueuedImageDetailsNow(t); len(jobs) != 0 {
+		t.Fatalf("Expected nothing to be queued once recorded, got %+v", jobs)
+	}
+}
@@ -0,0 +1,83 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/exif"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func getExif(req typhon.Request) typhon.Response {
+	imageExifRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ImageExifRequest{}
+	err = json.Unmarshal(imageExifRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	// Auth required for all access types, as EXIF data can include where and when images
+	// were taken.
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	if !validateFilename(body.FileName) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", body.FileName), nil)}
+	}
+
+	validAccessType, storagePath := validateAccessType(body.AccessType)
+	if !validAccessType {
+		return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
+	}
+
+	file, err := ioutil.ReadFile(path.Join(storagePath, body.FileName))
+	if os.IsNotExist(err) {
+		return typhon.Response{Error: terrors.NotFound("not_found", fmt.Sprintf("Requested image %s is not found", body.FileName), nil)}
+	} else if err != nil {
+		slog.Error(req, "Error reading file %s of type %s: %v", body.FileName, body.AccessType, err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered reading image", nil)}
+	}
+
+	response := types.ImageExifResponse{Tags: []types.ImageExifTag{}}
+	data, err := exif.Decode(file)
+	if err == exif.ErrNoExif {
+		return req.Response(response)
+	} else if err != nil {
+		slog.Error(req, "Error decoding EXIF data of %s of type %s: %v", body.FileName, body.AccessType, err)
+		return typhon.Response{Error: terrors.InternalService("bad_exif", "EXIF data of the image could not be read", nil)}
+	}
+
+	for _, tag := range data.Tags {
+		response.Tags = append(response.Tags, types.ImageExifTag{
+			Directory: tag.Directory,
+			ID:        int(tag.ID),
+			Name:      tag.Name(),
+			Value:     tag.String(),
+		})
+	}
+
+	return req.Response(response)
+}
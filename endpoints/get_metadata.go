@@ -0,0 +1,98 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func getMetadata(req typhon.Request) typhon.Response {
+	imageMetadataRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ImageMetadataRequest{}
+	err = json.Unmarshal(imageMetadataRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	validAccessType, storagePath := validateAccessType(body.AccessType)
+	if !validAccessType {
+		return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
+	}
+
+	if !validateFilename(body.FileName) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", body.FileName), nil)}
+	}
+
+	// As with viewing images, only private images require authentication, with either
+	// an admin token or a token pre-signed for the image.
+	if body.AccessType == config.ConfigAccessTypePrivate {
+		if body.Token == "" && body.ImageToken == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+
+		var authenticated bool
+		if body.Token != "" {
+			authenticated, err = auth.VerifyAdminToken(body.Token)
+		} else {
+			authenticated, err = auth.VerifyImageToken(body.ImageToken, fmt.Sprintf("%s/%s", config.ConfigAccessTypePrivate, body.FileName))
+		}
+		if err != nil {
+			slog.Error(req, "Error authenticating client: %v", err)
+			return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+		}
+		if !authenticated {
+			return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+		}
+	}
+
+	fileInfo, err := os.Stat(path.Join(storagePath, body.FileName))
+	if os.IsNotExist(err) {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Requested image is not found", nil)}
+	} else if err != nil {
+		slog.Error(req, "Error checking file %s of type %s: %v", body.FileName, body.AccessType, err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered reading image", nil)}
+	}
+
+	tags, err := readTags(req, storagePath, body.FileName)
+	if err != nil {
+		slog.Error(req, "Error reading tags of %s of type %s: %v", body.FileName, body.AccessType, err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered reading image", nil)}
+	}
+
+	imageMeta := imageMetadata{
+		FileName:   body.FileName,
+		Tags:       tags,
+		AccessPath: body.AccessType,
+		Uploaded:   fileInfo.ModTime(),
+	}
+
+	if body.AccessType == config.ConfigAccessTypePrivate {
+		imageMeta.ImageToken, err = auth.SignImageToken(imageTokenValidity, fmt.Sprintf("%s/%s", config.ConfigAccessTypePrivate, body.FileName))
+		if err != nil {
+			slog.Error(req, "Error pre-signing image %s: %v", body.FileName, err)
+			return typhon.Response{Error: terrors.InternalService("", "Error encountered reading image", nil)}
+		}
+	}
+
+	if err := describeImage(req, &imageMeta); err != nil {
+		slog.Error(req, "Error describing image %s: %v", body.FileName, err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered reading image", nil)}
+	}
+
+	return req.Response(internalMetadataToResponseList([]imageMetadata{imageMeta})[0])
+}
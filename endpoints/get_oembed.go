@@ -0,0 +1,167 @@
+package endpoints
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/thumbnail"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func getOEmbed(req typhon.Request) typhon.Response {
+	err := req.ParseForm()
+	if err != nil {
+		slog.Error(req, "Error processing query params: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	// Error responses are read back by filters, so this carries an error body like them.
+	if format := req.FormValue("format"); format != "" && format != "json" {
+		rsp := typhon.NewResponse(req)
+		rsp.StatusCode = http.StatusNotImplemented
+		rsp.Encode(basicError{Code: "format_not_implemented", Message: fmt.Sprintf("Format %s is not implemented", format)})
+		return rsp
+	}
+
+	maxDimensions := map[string]int{}
+	for _, formKey := range []string{"maxwidth", "maxheight"} {
+		if req.FormValue(formKey) == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(req.FormValue(formKey))
+		if err != nil || parsed <= 0 {
+			return typhon.Response{Error: terrors.BadRequest("invalid_dimension", fmt.Sprintf("Dimension %s must be a positive number", formKey), nil)}
+		}
+		maxDimensions[formKey] = parsed
+	}
+
+	// Links to the preview page and to the image itself can both be embedded.
+	embedURL, err := url.Parse(req.FormValue("url"))
+	if err != nil {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Requested image is not found", nil)}
+	}
+	embedPath := embedURL.Path
+	if publicURL, err := url.Parse(config.ConfigPublicURL); err == nil {
+		embedPath = strings.TrimPrefix(embedPath, strings.TrimSuffix(publicURL.Path, "/"))
+	}
+	success, accessType, fileName := processURI(embedPath)
+	if !success || (!strings.HasPrefix(embedPath, "/p/") && !strings.HasPrefix(embedPath, "/uploads/")) {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Requested image is not found", nil)}
+	}
+
+	baseURL := previewBaseURL(req)
+	token := embedURL.Query().Get("token")
+	preview, err := getImagePreview(req, baseURL, fileName, accessType, token)
+	if err != nil {
+		return typhon.Response{Error: err}
+	}
+
+	response := types.OEmbedResponse{
+		Type:         "link",
+		Version:      "1.0",
+		Title:        preview.Title,
+		ProviderName: config.ConfigPreviewSiteName,
+		ProviderURL:  baseURL,
+	}
+	if preview.Width > 0 && preview.Height > 0 {
+		response.Type = "photo"
+		response.URL, response.Width, response.Height = preview.ImageURL, preview.Width, preview.Height
+
+		// Images larger than the consumer allows are embedded as the largest derivative we
+		// already make which fits, as dimensions chosen by consumers are never signed.
+		maxWidth, maxHeight := maxDimensions["maxwidth"], maxDimensions["maxheight"]
+		if (maxWidth > 0 && preview.Width > maxWidth) || (maxHeight > 0 && preview.Height > maxHeight) {
+			derivative, found, err := fittingDerivative(accessType, fileName, token, preview.Width, preview.Height, maxWidth, maxHeight)
+			if err != nil {
+				slog.Error(req, "Error signing derivative of %s to embed: %v", fileName, err)
+				return typhon.Response{Error: terrors.InternalService("", "Error encountered signing resized image", nil)}
+			}
+			if found {
+				response.URL = fmt.Sprintf("%s%s", baseURL, derivative.url)
+				response.Width, response.Height = derivative.width, derivative.height
+			}
+		}
+	}
+
+	rsp := req.Response(response)
+	setPreviewCacheControl(rsp, accessType)
+	return rsp
+}
+
+type embeddedDerivative struct {
+	url    string // Relative to the API host
+	width  int
+	height int
+}
+
+// fittingDerivative returns the largest derivative of the image configured as a preset or
+// listed in srcsets which fits within the maximum dimensions, where they are set. Only
+// derivatives scaled to fit are considered, as only their dimensions follow from those of
+// the image, and none larger than the image. Private images are embedded with the token
+// the consumer was given, rather than with one signed for longer.
+func fittingDerivative(accessType, fileName, token string, width, height, maxWidth, maxHeight int) (embeddedDerivative, bool, error) {
+	fits := func(params thumbnail.DerivativeParams) (int, int, bool) {
+		if params.Fit != thumbnail.FitContain {
+			return 0, 0, false
+		}
+		fittedWidth, fittedHeight := params.ContainDimensions(width, height)
+		if fittedWidth >= width || fittedHeight >= height {
+			return 0, 0, false
+		}
+		return fittedWidth, fittedHeight, (maxWidth == 0 || fittedWidth <= maxWidth) && (maxHeight == 0 || fittedHeight <= maxHeight)
+	}
+
+	// Presets are preferred over srcset widths of the same size, as their URLs need no
+	// signature.
+	fitting := embeddedDerivative{}
+	for _, preset := range thumbnail.DerivativePresetNames() {
+		params, _ := thumbnail.PresetDerivativeParams(preset)
+		fittedWidth, fittedHeight, fit := fits(params)
+		if !fit || fittedWidth*fittedHeight <= fitting.width*fitting.height {
+			continue
+		}
+		fitting = embeddedDerivative{
+			url:    fmt.Sprintf("/uploads/%s/%s?preset=%s", url.PathEscape(accessType), url.PathEscape(fileName), url.QueryEscape(preset)),
+			width:  fittedWidth,
+			height: fittedHeight,
+		}
+	}
+
+	for _, srcsetWidth := range srcsetWidths {
+		params := thumbnail.DerivativeParams{
+			Width: srcsetWidth,
+			Fit:   thumbnail.FitContain,
+		}
+		if params.Validate() != nil {
+			// Wider than derivatives are allowed to be.
+			break
+		}
+		fittedWidth, fittedHeight, fit := fits(params)
+		if !fit || fittedWidth*fittedHeight <= fitting.width*fitting.height {
+			continue
+		}
+
+		derivativeURL, err := signDerivativeParamsURL(accessType, fileName, params)
+		if err != nil {
+			return embeddedDerivative{}, false, err
+		}
+		fitting = embeddedDerivative{url: derivativeURL, width: fittedWidth, height: fittedHeight}
+	}
+
+	if fitting.url == "" {
+		return embeddedDerivative{}, false, nil
+	}
+	if accessType == config.ConfigAccessTypePrivate {
+		fitting.url = fmt.Sprintf("%s&token=%s", fitting.url, url.QueryEscape(token))
+	}
+
+	return fitting, true, nil
+}
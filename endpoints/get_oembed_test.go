@@ -0,0 +1,133 @@
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func requestOEmbed(query url.Values) typhon.Response {
+	req := typhon.NewRequest(context.Background(), http.MethodGet, "https://images.example/oembed?"+query.Encode(), nil)
+	return getOEmbed(req)
+}
+
+func TestGetOEmbed(t *testing.T) {
+	useTestImages(t)
+	defer func(configured []int) { srcsetWidths = configured }(srcsetWidths)
+	srcsetWidths = []int{400, 800, 1200}
+	writeTestImage(t, config.ConfigAccessTypePublic, "wide.png", 2000, 1000)
+
+	for _, testCase := range []struct {
+		name      string
+		maxWidth  string
+		maxHeight string
+		url       string // Relative to https://images.example
+		width     int
+		height    int
+	}{
+		{"original", "", "", "/uploads/public/wide.png", 2000, 1000},
+		{"original within maximum", "2000", "1000", "/uploads/public/wide.png", 2000, 1000},
+		{"preset", "1000", "", "/uploads/public/wide.png?preset=medium", 800, 400},
+		{"preset within height", "", "450", "/uploads/public/wide.png?preset=medium", 800, 400},
+		{"srcset width", "1300", "", "/uploads/public/wide.png?w=1200&h=0&fit=contain&gravity=center&sig=", 1200, 600},
+		{"nothing fits", "", "100", "/uploads/public/wide.png", 2000, 1000},
+	} {
+		query := url.Values{"url": {"https://images.example/p/public/wide.png"}}
+		if testCase.maxWidth != "" {
+			query.Set("maxwidth", testCase.maxWidth)
+		}
+		if testCase.maxHeight != "" {
+			query.Set("maxheight", testCase.maxHeight)
+		}
+
+		rsp := requestOEmbed(query)
+		if rsp.Error != nil {
+			t.Fatalf("Unexpected error embedding %s: %v", testCase.name, rsp.Error)
+		}
+		embedded := types.OEmbedResponse{}
+		if err := rsp.Decode(&embedded); err != nil {
+			t.Fatal(err)
+		}
+		if embedded.Type != "photo" || embedded.Title != "wide.png" || embedded.ProviderURL != "https://images.example" {
+			t.Fatalf("Expected photo embedding %s, got %+v", testCase.name, embedded)
+		}
+		if !strings.HasPrefix(embedded.URL, "https://images.example"+testCase.url) || embedded.Width != testCase.width || embedded.Height != testCase.height {
+			t.Fatalf("Expected %s to embed %s at %dx%d, got %s at %dx%d", testCase.name, testCase.url, testCase.width, testCase.height, embedded.URL, embedded.Width, embedded.Height)
+		}
+	}
+}
+
+func TestGetOEmbedPrivate(t *testing.T) {
+	useTestImages(t)
+	writeTestImage(t, config.ConfigAccessTypePrivate, "wide.png", 2000, 1000)
+	token := testImageToken(t, "wide.png")
+
+	// Derivatives of private images are embedded with the token the consumer was given,
+	// rather than with one signed anew.
+	rsp := requestOEmbed(url.Values{
+		"url":      {"https://images.example/uploads/private/wide.png?token=" + url.QueryEscape(token)},
+		"maxwidth": {"500"},
+	})
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	embedded := types.OEmbedResponse{}
+	if err := rsp.Decode(&embedded); err != nil {
+		t.Fatal(err)
+	}
+	expectedURL := "https://images.example/uploads/private/wide.png?preset=small&token=" + url.QueryEscape(token)
+	if embedded.URL != expectedURL || embedded.Width != 400 || embedded.Height != 200 {
+		t.Fatalf("Expected %s at 400x200, got %s at %dx%d", expectedURL, embedded.URL, embedded.Width, embedded.Height)
+	}
+	if cacheControl := rsp.Header.Get("Cache-Control"); cacheControl != config.ConfigCacheControlPrivate {
+		t.Fatalf("Expected private caching of private embed, got %s", cacheControl)
+	}
+
+	for _, testCase := range []struct {
+		url  string
+		code string
+	}{
+		{"https://images.example/uploads/private/wide.png", terrors.ErrUnauthorized},
+		{"https://images.example/uploads/private/wide.png?token=" + url.QueryEscape(testImageToken(t, "other.png")), terrors.ErrForbidden},
+	} {
+		rsp := requestOEmbed(url.Values{"url": {testCase.url}})
+		if !terrors.PrefixMatches(rsp.Error, testCase.code) {
+			t.Fatalf("Expected %s embedding %s, got %v", testCase.code, testCase.url, rsp.Error)
+		}
+	}
+}
+
+func TestGetOEmbedInvalid(t *testing.T) {
+	useTestImages(t)
+	writeTestImage(t, config.ConfigAccessTypePublic, "wide.png", 2000, 1000)
+
+	rsp := requestOEmbed(url.Values{"url": {"https://images.example/p/public/wide.png"}, "format": {"xml"}})
+	if rsp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("Expected XML format to not be implemented, got %d", rsp.StatusCode)
+	}
+
+	for _, testCase := range []struct {
+		query url.Values
+		code  string
+	}{
+		{url.Values{"url": {"https://images.example/p/public/wide.png"}, "maxwidth": {"wide"}}, terrors.ErrBadRequest},
+		{url.Values{"url": {"https://images.example/p/public/wide.png"}, "maxheight": {"-1"}}, terrors.ErrBadRequest},
+		{url.Values{"url": {"https://images.example/p/public/missing.png"}}, terrors.ErrNotFound},
+		{url.Values{"url": {"https://images.example/shares/list"}}, terrors.ErrNotFound},
+		{url.Values{"url": {"https://images.example/p/secret/wide.png"}}, terrors.ErrNotFound},
+		{url.Values{}, terrors.ErrNotFound},
+	} {
+		rsp := requestOEmbed(testCase.query)
+		if !terrors.PrefixMatches(rsp.Error, testCase.code) {
+			t.Fatalf("Expected %s embedding with %v, got %v", testCase.code, testCase.query, rsp.Error)
+		}
+	}
+}
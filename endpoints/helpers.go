@@ -7,24 +7,40 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/monzo/slog"
 	"github.com/monzo/terrors"
 
 	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/exif"
+	"github.com/chongyangshi/yronwood/metadata"
+	"github.com/chongyangshi/yronwood/optimize"
+	"github.com/chongyangshi/yronwood/svg"
+	"github.com/chongyangshi/yronwood/thumbnail"
 )
 
-const tagSeparator = "|"
+const (
+	tagSeparator   = "|"
+	svgContentType = "image/svg+xml"
+
+	// Raised whenever recordImageDetails records something new, so that images recorded
+	// before are recorded again when listed.
+	imageDetailsVersion = 2
+)
 
 var (
 	permittedExtensions        = strings.Split(config.ConfigPermittedExtensions, "|")
 	permittedComposition       = regexp.MustCompile(`[a-zA-Z0-9-_]+`)
 	maxFileNameSize      int64 = 1024
+	maxDisplayNameSize         = 255 // Bytes, as most file systems allow for file names
 )
 
 func init() {
@@ -59,6 +75,43 @@ func validateChecksum(payload []byte, checksum string) (bool, error) {
 	return false, nil
 }
 
+// decodePayload verifies the checksum of a base64-encoded image payload from the
+// client and decodes it, returning a client error if either step fails.
+func decodePayload(ctx context.Context, payload, checksum string) ([]byte, error) {
+	if len(payload) == 0 || len(payload) > int(maxUploadSize) {
+		return nil, terrors.BadRequest("bad_file_size", "Content length of payload is too large", nil)
+	}
+
+	validChecksum, err := validateChecksum([]byte(payload), checksum)
+	if err != nil || !validChecksum {
+		return nil, terrors.BadRequest("bad_payload", "Invalid payload, could not verify checksum", nil)
+	}
+
+	decodedPayload, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		slog.Error(ctx, "Error decoding base64 payload: %v", err)
+		return nil, terrors.BadRequest("bad_payload", "Invalid payload, could not decode", nil)
+	}
+
+	return decodedPayload, nil
+}
+
+// sanitizePayload removes active content from image formats which can carry it, and
+// returns a client error if such an image cannot be parsed.
+func sanitizePayload(ctx context.Context, fileName string, payload []byte) ([]byte, error) {
+	if getContentTypeFromFilename(fileName) != svgContentType {
+		return payload, nil
+	}
+
+	sanitizedPayload, err := svg.Sanitize(payload)
+	if err != nil {
+		slog.Error(ctx, "Error sanitizing SVG payload for %s: %v", fileName, err)
+		return nil, terrors.BadRequest("bad_payload", "Invalid payload, could not parse SVG image", nil)
+	}
+
+	return sanitizedPayload, nil
+}
+
 func getContentTypeFromFilename(fileName string) string {
 	fileNameSplit := strings.SplitN(fileName, ".", 2)
 	if len(fileNameSplit) != 2 {
@@ -98,6 +151,23 @@ func validateFilename(fileName string) bool {
 	return true
 }
 
+// validateDisplayName returns whether the name can be given as the name of an image when
+// downloaded. Display names are only ever sent in headers, so they may contain anything
+// but control characters and path separators, which browsers would not save as given.
+func validateDisplayName(displayName string) bool {
+	if strings.TrimSpace(displayName) == "" || len(displayName) > maxDisplayNameSize || !utf8.ValidString(displayName) {
+		return false
+	}
+
+	for _, character := range displayName {
+		if unicode.IsControl(character) || character == '/' || character == '\\' {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Converts a filename and optionally a list of tags into an encoded filename for storage.
 // Returns an error if the file name is invalid.
 func validateAndEncodeFileNameWithTags(fileName string, tags []string) (string, error) {
@@ -189,23 +259,31 @@ func accessTypeToPaths(accessType string) map[string]string {
 	return nil
 }
 
-// readFile queries directory for existence of file, and if exists, return content
-// as bytes. The fileName MUST be validated by validateFilename() before passing in.
-func readFile(ctx context.Context, storagePath, fileName string) []byte {
+// openFile queries directory for existence of file, and if exists, opens it for reading.
+// The caller is responsible for closing the file. The fileName MUST be validated by
+// validateFilename() before passing in.
+func openFile(ctx context.Context, storagePath, fileName string) *os.File {
 	filePath := path.Join(storagePath, fileName)
 	if _, err := os.Stat(filePath); err != nil {
 		return nil
 	}
 
-	file, err := ioutil.ReadFile(filePath)
+	file, err := os.Open(filePath)
 	if err != nil {
-		slog.Debug(ctx, "Could not read file %s: %v", filePath, err)
+		slog.Debug(ctx, "Could not open file %s: %v", filePath, err)
 		return nil
 	}
 
 	return file
 }
 
+// fileExists returns whether a file of the given name exists in the storage directory.
+// The fileName MUST be validated by validateFilename() before passing in.
+func fileExists(storagePath, fileName string) bool {
+	_, err := os.Stat(path.Join(storagePath, fileName))
+	return err == nil
+}
+
 // deleteFile queries directory for existence of file, and if exists, delete
 // the file. If any symlinks with the same file name suffix exists, then
 // delete the symlinks as well.
@@ -222,6 +300,13 @@ func deleteFile(ctx context.Context, storagePath, fileName string) error {
 		return err
 	}
 
+	return deleteTagSymlinks(ctx, storagePath, fileName)
+}
+
+// deleteTagSymlinks removes any symlinks carrying tags for the file name in
+// the storage directory, leaving the original file itself untouched.
+func deleteTagSymlinks(ctx context.Context, storagePath, fileName string) error {
+	filePath := path.Join(storagePath, fileName)
 	pathFiles, err := ioutil.ReadDir(storagePath)
 	if err != nil {
 		slog.Error(ctx, "Could not list directory for file %s: %v", storagePath, err)
@@ -229,7 +314,7 @@ func deleteFile(ctx context.Context, storagePath, fileName string) error {
 	}
 
 	for _, file := range pathFiles {
-		if !strings.HasSuffix(file.Name(), fileName) {
+		if !strings.HasSuffix(file.Name(), tagSeparator+fileName) {
 			continue
 		}
 
@@ -253,3 +338,165 @@ func deleteFile(ctx context.Context, storagePath, fileName string) error {
 
 	return nil
 }
+
+// readTags returns the tags of the file name, from the symlinks carrying them in the
+// storage directory.
+func readTags(ctx context.Context, storagePath, fileName string) ([]string, error) {
+	pathFiles, err := ioutil.ReadDir(storagePath)
+	if err != nil {
+		slog.Error(ctx, "Could not list directory for file %s: %v", storagePath, err)
+		return nil, err
+	}
+
+	for _, file := range pathFiles {
+		if !strings.HasSuffix(file.Name(), tagSeparator+fileName) || file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		_, tags, err := decodeFileNameWithTags(file.Name())
+		return tags, err
+	}
+
+	return nil, nil
+}
+
+// optimizeUpload optimizes the uploaded image according to the policy of its access type,
+// returning what to store and the bytes saved. The image as uploaded is kept if optimized
+// and the policy says so, and otherwise any original kept of previous content of the image
+// is removed, as it no longer matches.
+func optimizeUpload(ctx context.Context, fileName, accessType string, payload []byte) ([]byte, int64, error) {
+	policy := optimize.PolicyForAccessType(accessType)
+	optimizedPayload, optimized := optimize.Optimize(ctx, fileName, payload, policy.Mode)
+	if optimized && policy.KeepOriginal {
+		if err := optimize.KeepOriginal(ctx, fileName, accessType, payload); err != nil {
+			return nil, 0, err
+		}
+	} else if err := optimize.RemoveOriginal(ctx, fileName, accessType); err != nil {
+		return nil, 0, err
+	}
+
+	return optimizedPayload, int64(len(payload) - len(optimizedPayload)), nil
+}
+
+// recordImageDetails works out the dimensions, size, content type, checksum and EXIF
+// summary of the stored image and records them in its metadata.
+func recordImageDetails(ctx context.Context, fileName, storagePath, accessType string) (metadata.Record, error) {
+	file, err := ioutil.ReadFile(path.Join(storagePath, fileName))
+	if err != nil {
+		slog.Error(ctx, "Could not read file %s in %s to record details: %v", fileName, storagePath, err)
+		return metadata.Record{}, err
+	}
+
+	width, height, err := thumbnail.GetImageDimensions(fileName, storagePath)
+	if err != nil {
+		// Still worth recording the rest for images we cannot decode.
+		slog.Warn(ctx, "Could not read dimensions of image %s: %v", fileName, err)
+	}
+	checksum := sha256.Sum256(file)
+
+	var exifSummary *metadata.Exif
+	exifData, err := exif.Decode(file)
+	switch err {
+	case nil:
+		// Where a photo was taken can reveal where someone lives, so it is only kept for
+		// images which are not shown to others.
+		exifSummary = summariseExif(exifData, accessType == config.ConfigAccessTypePrivate)
+	case exif.ErrNoExif:
+	default:
+		slog.Warn(ctx, "Could not read EXIF data of image %s: %v", fileName, err)
+	}
+
+	record := metadata.Record{}
+	err = metadata.Update(ctx, fileName, accessType, func(updated *metadata.Record) {
+		updated.Width = width
+		updated.Height = height
+		updated.Size = int64(len(file))
+		updated.ContentType = getContentTypeFromFilename(fileName)
+		updated.SHA256 = hex.EncodeToString(checksum[:])
+		updated.Exif = exifSummary
+		updated.DetailsVersion = imageDetailsVersion
+		record = *updated
+	})
+
+	return record, err
+}
+
+// getImageDetails returns the metadata of the stored image, recording its details first
+// if the image was uploaded before they were recorded.
+func getImageDetails(ctx context.Context, fileName, storagePath, accessType string) (metadata.Record, error) {
+	record, err := metadata.Get(ctx, fileName, accessType)
+	if err != nil {
+		return metadata.Record{}, err
+	}
+	if record.DetailsVersion >= imageDetailsVersion {
+		return record, nil
+	}
+
+	return recordImageDetails(ctx, fileName, storagePath, accessType)
+}
+
+// summariseExif picks out how a photo was taken from its EXIF data, returning nil if
+// none of it is present.
+func summariseExif(data *exif.Data, includePosition bool) *metadata.Exif {
+	summary := metadata.Exif{}
+	found := false
+
+	if taken, ok := data.Taken(); ok {
+		summary.Taken = &taken
+		found = true
+	}
+
+	for _, text := range []struct {
+		directory string
+		id        uint16
+		value     *string
+	}{
+		{exif.DirectoryImage, exif.TagMake, &summary.CameraMake},
+		{exif.DirectoryImage, exif.TagModel, &summary.CameraModel},
+		{exif.DirectoryPhoto, exif.TagLensModel, &summary.LensModel},
+		{exif.DirectoryPhoto, exif.TagExposureTime, &summary.ExposureTime},
+	} {
+		if tag, ok := data.Get(text.directory, text.id); ok {
+			*text.value = strings.TrimSpace(tag.String())
+			found = found || *text.value != ""
+		}
+	}
+
+	for _, number := range []struct {
+		id    uint16
+		value *float64
+	}{
+		{exif.TagFNumber, &summary.FNumber},
+		{exif.TagFocalLength, &summary.FocalLength},
+	} {
+		if tag, ok := data.Get(exif.DirectoryPhoto, number.id); ok && len(tag.Numbers) > 0 && isFinite(tag.Numbers[0]) {
+			*number.value = tag.Numbers[0]
+			found = true
+		}
+	}
+
+	if tag, ok := data.Get(exif.DirectoryPhoto, exif.TagISOSpeedRatings); ok && len(tag.Numbers) > 0 && isFinite(tag.Numbers[0]) {
+		summary.ISO = int(tag.Numbers[0])
+		found = true
+	}
+
+	if includePosition {
+		if latitude, longitude, ok := data.Position(); ok {
+			summary.Latitude = &latitude
+			summary.Longitude = &longitude
+			found = true
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	return &summary
+}
+
+// isFinite reports whether the number can be recorded, as rationals with a denominator of
+// zero are not.
+func isFinite(number float64) bool {
+	return !math.IsNaN(number) && !math.IsInf(number, 0)
+}
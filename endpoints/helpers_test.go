@@ -0,0 +1,98 @@
+package endpoints
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"image"
+	"image/png"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/metadata"
+	"github.com/chongyangshi/yronwood/share"
+	"github.com/chongyangshi/yronwood/shortlink"
+	"github.com/chongyangshi/yronwood/store"
+)
+
+// useTestImages stores images, their records and links to them in temporary directories for
+// the duration of the test, and signs tokens with a key generated for it.
+func useTestImages(t *testing.T) {
+	t.Helper()
+
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedKey, err := x509.MarshalECPrivateKey(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for configured, value := range map[*string]string{
+		&config.ConfigStorageDirectoryPublic:    t.TempDir(),
+		&config.ConfigStorageDirectoryUnlisted:  t.TempDir(),
+		&config.ConfigStorageDirectoryPrivate:   t.TempDir(),
+		&config.ConfigStorageDirectoryThumbnail: t.TempDir(),
+		&config.ConfigStorageDirectoryVersions:  t.TempDir(),
+		&config.ConfigStorageDirectoryRendition: t.TempDir(),
+		&config.ConfigStorageDirectoryOriginals: t.TempDir(),
+		&config.ConfigAuthenticationSigningKey:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encodedKey})),
+		&config.ConfigPublicURL:                 "https://images.example",
+	} {
+		previous := *configured
+		*configured = value
+		t.Cleanup(func() { *configured = previous })
+	}
+
+	previousRecords := metadata.UseStore(store.New(t.TempDir()))
+	t.Cleanup(func() { metadata.UseStore(previousRecords) })
+	previousLinks := share.UseStore(store.New(t.TempDir()))
+	t.Cleanup(func() { share.UseStore(previousLinks) })
+	previousShortLinks := shortlink.UseStore(store.New(t.TempDir()))
+	t.Cleanup(func() { shortlink.UseStore(previousShortLinks) })
+}
+
+// writeTestImage stores a PNG image of the given dimensions.
+func writeTestImage(t *testing.T, accessType, fileName string, width, height int) {
+	t.Helper()
+
+	_, storagePath := validateAccessType(accessType)
+	imageFile, err := os.Create(path.Join(storagePath, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imageFile.Close()
+
+	if err := png.Encode(imageFile, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testImageToken(t *testing.T, fileName string) string {
+	t.Helper()
+
+	token, err := auth.SignImageToken(time.Hour, path.Join(config.ConfigAccessTypePrivate, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func testAdminToken(t *testing.T) string {
+	t.Helper()
+
+	token, err := auth.SignAdminToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
@@ -1,12 +1,16 @@
 package endpoints
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/monzo/slog"
@@ -15,24 +19,61 @@ import (
 
 	"github.com/chongyangshi/yronwood/auth"
 	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/metadata"
+	"github.com/chongyangshi/yronwood/thumbnail"
 	"github.com/chongyangshi/yronwood/types"
 )
 
 const (
 	pagingCount        = 21
 	imageTokenValidity = time.Duration(time.Hour * 12)
+
+	sortUploaded = "uploaded"
+	sortTaken    = "taken"
+)
+
+var (
+	srcsetWidths    = []int{}
+	srcsetBaseWidth = 400
 )
 
+func init() {
+	for _, width := range strings.Split(config.ConfigSrcsetWidths, "|") {
+		widthParsed, err := strconv.Atoi(width)
+		if err != nil || widthParsed < 1 {
+			continue
+		}
+		srcsetWidths = append(srcsetWidths, widthParsed)
+	}
+	sort.Ints(srcsetWidths)
+
+	srcsetBaseWidthParsed, err := strconv.Atoi(config.ConfigSrcsetBaseWidth)
+	if err == nil && srcsetBaseWidthParsed > 0 {
+		srcsetBaseWidth = srcsetBaseWidthParsed
+	}
+}
+
 type imageMetadata struct {
 	FileName   string
 	Tags       []string
 	AccessPath string
 	Uploaded   time.Time
+	Sources    []types.ImageSource
+	Metadata   metadata.Record
 
 	// Pre-signed read access token for private images only
 	ImageToken string
 }
 
+// takenOrUploaded returns when the image was taken if known, or else when it was uploaded.
+func (i imageMetadata) takenOrUploaded() time.Time {
+	if i.Metadata.Exif != nil && i.Metadata.Exif.Taken != nil {
+		return *i.Metadata.Exif.Taken
+	}
+
+	return i.Uploaded
+}
+
 func listImages(req typhon.Request) typhon.Response {
 	imageListRequest, err := req.BodyBytes(true)
 	if err != nil {
@@ -52,6 +93,13 @@ func listImages(req typhon.Request) typhon.Response {
 		return typhon.Response{Error: terrors.BadRequest("invalid_access_type", "Access type specified is invalid", nil)}
 	}
 
+	if body.Sort == "" {
+		body.Sort = sortUploaded
+	}
+	if body.Sort != sortUploaded && body.Sort != sortTaken {
+		return typhon.Response{Error: terrors.BadRequest("invalid_sort", fmt.Sprintf("Images can only be sorted by %s or %s time", sortUploaded, sortTaken), nil)}
+	}
+
 	if body.AccessType != config.ConfigAccessTypePublic {
 		authSuccess, err := auth.VerifyAdminToken(body.Token)
 		if err != nil {
@@ -120,13 +168,15 @@ func listImages(req typhon.Request) typhon.Response {
 			}
 
 			if accessType == config.ConfigAccessTypePrivate {
+				// Tokens are verified against the file name without tags, which is
+				// what clients request the image by.
 				imageToken, err := auth.SignImageToken(
 					imageTokenValidity,
-					fmt.Sprintf("%s/%s", config.ConfigAccessTypePrivate, pathFile.Name()),
+					fmt.Sprintf("%s/%s", config.ConfigAccessTypePrivate, fileName),
 				)
 
 				if err != nil {
-					slog.Error(req, "Error pre-signing image %s in directory %s: %v", pathFile.Name(), storagePath, err)
+					slog.Error(req, "Error pre-signing image %s in directory %s: %v", fileName, storagePath, err)
 					return typhon.Response{Error: terrors.InternalService("", "Error encountered listing images", nil)}
 				}
 
@@ -152,13 +202,43 @@ func listImages(req typhon.Request) typhon.Response {
 		images = append(images, file)
 	}
 
+	// Sorting by when images were taken needs the details of every image rather than just
+	// those of the page returned. Images without a taken time are sorted by when they were
+	// uploaded instead, as are images whose details are yet to be recorded, which are
+	// recorded in the background rather than by reading every image here.
+	if body.Sort == sortTaken {
+		for i := range images {
+			images[i].Metadata, err = metadata.Get(req, images[i].FileName, images[i].AccessPath)
+			if err != nil {
+				slog.Error(req, "Error reading details of image %s: %v", images[i].FileName, err)
+				return typhon.Response{Error: terrors.InternalService("", "Error encountered listing images", nil)}
+			}
+			if images[i].Metadata.DetailsVersion < imageDetailsVersion {
+				_, storagePath := validateAccessType(images[i].AccessPath)
+				queueImageDetails(req, images[i].FileName, storagePath, images[i].AccessPath)
+			}
+		}
+	}
+
 	// Most recent first. This application deals with small number of files, so backend
 	// always lists all files of the access directory presently.
 	sort.Slice(images, func(i, j int) bool {
+		if body.Sort == sortTaken {
+			return images[i].takenOrUploaded().After(images[j].takenOrUploaded())
+		}
 		return images[i].Uploaded.After(images[j].Uploaded)
 	})
 
+	// Metadata and resized sources are only worked out for the page returned, as this
+	// may require reading each image and signing each source.
 	start, end := boundPaging(body.Page, len(images))
+	for i := start; i < end; i++ {
+		if err := describeImage(req, &images[i]); err != nil {
+			slog.Error(req, "Error describing image %s: %v", images[i].FileName, err)
+			return typhon.Response{Error: terrors.InternalService("", "Error encountered listing images", nil)}
+		}
+	}
+
 	return req.Response(types.ImageListResponse{
 		Images:         internalMetadataToResponseList(images[start:end]),
 		PagesAvailable: end < len(images),
@@ -174,12 +254,124 @@ func internalMetadataToResponseList(images []imageMetadata) []types.ImageMetadat
 			AccessPath: image.AccessPath,
 			Uploaded:   image.Uploaded.Format(time.RFC3339),
 			ImageToken: image.ImageToken,
+			Sources:    image.Sources,
+
+			Width:          image.Metadata.Width,
+			Height:         image.Metadata.Height,
+			Size:           image.Metadata.Size,
+			ContentType:    image.Metadata.ContentType,
+			DisplayName:    image.Metadata.DisplayName,
+			SHA256:         image.Metadata.SHA256,
+			Exif:           exifToResponse(image.Metadata.Exif),
+			BlurHash:       image.Metadata.BlurHash,
+			DominantColour: image.Metadata.DominantColour,
 		})
 	}
 
 	return files
 }
 
+func exifToResponse(summary *metadata.Exif) *types.ImageExif {
+	if summary == nil {
+		return nil
+	}
+
+	response := types.ImageExif{
+		CameraMake:   summary.CameraMake,
+		CameraModel:  summary.CameraModel,
+		LensModel:    summary.LensModel,
+		ExposureTime: summary.ExposureTime,
+		FNumber:      summary.FNumber,
+		ISO:          summary.ISO,
+		FocalLength:  summary.FocalLength,
+		Latitude:     summary.Latitude,
+		Longitude:    summary.Longitude,
+	}
+	if summary.Taken != nil {
+		response.Taken = summary.Taken.Format(time.RFC3339)
+	}
+
+	return &response
+}
+
+// describeImage fills in the metadata of the image, and its resized sources.
+func describeImage(ctx context.Context, image *imageMetadata) error {
+	_, storagePath := validateAccessType(image.AccessPath)
+
+	var err error
+	image.Metadata, err = getImageDetails(ctx, image.FileName, storagePath, image.AccessPath)
+	if err != nil {
+		return err
+	}
+
+	// Images uploaded before placeholders were supported get them in the background, for
+	// later listings, unless they could not be made before.
+	if image.Metadata.BlurHash == "" && !image.Metadata.PlaceholderFailed {
+		thumbnail.EnqueueThumbnail(ctx, image.FileName, storagePath, image.AccessPath)
+	}
+
+	return describeImageSources(image)
+}
+
+// describeImageSources fills in a source for each configured srcset width narrower than
+// the image. The original completes the set, so that the largest displays are not limited
+// to configured widths. Images without dimensions, such as SVG, are left without sources
+// as they scale by themselves.
+func describeImageSources(image *imageMetadata) error {
+	width := image.Metadata.Width
+	if width == 0 || image.Metadata.Height == 0 {
+		return nil
+	}
+
+	for _, srcsetWidth := range srcsetWidths {
+		if srcsetWidth >= width {
+			break
+		}
+
+		params := thumbnail.DerivativeParams{
+			Width: srcsetWidth,
+			Fit:   thumbnail.FitContain,
+		}
+		if params.Validate() != nil {
+			// Wider than derivatives are allowed to be.
+			break
+		}
+
+		// Sources of private images carry the token already signed for the image.
+		derivativeURL, err := signDerivativeParamsURL(image.AccessPath, image.FileName, params)
+		if err != nil {
+			return err
+		}
+		if image.ImageToken != "" {
+			derivativeURL = fmt.Sprintf("%s&token=%s", derivativeURL, url.QueryEscape(image.ImageToken))
+		}
+
+		image.Sources = append(image.Sources, types.ImageSource{
+			URL:     derivativeURL,
+			Width:   srcsetWidth,
+			Density: srcsetDensity(srcsetWidth),
+		})
+	}
+
+	originalURL := fmt.Sprintf("/uploads/%s/%s", url.PathEscape(image.AccessPath), url.PathEscape(image.FileName))
+	if image.ImageToken != "" {
+		originalURL = fmt.Sprintf("%s?token=%s", originalURL, url.QueryEscape(image.ImageToken))
+	}
+	image.Sources = append(image.Sources, types.ImageSource{
+		URL:     originalURL,
+		Width:   width,
+		Density: srcsetDensity(width),
+	})
+
+	return nil
+}
+
+// srcsetDensity returns the pixel density a source of the width has when displayed at
+// the base width, to two decimal places.
+func srcsetDensity(width int) float64 {
+	return math.Round(float64(width)/float64(srcsetBaseWidth)*100) / 100
+}
+
 func boundPaging(pageNumber, imagesAvailable int) (int, int) {
 	pageNumberMax := math.Ceil(float64(imagesAvailable) / pagingCount)
 
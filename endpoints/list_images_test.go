@@ -0,0 +1,56 @@
+package endpoints
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/metadata"
+)
+
+func TestDescribeImageSources(t *testing.T) {
+	useTestImages(t)
+	defer func(configured []int) { srcsetWidths = configured }(srcsetWidths)
+	srcsetWidths = []int{400, 800, 1200}
+
+	describe := func(accessType, imageToken string) *imageMetadata {
+		image := &imageMetadata{
+			FileName:   "wide.png",
+			AccessPath: accessType,
+			Metadata:   metadata.Record{Width: 1000, Height: 500},
+			ImageToken: imageToken,
+		}
+		if err := describeImageSources(image); err != nil {
+			t.Fatal(err)
+		}
+		return image
+	}
+
+	image := describe(config.ConfigAccessTypePublic, "")
+	if len(image.Sources) != 3 {
+		t.Fatalf("Expected sources of 400, 800 and the original, got %+v", image.Sources)
+	}
+	for i, width := range []int{400, 800, 1000} {
+		if image.Sources[i].Width != width {
+			t.Fatalf("Expected source %d to be %d wide, got %+v", i, width, image.Sources[i])
+		}
+	}
+	if image.Sources[2].URL != "/uploads/public/wide.png" {
+		t.Fatalf("Expected original to complete the sources, got %s", image.Sources[2].URL)
+	}
+
+	// Sources are described the same way every time, so that clients can cache them.
+	if described := describe(config.ConfigAccessTypePublic, ""); !reflect.DeepEqual(described.Sources, image.Sources) {
+		t.Fatalf("Expected sources %+v to be described again, got %+v", image.Sources, described.Sources)
+	}
+
+	token := testImageToken(t, "wide.png")
+	image = describe(config.ConfigAccessTypePrivate, token)
+	for _, source := range image.Sources {
+		if !strings.HasSuffix(source.URL, "token="+url.QueryEscape(token)) {
+			t.Fatalf("Expected source of private image to carry its token, got %s", source.URL)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/share"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func listShares(req typhon.Request) typhon.Response {
+	shareListRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ShareListRequest{}
+	err = json.Unmarshal(shareListRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	sharedLinks, err := share.List(req)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered listing share links", nil)}
+	}
+
+	response := types.ShareListResponse{Links: []types.ShareLink{}}
+	for _, link := range sharedLinks {
+		if body.FileName != "" && link.FileName != body.FileName {
+			continue
+		}
+		if body.AccessType != "" && link.AccessType != body.AccessType {
+			continue
+		}
+		response.Links = append(response.Links, shareToResponse(link))
+	}
+
+	return req.Response(response)
+}
+
+func shareToResponse(link share.Link) types.ShareLink {
+	return types.ShareLink{
+		ID:                link.ID,
+		URL:               shareURL(link.ID),
+		FileName:          link.FileName,
+		AccessType:        link.AccessType,
+		Created:           link.Created.Format(time.RFC3339),
+		Expires:           link.Expires.Format(time.RFC3339),
+		MaxViews:          link.MaxViews,
+		Views:             link.Views,
+		PasswordProtected: link.PasswordProtected(),
+		Usable:            link.Usable(time.Now()) == nil,
+	}
+}
+
+// shareURL returns the URL of the share link, which is relative to the API host unless
+// its public URL is configured.
+func shareURL(id string) string {
+	return fmt.Sprintf("%s/s/%s", strings.TrimSuffix(config.ConfigPublicURL, "/"), url.PathEscape(id))
+}
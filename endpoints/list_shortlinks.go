@@ -0,0 +1,81 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/shortlink"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func listShortLinks(req typhon.Request) typhon.Response {
+	shortLinkListRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ShortLinkListRequest{}
+	err = json.Unmarshal(shortLinkListRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	shortLinks, err := shortlink.List(req)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered listing short links", nil)}
+	}
+
+	response := types.ShortLinkListResponse{Links: []types.ShortLink{}}
+	for _, link := range shortLinks {
+		if body.FileName != "" && link.FileName != body.FileName {
+			continue
+		}
+		if body.AccessType != "" && link.AccessType != body.AccessType {
+			continue
+		}
+		response.Links = append(response.Links, shortLinkToResponse(link))
+	}
+
+	return req.Response(response)
+}
+
+func shortLinkToResponse(link shortlink.Link) types.ShortLink {
+	return types.ShortLink{
+		Slug:       link.Slug,
+		URL:        shortLinkURL(link.Slug),
+		FileName:   link.FileName,
+		AccessType: link.AccessType,
+		Mode:       link.Mode,
+		Created:    link.Created.Format(time.RFC3339),
+		Hits:       link.Hits,
+	}
+}
+
+// shortLinkURL returns the URL of the short link, which is relative to the API host unless
+// its public URL is configured.
+func shortLinkURL(slug string) string {
+	return fmt.Sprintf("%s/i/%s", strings.TrimSuffix(config.ConfigPublicURL, "/"), url.PathEscape(slug))
+}
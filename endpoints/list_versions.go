@@ -0,0 +1,72 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/types"
+	"github.com/chongyangshi/yronwood/versions"
+)
+
+func listVersions(req typhon.Request) typhon.Response {
+	imageVersionsRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ImageVersionsRequest{}
+	err = json.Unmarshal(imageVersionsRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	// Version history is only available to admin users, regardless of access type.
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	if !validateFilename(body.FileName) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", body.FileName), nil)}
+	}
+
+	validAccessType, _ := validateAccessType(body.AccessType)
+	if !validAccessType {
+		return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
+	}
+
+	imageVersions, err := versions.ListVersions(req, body.FileName, body.AccessType)
+	if err != nil {
+		slog.Error(req, "Error listing versions of %s of type %s: %v", body.FileName, body.AccessType, err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered listing versions", nil)}
+	}
+
+	response := types.ImageVersionsResponse{
+		Versions: []types.ImageVersion{},
+	}
+	for _, imageVersion := range imageVersions {
+		response.Versions = append(response.Versions, types.ImageVersion{
+			Version:  imageVersion.ID,
+			Uploaded: imageVersion.Uploaded.Format(time.RFC3339),
+			Checksum: imageVersion.Checksum,
+			Size:     imageVersion.Size,
+		})
+	}
+
+	return req.Response(response)
+}
@@ -0,0 +1,113 @@
+package endpoints
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/thumbnail"
+)
+
+// Links to images can be previewed by sites they are pasted into, which read OpenGraph
+// tags from a page for the image, or ask for an oEmbed description of it. Previews are
+// given for images anyone can view, and for private images only with a valid token, which
+// then appears in the URLs previewed.
+
+// imagePreview describes an image for previews of links to it, with absolute URLs.
+type imagePreview struct {
+	Title       string
+	AccessType  string
+	PageURL     string
+	ImageURL    string
+	ContentType string
+	Width       int // Zero for images without a fixed size, such as SVG
+	Height      int
+}
+
+// getImagePreview returns a client error unless the image exists and can be viewed with
+// the token, which is only required for private images.
+func getImagePreview(ctx context.Context, baseURL, fileName, accessType, token string) (imagePreview, error) {
+	validAccessType, storagePath := validateAccessType(accessType)
+	if !validAccessType {
+		return imagePreview{}, terrors.NotFound("not_found", "Requested image is not found", nil)
+	}
+
+	if accessType == config.ConfigAccessTypePrivate {
+		if err := authenticateImageToken(ctx, fileName, token); err != nil {
+			return imagePreview{}, err
+		}
+	}
+
+	if !validateFilename(fileName) {
+		return imagePreview{}, terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", fileName), nil)
+	}
+
+	if !fileExists(storagePath, fileName) {
+		return imagePreview{}, terrors.NotFound("not_found", "Requested image is not found", nil)
+	}
+
+	record, err := getImageDetails(ctx, fileName, storagePath, accessType)
+	if err != nil {
+		return imagePreview{}, terrors.InternalService("", "Error encountered reading image details", nil)
+	}
+
+	preview := imagePreview{
+		Title:       record.DisplayName,
+		AccessType:  accessType,
+		PageURL:     fmt.Sprintf("%s/p/%s/%s", baseURL, url.PathEscape(accessType), url.PathEscape(fileName)),
+		ImageURL:    fmt.Sprintf("%s/uploads/%s/%s", baseURL, url.PathEscape(accessType), url.PathEscape(fileName)),
+		ContentType: getContentTypeFromFilename(fileName),
+		Width:       record.Width,
+		Height:      record.Height,
+	}
+	if preview.Title == "" {
+		preview.Title = fileName
+	}
+	if thumbnail.NeedsWebRendition(fileName) {
+		preview.ContentType = thumbnail.WebRenditionContentType()
+	}
+	if accessType == config.ConfigAccessTypePrivate {
+		preview.PageURL = fmt.Sprintf("%s?token=%s", preview.PageURL, url.QueryEscape(token))
+		preview.ImageURL = fmt.Sprintf("%s?token=%s", preview.ImageURL, url.QueryEscape(token))
+	}
+
+	return preview, nil
+}
+
+// setPreviewCacheControl sets the caching policy of a preview of an image of the access
+// type. Unless the URL this API is reached at is configured, previews link to where the
+// request was sent to, so are then only cached by whoever sent it, as caches in front of
+// us could otherwise serve links to hosts given by others.
+func setPreviewCacheControl(response typhon.Response, accessType string) {
+	if config.ConfigPublicURL == "" {
+		response.Header.Set("Cache-Control", config.ConfigCacheControlPrivate)
+		response.Header.Add("Vary", "Host, X-Forwarded-Proto")
+		return
+	}
+
+	response.Header.Set("Cache-Control", cacheControlForAccessType(accessType, accessType == config.ConfigAccessTypePrivate))
+}
+
+// previewBaseURL returns the URL this API is reached at, as sites previewing links need
+// absolute URLs. Unless configured, it is where the request was sent to.
+func previewBaseURL(req typhon.Request) string {
+	if config.ConfigPublicURL != "" {
+		return strings.TrimSuffix(config.ConfigPublicURL, "/")
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	switch forwardedScheme := req.Header.Get("X-Forwarded-Proto"); forwardedScheme {
+	case "http", "https":
+		scheme = forwardedScheme
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, req.Host)
+}
@@ -0,0 +1,116 @@
+package endpoints
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+func TestGetImagePreview(t *testing.T) {
+	useTestImages(t)
+	ctx := context.Background()
+	writeTestImage(t, config.ConfigAccessTypePublic, "cat.png", 60, 40)
+	writeTestImage(t, config.ConfigAccessTypePrivate, "dog.png", 30, 20)
+
+	preview, err := getImagePreview(ctx, "https://images.example", "cat.png", config.ConfigAccessTypePublic, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := imagePreview{
+		Title:       "cat.png",
+		AccessType:  config.ConfigAccessTypePublic,
+		PageURL:     "https://images.example/p/public/cat.png",
+		ImageURL:    "https://images.example/uploads/public/cat.png",
+		ContentType: "image/png",
+		Width:       60,
+		Height:      40,
+	}
+	if preview != expected {
+		t.Fatalf("Expected preview %+v, got %+v", expected, preview)
+	}
+
+	// Private images are previewed with the token given, which is carried by their URLs.
+	token := testImageToken(t, "dog.png")
+	preview, err = getImagePreview(ctx, "https://images.example", "dog.png", config.ConfigAccessTypePrivate, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.PageURL != "https://images.example/p/private/dog.png?token="+token || preview.ImageURL != "https://images.example/uploads/private/dog.png?token="+token {
+		t.Fatalf("Expected URLs of private preview to carry the token, got %+v", preview)
+	}
+	if preview.Width != 30 || preview.Height != 20 {
+		t.Fatalf("Expected private preview of 30x20, got %dx%d", preview.Width, preview.Height)
+	}
+
+	for _, testCase := range []struct {
+		fileName   string
+		accessType string
+		token      string
+		code       string
+	}{
+		{"dog.png", config.ConfigAccessTypePrivate, "", terrors.ErrUnauthorized},
+		{"dog.png", config.ConfigAccessTypePrivate, testImageToken(t, "cat.png"), terrors.ErrForbidden},
+		{"cat.png", "secret", "", terrors.ErrNotFound},
+		{"missing.png", config.ConfigAccessTypePublic, "", terrors.ErrNotFound},
+		{"../cat.png", config.ConfigAccessTypePublic, "", terrors.ErrBadRequest},
+	} {
+		_, err := getImagePreview(ctx, "https://images.example", testCase.fileName, testCase.accessType, testCase.token)
+		if !terrors.PrefixMatches(err, testCase.code) {
+			t.Fatalf("Expected %s previewing %s of access type %s, got %v", testCase.code, testCase.fileName, testCase.accessType, err)
+		}
+	}
+}
+
+func TestPreviewsCachedPrivatelyWithoutPublicURL(t *testing.T) {
+	useTestImages(t)
+	writeTestImage(t, config.ConfigAccessTypePublic, "cat.png", 60, 40)
+
+	request := func(target string) typhon.Request {
+		req := typhon.NewRequest(context.Background(), http.MethodGet, target, nil)
+		req.Host = "elsewhere.example"
+		req.Header.Set("X-Forwarded-Proto", "http")
+		return req
+	}
+	oEmbedURL := "https://images.example/oembed?" + url.Values{"url": {"https://images.example/p/public/cat.png"}}.Encode()
+
+	for _, testCase := range []struct {
+		publicURL    string
+		baseURL      string
+		cacheControl string
+		vary         string
+	}{
+		{"https://images.example", "https://images.example", config.ConfigCacheControlPublic, ""},
+		{"", "http://elsewhere.example", config.ConfigCacheControlPrivate, "Host, X-Forwarded-Proto"},
+	} {
+		config.ConfigPublicURL = testCase.publicURL
+
+		rsp := viewPreview(request("https://images.example/p/public/cat.png"))
+		if rsp.Error != nil {
+			t.Fatal(rsp.Error)
+		}
+		page, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(page), `<meta property="og:image" content="`+testCase.baseURL+`/uploads/public/cat.png">`) {
+			t.Fatalf("Expected preview to link to %s with public URL %q, got %s", testCase.baseURL, testCase.publicURL, page)
+		}
+
+		for _, rsp := range []typhon.Response{rsp, getOEmbed(request(oEmbedURL))} {
+			if rsp.Error != nil {
+				t.Fatal(rsp.Error)
+			}
+			if cacheControl, vary := rsp.Header.Get("Cache-Control"), rsp.Header.Get("Vary"); cacheControl != testCase.cacheControl || vary != testCase.vary {
+				t.Fatalf("Expected %s varying by %q with public URL %q, got %s varying by %q", testCase.cacheControl, testCase.vary, testCase.publicURL, cacheControl, vary)
+			}
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/typhon"
+)
+
+// Images are streamed to clients from open files where they are stored as served, rather
+// than read into memory first, and clients can request parts of them with Range headers,
+// such as to resume interrupted downloads.
+
+// Requests for more ranges than this are served the whole image, as parts of it add
+// little for clients but each costs us a part to write.
+const maxRanges = 16
+
+var errRangeNotSatisfiable = errors.New("No requested range is satisfiable")
+
+// imageContent is an image being served, from an open file or from memory.
+type imageContent struct {
+	io.ReaderAt
+	io.Closer
+	size    int64
+	modTime time.Time // Zero if the content was not read from a file
+}
+
+// newFileContent returns the content of the open file, which is closed with the content.
+// Returns nil if no file is given.
+func newFileContent(ctx context.Context, file *os.File) (*imageContent, error) {
+	if file == nil {
+		return nil, nil
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		slog.Error(ctx, "Could not stat file %s: %v", file.Name(), err)
+		file.Close()
+		return nil, err
+	}
+
+	return &imageContent{ReaderAt: file, Closer: file, size: fileInfo.Size(), modTime: fileInfo.ModTime()}, nil
+}
+
+// newBytesContent returns the content held in memory, or nil if there is none.
+func newBytesContent(content []byte) *imageContent {
+	if content == nil {
+		return nil
+	}
+
+	reader := bytes.NewReader(content)
+	return &imageContent{ReaderAt: reader, Closer: io.NopCloser(reader), size: int64(len(content))}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRanges returns the ranges of content of the given size requested by the Range
+// header. Nothing is returned if the header is not a valid request for byte ranges, in
+// which case it is ignored, and errRangeNotSatisfiable if no range requested is within
+// the content.
+func parseRanges(header string, size int64) ([]byteRange, error) {
+	rangeSpecs, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return nil, nil
+	}
+
+	ranges := []byteRange{}
+	for _, rangeSpec := range strings.Split(rangeSpecs, ",") {
+		rangeSpec = strings.TrimSpace(rangeSpec)
+		if rangeSpec == "" {
+			continue
+		}
+		first, last, found := strings.Cut(rangeSpec, "-")
+		if !found {
+			return nil, nil
+		}
+
+		if first == "" {
+			// A suffix of the content, of the given length.
+			suffixLength, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffixLength < 0 {
+				return nil, nil
+			}
+			if suffixLength == 0 || size == 0 {
+				continue
+			}
+			if suffixLength > size {
+				suffixLength = size
+			}
+			ranges = append(ranges, byteRange{start: size - suffixLength, length: suffixLength})
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, nil
+		}
+		end := size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, nil
+			}
+			if end > size-1 {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+
+	return ranges, nil
+}
+
+// requestedRanges returns the ranges of the content the client requested, or nothing if
+// the whole content is to be served: because none were requested, too many were, or the
+// content changed from what the client holds part of, per If-Range.
+func requestedRanges(req typhon.Request, size int64, etag string, lastModified time.Time) ([]byteRange, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, nil
+	}
+	if req.Header.Get("Range") == "" {
+		return nil, nil
+	}
+
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" {
+		if strings.HasPrefix(ifRange, `"`) {
+			// Only strong ETags can be compared, as ranges are of exact bytes.
+			if ifRange != etag {
+				return nil, nil
+			}
+		} else {
+			since, err := http.ParseTime(ifRange)
+			if err != nil || lastModified.IsZero() || !lastModified.Truncate(time.Second).Equal(since) {
+				return nil, nil
+			}
+		}
+	}
+
+	ranges, err := parseRanges(req.Header.Get("Range"), size)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) > maxRanges {
+		return nil, nil
+	}
+
+	var totalLength int64
+	for _, requested := range ranges {
+		totalLength += requested.length
+	}
+	if totalLength > size {
+		// Overlapping ranges are served as the whole content rather than repeatedly.
+		return nil, nil
+	}
+
+	return ranges, nil
+}
+
+// serveContent sets the response to serve the content, or the ranges of it requested,
+// with its length. The content is closed once served.
+func serveContent(req typhon.Request, response typhon.Response, content *imageContent, contentType, etag string, lastModified time.Time) typhon.Response {
+	response.Header.Set("Accept-Ranges", "bytes")
+
+	ranges, err := requestedRanges(req, content.size, etag, lastModified)
+	if err != nil {
+		// Error responses are read back by filters, so this carries an error body like them.
+		content.Close()
+		response.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		response.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", content.size))
+		response.Encode(basicError{Code: "range_not_satisfiable", Message: "Requested range is not satisfiable"})
+		return response
+	}
+
+	response.Header.Set("Content-Type", contentType)
+	var body io.ReadCloser
+	var length int64
+	switch len(ranges) {
+	case 0:
+		body = readCloser{io.NewSectionReader(content, 0, content.size), content}
+		length = content.size
+	case 1:
+		response.StatusCode = http.StatusPartialContent
+		response.Header.Set("Content-Range", ranges[0].contentRange(content.size))
+		body = readCloser{io.NewSectionReader(content, ranges[0].start, ranges[0].length), content}
+		length = ranges[0].length
+	default:
+		response.StatusCode = http.StatusPartialContent
+		boundary := multipart.NewWriter(io.Discard).Boundary()
+		response.Header.Set("Content-Type", fmt.Sprintf("multipart/byteranges; boundary=%s", boundary))
+
+		// The length of the body is worked out by writing it without the content.
+		counter := &countingWriter{}
+		writeMultipartRanges(counter, boundary, content, contentType, ranges, false)
+		length = counter.written
+		for _, requested := range ranges {
+			length += requested.length
+		}
+
+		if req.Method != http.MethodHead {
+			pipeReader, pipeWriter := io.Pipe()
+			go func() {
+				defer content.Close()
+				pipeWriter.CloseWithError(writeMultipartRanges(pipeWriter, boundary, content, contentType, ranges, true))
+			}()
+			body = pipeReader
+		}
+	}
+
+	response.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	response.ContentLength = length
+	if req.Method == http.MethodHead {
+		// The length of what would have been served is still sent.
+		if body != nil {
+			body.Close()
+		} else {
+			content.Close()
+		}
+		response.Body = nil
+		return response
+	}
+
+	response.Body = body
+	return response
+}
+
+// writeMultipartRanges writes the ranges of the content as parts of a multipart body,
+// leaving out the content of each part unless copyContent is set.
+func writeMultipartRanges(w io.Writer, boundary string, content *imageContent, contentType string, ranges []byteRange, copyContent bool) error {
+	partsWriter := multipart.NewWriter(w)
+	if err := partsWriter.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	for _, requested := range ranges {
+		part, err := partsWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {contentType},
+			"Content-Range": {requested.contentRange(content.size)},
+		})
+		if err != nil {
+			return err
+		}
+		if !copyContent {
+			continue
+		}
+		if _, err := io.Copy(part, io.NewSectionReader(content, requested.start, requested.length)); err != nil {
+			return err
+		}
+	}
+
+	return partsWriter.Close()
+}
+
+type countingWriter struct {
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,207 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/monzo/typhon"
+)
+
+func TestParseRanges(t *testing.T) {
+	for _, testCase := range []struct {
+		header string
+		ranges []byteRange
+		err    error
+	}{
+		{"bytes=0-3", []byteRange{{start: 0, length: 4}}, nil},
+		{"bytes=5-", []byteRange{{start: 5, length: 5}}, nil},
+		{"bytes=8-20", []byteRange{{start: 8, length: 2}}, nil},
+		{"bytes=-3", []byteRange{{start: 7, length: 3}}, nil},
+		{"bytes=-20", []byteRange{{start: 0, length: 10}}, nil},
+		{"bytes=0-1, 4-5", []byteRange{{start: 0, length: 2}, {start: 4, length: 2}}, nil},
+		{"bytes=0-5,3-8", []byteRange{{start: 0, length: 6}, {start: 3, length: 6}}, nil},
+		{"bytes=0-1,20-30", []byteRange{{start: 0, length: 2}}, nil},
+		{"bytes=10-", nil, errRangeNotSatisfiable},
+		{"bytes=20-30", nil, errRangeNotSatisfiable},
+		{"bytes=-0", nil, errRangeNotSatisfiable},
+		{"bytes=", nil, errRangeNotSatisfiable},
+		{"bytes=3-1", nil, nil},
+		{"bytes=a-b", nil, nil},
+		{"bytes=--1", nil, nil},
+		{"bytes=1", nil, nil},
+		{"items=0-1", nil, nil},
+	} {
+		ranges, err := parseRanges(testCase.header, 10)
+		if err != testCase.err {
+			t.Fatalf("Expected error %v parsing %q, got %v", testCase.err, testCase.header, err)
+		}
+		if !reflect.DeepEqual(ranges, testCase.ranges) {
+			t.Fatalf("Expected ranges %+v parsing %q, got %+v", testCase.ranges, testCase.header, ranges)
+		}
+	}
+
+	if ranges, err := parseRanges("bytes=-5", 0); err != errRangeNotSatisfiable {
+		t.Fatalf("Expected no range of empty content to be satisfiable, got %+v and %v", ranges, err)
+	}
+}
+
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestServeContent(t *testing.T) {
+	const etag = `"0123"`
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, testCase := range []struct {
+		name         string
+		method       string
+		headers      map[string]string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"whole", http.MethodGet, nil, http.StatusOK, "", "0123456789"},
+		{"range", http.MethodGet, map[string]string{"Range": "bytes=2-4"}, http.StatusPartialContent, "bytes 2-4/10", "234"},
+		{"suffix range", http.MethodGet, map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "bytes 7-9/10", "789"},
+		{"range past end", http.MethodGet, map[string]string{"Range": "bytes=8-20"}, http.StatusPartialContent, "bytes 8-9/10", "89"},
+		{"overlapping ranges", http.MethodGet, map[string]string{"Range": "bytes=0-5,3-8"}, http.StatusOK, "", "0123456789"},
+		{"too many ranges", http.MethodGet, map[string]string{"Range": "bytes=0-0,1-1,2-2,3-3,4-4,5-5,6-6,7-7,8-8,9-9,0-0,1-1,2-2,3-3,4-4,5-5,6-6"}, http.StatusOK, "", "0123456789"},
+		{"invalid range", http.MethodGet, map[string]string{"Range": "bytes=4-2"}, http.StatusOK, "", "0123456789"},
+		{"out of bounds", http.MethodGet, map[string]string{"Range": "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable, "bytes */10", ""},
+		{"matching If-Range", http.MethodGet, map[string]string{"Range": "bytes=2-4", "If-Range": etag}, http.StatusPartialContent, "bytes 2-4/10", "234"},
+		{"stale If-Range", http.MethodGet, map[string]string{"Range": "bytes=2-4", "If-Range": `"4567"`}, http.StatusOK, "", "0123456789"},
+		{"weak If-Range", http.MethodGet, map[string]string{"Range": "bytes=2-4", "If-Range": "W/" + etag}, http.StatusOK, "", "0123456789"},
+		{"matching If-Range date", http.MethodGet, map[string]string{"Range": "bytes=2-4", "If-Range": lastModified.Format(http.TimeFormat)}, http.StatusPartialContent, "bytes 2-4/10", "234"},
+		{"stale If-Range date", http.MethodGet, map[string]string{"Range": "bytes=2-4", "If-Range": lastModified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK, "", "0123456789"},
+		{"head", http.MethodHead, nil, http.StatusOK, "", ""},
+		{"head range", http.MethodHead, map[string]string{"Range": "bytes=2-4"}, http.StatusPartialContent, "bytes 2-4/10", ""},
+		{"head out of bounds", http.MethodHead, map[string]string{"Range": "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable, "bytes */10", ""},
+		{"range of post", http.MethodPost, map[string]string{"Range": "bytes=2-4"}, http.StatusOK, "", "0123456789"},
+	} {
+		req := typhon.NewRequest(context.Background(), testCase.method, "http://images.local/uploads/public/test.png", nil)
+		for header, value := range testCase.headers {
+			req.Header.Set(header, value)
+		}
+		content := newBytesContent([]byte("0123456789"))
+		closer := &closeRecorder{}
+		content.Closer = closer
+
+		response := serveContent(req, typhon.NewResponse(req), content, "image/png", etag, lastModified)
+		if response.StatusCode != testCase.status {
+			t.Fatalf("Expected status %d serving %s, got %d", testCase.status, testCase.name, response.StatusCode)
+		}
+		if contentRange := response.Header.Get("Content-Range"); contentRange != testCase.contentRange {
+			t.Fatalf("Expected Content-Range %q serving %s, got %q", testCase.contentRange, testCase.name, contentRange)
+		}
+		if response.Header.Get("Accept-Ranges") != "bytes" {
+			t.Fatalf("Expected ranges to be accepted serving %s", testCase.name)
+		}
+		if testCase.status == http.StatusRequestedRangeNotSatisfiable {
+			if !closer.closed {
+				t.Fatalf("Expected content to be closed serving %s", testCase.name)
+			}
+			continue
+		}
+
+		expectedLength := strconv.Itoa(len(testCase.body))
+		if testCase.method == http.MethodHead {
+			if response.Body != nil {
+				t.Fatalf("Expected no body serving %s", testCase.name)
+			}
+			if !closer.closed {
+				t.Fatalf("Expected content to be closed serving %s", testCase.name)
+			}
+			// The length of what a GET would have been served is still sent.
+			expectedLength = "10"
+			if testCase.contentRange != "" {
+				expectedLength = "3"
+			}
+		} else {
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if string(body) != testCase.body {
+				t.Fatalf("Expected body %q serving %s, got %q", testCase.body, testCase.name, body)
+			}
+			if !closer.closed {
+				t.Fatalf("Expected content to be closed once served for %s", testCase.name)
+			}
+		}
+		if contentLength := response.Header.Get("Content-Length"); contentLength != expectedLength {
+			t.Fatalf("Expected Content-Length %s serving %s, got %s", expectedLength, testCase.name, contentLength)
+		}
+		if contentType := response.Header.Get("Content-Type"); contentType != "image/png" {
+			t.Fatalf("Expected Content-Type image/png serving %s, got %s", testCase.name, contentType)
+		}
+	}
+}
+
+func TestServeContentMultipleRanges(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req := typhon.NewRequest(context.Background(), method, "http://images.local/uploads/public/test.png", nil)
+		req.Header.Set("Range", "bytes=0-1,-2")
+
+		response := serveContent(req, typhon.NewResponse(req), newBytesContent([]byte("0123456789")), "image/png", `"0123"`, time.Time{})
+		if response.StatusCode != http.StatusPartialContent {
+			t.Fatalf("Expected status %d for %s, got %d", http.StatusPartialContent, method, response.StatusCode)
+		}
+		mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/byteranges" || params["boundary"] == "" {
+			t.Fatalf("Expected multipart byte ranges for %s, got %q", method, response.Header.Get("Content-Type"))
+		}
+		if method == http.MethodHead {
+			if response.Body != nil {
+				t.Fatalf("Expected no body for %s", method)
+			}
+			continue
+		}
+
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentLength := response.Header.Get("Content-Length"); contentLength != strconv.Itoa(len(body)) {
+			t.Fatalf("Expected Content-Length %d, got %s", len(body), contentLength)
+		}
+
+		partsReader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for _, expected := range []struct {
+			contentRange string
+			content      string
+		}{
+			{"bytes 0-1/10", "01"},
+			{"bytes 8-9/10", "89"},
+		} {
+			part, err := partsReader.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if part.Header.Get("Content-Range") != expected.contentRange || part.Header.Get("Content-Type") != "image/png" || string(content) != expected.content {
+				t.Fatalf("Expected part %s of %q, got %v of %q", expected.contentRange, expected.content, part.Header, content)
+			}
+		}
+		if _, err := partsReader.NextPart(); err != io.EOF {
+			t.Fatalf("Expected only two parts, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/thumbnail"
+	"github.com/chongyangshi/yronwood/types"
+	"github.com/chongyangshi/yronwood/versions"
+)
+
+func replaceImage(req typhon.Request) typhon.Response {
+	imageReplaceRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ImageReplaceRequest{}
+	err = json.Unmarshal(imageReplaceRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	// Auth required for replacing images.
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	if !validateFilename(body.FileName) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", body.FileName), nil)}
+	}
+
+	validAccessType, storagePath := validateAccessType(body.AccessType)
+	if !validAccessType {
+		return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
+	}
+
+	if !fileExists(storagePath, body.FileName) {
+		return typhon.Response{Error: terrors.NotFound("not_found", fmt.Sprintf("Requested image %s is not found", body.FileName), nil)}
+	}
+
+	decodedPayload, err := decodePayload(req, body.Payload, body.Checksum)
+	if err != nil {
+		return typhon.Response{Error: err}
+	}
+
+	decodedPayload, err = sanitizePayload(req, body.FileName, decodedPayload)
+	if err != nil {
+		return typhon.Response{Error: err}
+	}
+
+	previousVersion, err := versions.ArchiveCurrentVersion(req, body.FileName, storagePath, body.AccessType)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Could not keep previous version of file", nil)}
+	}
+
+	storedPayload, bytesSaved, err := optimizeUpload(req, body.FileName, body.AccessType, decodedPayload)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Could not keep original of optimized file", nil)}
+	}
+
+	// Tags are kept as they are, as their symlinks still point to the same file.
+	filePath := path.Join(storagePath, body.FileName)
+	err = ioutil.WriteFile(filePath, storedPayload, 0644)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", fmt.Sprintf("Could not save file: %v", err), nil)}
+	}
+
+	err = thumbnail.InvalidateDerivatives(req, body.FileName, body.AccessType)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Could not invalidate derived images of previous version of file", nil)}
+	}
+	thumbnail.EnqueueThumbnail(req, body.FileName, storagePath, body.AccessType)
+
+	// Clients see missing details filled in when listing, so failing here is not fatal.
+	if _, err := recordImageDetails(req, body.FileName, storagePath, body.AccessType); err != nil {
+		slog.Error(req, "Could not record details of %s: %v", body.FileName, err)
+	}
+
+	return req.Response(types.ImageReplaceResponse{
+		FileName:        body.FileName,
+		PreviousVersion: previousVersion,
+		BytesSaved:      bytesSaved,
+	})
+}
@@ -0,0 +1,50 @@
+package endpoints
+
+import (
+	"encoding/json"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/share"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func revokeShare(req typhon.Request) typhon.Response {
+	shareRevokeRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ShareRevokeRequest{}
+	err = json.Unmarshal(shareRevokeRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	revoked, err := share.Revoke(req, body.ID)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered revoking share link", nil)}
+	}
+	if !revoked {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Share link is not found", nil)}
+	}
+
+	return req.Response(nil)
+}
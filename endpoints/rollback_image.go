@@ -0,0 +1,88 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/optimize"
+	"github.com/chongyangshi/yronwood/thumbnail"
+	"github.com/chongyangshi/yronwood/types"
+	"github.com/chongyangshi/yronwood/versions"
+)
+
+func rollbackImage(req typhon.Request) typhon.Response {
+	imageRollbackRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ImageRollbackRequest{}
+	err = json.Unmarshal(imageRollbackRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	// Auth required for rolling back images.
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	if !validateFilename(body.FileName) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", body.FileName), nil)}
+	}
+
+	validAccessType, storagePath := validateAccessType(body.AccessType)
+	if !validAccessType {
+		return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
+	}
+
+	if !fileExists(storagePath, body.FileName) {
+		return typhon.Response{Error: terrors.NotFound("not_found", fmt.Sprintf("Requested image %s is not found", body.FileName), nil)}
+	}
+
+	previousVersion, err := versions.RestoreVersion(req, body.FileName, storagePath, body.AccessType, body.Version)
+	if err != nil {
+		slog.Error(req, "Could not roll back %s of type %s to version %s: %v", body.FileName, body.AccessType, body.Version, err)
+		if terrors.Is(err, terrors.ErrNotFound) {
+			return typhon.Response{Error: err}
+		}
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered rolling back image", nil)}
+	}
+
+	err = thumbnail.InvalidateDerivatives(req, body.FileName, body.AccessType)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Could not invalidate derived images of rolled back file", nil)}
+	}
+
+	// Any original kept as uploaded is of the content rolled back from.
+	err = optimize.RemoveOriginal(req, body.FileName, body.AccessType)
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Could not remove original of rolled back file", nil)}
+	}
+	thumbnail.EnqueueThumbnail(req, body.FileName, storagePath, body.AccessType)
+
+	// Clients see missing details filled in when listing, so failing here is not fatal.
+	if _, err := recordImageDetails(req, body.FileName, storagePath, body.AccessType); err != nil {
+		slog.Error(req, "Could not record details of %s: %v", body.FileName, err)
+	}
+
+	return req.Response(types.ImageRollbackResponse{
+		FileName:        body.FileName,
+		PreviousVersion: previousVersion,
+	})
+}
@@ -18,7 +18,30 @@ func Service() typhon.Service {
 	router.GET("/index.html", handleIndex)
 	router.POST("/authenticate", authenticate)
 	router.PUT("/upload", uploadImage)
+	router.PUT("/replace", replaceImage)
+	router.POST("/versions", listVersions)
+	router.POST("/rollback", rollbackImage)
+	router.POST("/derivative", signDerivative)
+	router.POST("/thumbnails/backfill", backfillThumbnails)
+	router.POST("/stats", serviceStats)
+	router.POST("/metadata", getMetadata)
+	router.POST("/exif", getExif)
+	router.POST("/shares/create", createShare)
+	router.POST("/shares/list", listShares)
+	router.POST("/shares/revoke", revokeShare)
+	router.GET("/s/:id", viewShare)
+	router.HEAD("/s/:id", viewShare)
+	router.POST("/shortlinks/create", createShortLink)
+	router.POST("/shortlinks/list", listShortLinks)
+	router.POST("/shortlinks/delete", deleteShortLink)
+	router.GET("/i/:slug", viewShortLink)
+	router.HEAD("/i/:slug", viewShortLink)
 	router.GET("/uploads/:accesstype/:filename", viewImage)
+	router.HEAD("/uploads/:accesstype/:filename", viewImage)
+	router.GET("/originals/:accesstype/:filename", viewOriginal)
+	router.HEAD("/originals/:accesstype/:filename", viewOriginal)
+	router.GET("/p/:accesstype/:filename", viewPreview)
+	router.GET("/oembed", getOEmbed)
 	router.POST("/delete", deleteImage)
 	router.POST("/list", listImages)
 	router.GET("/robots.txt", handleRobots)
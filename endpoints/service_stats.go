@@ -0,0 +1,62 @@
+package endpoints
+
+import (
+	"encoding/json"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/hotlink"
+	"github.com/chongyangshi/yronwood/thumbnail"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func serviceStats(req typhon.Request) typhon.Response {
+	serviceStatsRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ServiceStatsRequest{}
+	err = json.Unmarshal(serviceStatsRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	cacheStats := thumbnail.GetCacheStats()
+	hotlinkStats := hotlink.GetStats()
+	return req.Response(types.ServiceStatsResponse{
+		ThumbnailCache: types.ThumbnailCacheStats{
+			Files:     cacheStats.Files,
+			Bytes:     cacheStats.Bytes,
+			Budget:    cacheStats.Budget,
+			HotFiles:  cacheStats.HotFiles,
+			HotBytes:  cacheStats.HotBytes,
+			HotBudget: cacheStats.HotBudget,
+			Hits:      cacheStats.Hits,
+			HotHits:   cacheStats.HotHits,
+			Misses:    cacheStats.Misses,
+			Evictions: cacheStats.Evictions,
+		},
+		Hotlink: types.HotlinkStats{
+			Denied:       hotlinkStats.Denied,
+			Placeholders: hotlinkStats.Placeholders,
+		},
+	})
+}
@@ -0,0 +1,107 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/thumbnail"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func signDerivative(req typhon.Request) typhon.Response {
+	imageDerivativeRequest, err := req.BodyBytes(true)
+	if err != nil {
+		slog.Error(req, "Error reading request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	body := types.ImageDerivativeRequest{}
+	err = json.Unmarshal(imageDerivativeRequest, &body)
+	if err != nil {
+		slog.Error(req, "Error parsing request body: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	// Only admin users can sign derivative parameters of their choice.
+	authenticated, err := auth.VerifyAdminToken(body.Token)
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+	if !authenticated {
+		if body.Token == "" {
+			return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
+		}
+		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	}
+
+	if !validateFilename(body.FileName) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", body.FileName), nil)}
+	}
+
+	validAccessType, _ := validateAccessType(body.AccessType)
+	if !validAccessType {
+		return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
+	}
+
+	params := thumbnail.DerivativeParams{
+		Width:   body.Width,
+		Height:  body.Height,
+		Fit:     body.Fit,
+		Gravity: body.Gravity,
+	}
+	if err := params.Validate(); err != nil {
+		return typhon.Response{Error: err}
+	}
+
+	derivativeURL, err := signDerivativeURL(body.AccessType, body.FileName, params)
+	if err != nil {
+		slog.Error(req, "Error signing derivative %s of %s: %v", params.Canonical(), body.FileName, err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered signing resized image", nil)}
+	}
+
+	return req.Response(types.ImageDerivativeResponse{
+		URL: derivativeURL,
+	})
+}
+
+// signDerivativeURL returns the URL of a derivative of the image with signed parameters,
+// which for private images also carries a pre-signed image token.
+func signDerivativeURL(accessType, fileName string, params thumbnail.DerivativeParams) (string, error) {
+	derivativeURL, err := signDerivativeParamsURL(accessType, fileName, params)
+	if err != nil {
+		return "", err
+	}
+
+	if accessType == config.ConfigAccessTypePrivate {
+		imageToken, err := auth.SignImageToken(imageTokenValidity, fmt.Sprintf("%s/%s", config.ConfigAccessTypePrivate, fileName))
+		if err != nil {
+			return "", err
+		}
+		derivativeURL = fmt.Sprintf("%s&token=%s", derivativeURL, url.QueryEscape(imageToken))
+	}
+
+	return derivativeURL, nil
+}
+
+// signDerivativeParamsURL returns the URL of a derivative of the image with signed
+// parameters, leaving any image token needed to view it to callers.
+func signDerivativeParamsURL(accessType, fileName string, params thumbnail.DerivativeParams) (string, error) {
+	signature, err := auth.SignDerivativeParams(derivativeImagePath(accessType, fileName), params.Canonical())
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("/uploads/%s/%s?%s&sig=%s", url.PathEscape(accessType), url.PathEscape(fileName), params.Canonical(), signature), nil
+}
+
+func derivativeImagePath(accessType, fileName string) string {
+	return fmt.Sprintf("%s/%s", accessType, fileName)
+}
@@ -1,13 +1,13 @@
 package endpoints
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 
 	"github.com/monzo/slog"
 	"github.com/monzo/terrors"
@@ -15,7 +15,18 @@ import (
 
 	"github.com/chongyangshi/yronwood/auth"
 	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/metadata"
+	"github.com/chongyangshi/yronwood/thumbnail"
 	"github.com/chongyangshi/yronwood/types"
+	"github.com/chongyangshi/yronwood/versions"
+)
+
+const (
+	conflictPolicyReject    = "reject"
+	conflictPolicyOverwrite = "overwrite"
+	conflictPolicyRename    = "rename"
+
+	maxRenameAttempts = 1000
 )
 
 var maxUploadSize int64
@@ -55,10 +66,6 @@ func uploadImage(req typhon.Request) typhon.Response {
 		return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
 	}
 
-	if len(body.Payload) == 0 || len(body.Payload) > int(maxUploadSize) {
-		return typhon.Response{Error: terrors.BadRequest("bad_file_size", "Content length of payload is too large", nil)}
-	}
-
 	if !validateFilename(body.Metadata.FileName) {
 		slog.Error(req, "Invalid file name: %+v", err)
 		return typhon.Response{Error: terrors.BadRequest("bad_file_name", "Invalid file name or extension specified", nil)}
@@ -70,6 +77,20 @@ func uploadImage(req typhon.Request) typhon.Response {
 		return typhon.Response{Error: terrors.BadRequest("bad_file_tags", "Invalid file tags specified", nil)}
 	}
 
+	if body.Metadata.DisplayName != "" && !validateDisplayName(body.Metadata.DisplayName) {
+		return typhon.Response{Error: terrors.BadRequest("bad_display_name", "Invalid display name specified", nil)}
+	}
+
+	conflictPolicy := body.ConflictPolicy
+	if conflictPolicy == "" {
+		conflictPolicy = conflictPolicyReject
+	}
+	switch conflictPolicy {
+	case conflictPolicyReject, conflictPolicyOverwrite, conflictPolicyRename:
+	default:
+		return typhon.Response{Error: terrors.BadRequest("bad_conflict_policy", "Invalid file name conflict policy specified", nil)}
+	}
+
 	validAccessType, storagePath := validateAccessType(body.AccessType)
 	if !validAccessType {
 		return typhon.Response{Error: terrors.BadRequest("bad_access_type", "Invalid file access type specified", nil)}
@@ -87,33 +108,83 @@ func uploadImage(req typhon.Request) typhon.Response {
 		return typhon.Response{Error: terrors.InternalService("", "Error encountered retrieving file", nil)}
 	}
 
-	validChecksum, err := validateChecksum([]byte(body.Payload), body.Checksum)
-	if err != nil || !validChecksum {
-		return typhon.Response{Error: terrors.BadRequest("bad_payload", "Invalid payload, could not verify checksum", nil)}
+	decodedPayload, err := decodePayload(req, body.Payload, body.Checksum)
+	if err != nil {
+		return typhon.Response{Error: err}
 	}
 
-	decodedPayload, err := base64.StdEncoding.DecodeString(body.Payload)
+	decodedPayload, err = sanitizePayload(req, body.Metadata.FileName, decodedPayload)
 	if err != nil {
-		slog.Error(req, "Error decoding base64 payload: %v", err)
-		return typhon.Response{Error: terrors.BadRequest("bad_payload", "Invalid payload, could not decode", nil)}
+		return typhon.Response{Error: err}
+	}
+
+	file, fileName, overwriting, err := createUploadFile(req, storagePath, body.Metadata.FileName, body.AccessType, conflictPolicy)
+	if err != nil {
+		return typhon.Response{Error: err}
+	}
+	filePath := path.Join(storagePath, fileName)
+
+	if fileName != body.Metadata.FileName {
+		taggedFileName, err = validateAndEncodeFileNameWithTags(fileName, body.Metadata.Tags)
+		if err != nil {
+			slog.Error(req, "Invalid file name or tags after renaming: %+v", err)
+			file.Close()
+			os.Remove(filePath)
+			return typhon.Response{Error: terrors.BadRequest("bad_file_tags", "Invalid file tags specified", nil)}
+		}
 	}
 
-	if readStoredImageByAccessType(req, body.Metadata.FileName, body.AccessType) != nil {
-		return typhon.Response{Error: terrors.BadRequest("file_exists", "File with given name already exists", nil)}
+	bytesSaved, err := writeUploadFile(req, file, fileName, body.AccessType, decodedPayload)
+	if err != nil {
+		// Files just created are removed again, rather than left empty.
+		if !overwriting {
+			os.Remove(filePath)
+		}
+		return typhon.Response{Error: err}
 	}
 
-	// Upload the original file.
-	filePath := path.Join(storagePath, body.Metadata.FileName)
-	err = ioutil.WriteFile(filePath, decodedPayload, 0644)
+	// Images overwritten lose the display name given to them before, unless given again.
+	err = metadata.Update(req, fileName, body.AccessType, func(record *metadata.Record) {
+		record.DisplayName = body.Metadata.DisplayName
+	})
 	if err != nil {
-		return typhon.Response{Error: terrors.InternalService("", fmt.Sprintf("Could not save file: %v", err), nil)}
+		return typhon.Response{Error: terrors.InternalService("", "Could not record display name of file", nil)}
+	}
+
+	if overwriting {
+		err = thumbnail.InvalidateDerivatives(req, fileName, body.AccessType)
+		if err != nil {
+			return typhon.Response{Error: terrors.InternalService("", "Could not invalidate derived images of previous version of file", nil)}
+		}
+	}
+
+	// Formats not displayed well by browsers get a converted rendition stored alongside.
+	// Failing that, the rendition will be attempted again when the image is viewed.
+	if thumbnail.NeedsWebRendition(fileName) {
+		_, err = thumbnail.CreateWebRendition(req, fileName, storagePath, body.AccessType)
+		if err != nil {
+			slog.Error(req, "Could not create web rendition for %s: %v", fileName, err)
+		}
+	}
+
+	thumbnail.EnqueueThumbnail(req, fileName, storagePath, body.AccessType)
+
+	// Clients see missing details filled in when listing, so failing here is not fatal.
+	if _, err := recordImageDetails(req, fileName, storagePath, body.AccessType); err != nil {
+		slog.Error(req, "Could not record details of %s: %v", fileName, err)
+	}
+
+	response := types.ImageUploadResponse{
+		FileName:       fileName,
+		ConflictPolicy: conflictPolicy,
+		BytesSaved:     bytesSaved,
 	}
 
 	// If tags present, create a symlink from the tagged file name to the original file.
 	// This symlink is used to store the tags in the file system only and would never be
 	// actually followed by Yronwood, only listed and filtered.
-	if taggedFileName == body.Metadata.FileName {
-		return req.Response(nil)
+	if taggedFileName == fileName {
+		return req.Response(response)
 	}
 
 	symlinkPath := path.Join(storagePath, taggedFileName)
@@ -121,5 +192,87 @@ func uploadImage(req typhon.Request) typhon.Response {
 		return typhon.Response{Error: terrors.InternalService("", fmt.Sprintf("Could not create symlink for tagged file: %v", err), nil)}
 	}
 
-	return req.Response(nil)
+	return req.Response(response)
+}
+
+// createUploadFile creates the file an upload is stored in, under the name given unless
+// it is taken, in which case the conflict policy decides what happens. Files are created
+// exclusively, so that concurrent uploads under the same name cannot replace each other
+// without the replaced image being kept as a version. Returns the file, the name it was
+// created under, and whether it replaces an existing image.
+func createUploadFile(ctx context.Context, storagePath, fileName, accessType, conflictPolicy string) (*os.File, string, bool, error) {
+	file, err := createFileExclusively(ctx, storagePath, fileName)
+	if err != nil || file != nil {
+		return file, fileName, false, err
+	}
+
+	switch conflictPolicy {
+	case conflictPolicyReject:
+		return nil, "", false, terrors.BadRequest("file_exists", "File with given name already exists", nil)
+	case conflictPolicyRename:
+		// Appends an increasing numeric suffix to the name part of the file name, until a
+		// name not yet used in the storage path is found.
+		fileNameSplit := strings.SplitN(fileName, ".", 2)
+		for i := 1; i <= maxRenameAttempts; i++ {
+			renamedFileName := fmt.Sprintf("%s-%d.%s", fileNameSplit[0], i, fileNameSplit[1])
+			file, err := createFileExclusively(ctx, storagePath, renamedFileName)
+			if err != nil || file != nil {
+				return file, renamedFileName, false, err
+			}
+		}
+		return nil, "", false, terrors.BadRequest("file_exists", "File with given name already exists and no alternative name is available", nil)
+	}
+
+	// Keep the existing file as a previous version before replacing it, and clear its
+	// tags, which will be replaced by those of the new upload.
+	_, err = versions.ArchiveCurrentVersion(ctx, fileName, storagePath, accessType)
+	if err != nil {
+		return nil, "", false, terrors.InternalService("", "Could not keep previous version of file", nil)
+	}
+
+	err = deleteTagSymlinks(ctx, storagePath, fileName)
+	if err != nil {
+		return nil, "", false, terrors.InternalService("", "Could not clear tags of previous version of file", nil)
+	}
+
+	file, err = os.OpenFile(path.Join(storagePath, fileName), os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		slog.Error(ctx, "Could not open file %s in %s to overwrite: %v", fileName, storagePath, err)
+		return nil, "", false, terrors.InternalService("", fmt.Sprintf("Could not save file: %v", err), nil)
+	}
+
+	return file, fileName, true, nil
+}
+
+// writeUploadFile stores the uploaded image in the file created for it, optimized
+// according to the policy of its access type, and closes the file.
+func writeUploadFile(ctx context.Context, file *os.File, fileName, accessType string, payload []byte) (int64, error) {
+	defer file.Close()
+
+	storedPayload, bytesSaved, err := optimizeUpload(ctx, fileName, accessType, payload)
+	if err != nil {
+		return 0, terrors.InternalService("", "Could not keep original of optimized file", nil)
+	}
+
+	if _, err := file.Write(storedPayload); err != nil {
+		return 0, terrors.InternalService("", fmt.Sprintf("Could not save file: %v", err), nil)
+	}
+	if err := file.Close(); err != nil {
+		return 0, terrors.InternalService("", fmt.Sprintf("Could not save file: %v", err), nil)
+	}
+
+	return bytesSaved, nil
+}
+
+// createFileExclusively creates the file unless it already exists, returning nil if so.
+func createFileExclusively(ctx context.Context, storagePath, fileName string) (*os.File, error) {
+	file, err := os.OpenFile(path.Join(storagePath, fileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, nil
+	} else if err != nil {
+		slog.Error(ctx, "Could not create file %s in %s: %v", fileName, storagePath, err)
+		return nil, terrors.InternalService("", fmt.Sprintf("Could not save file: %v", err), nil)
+	}
+
+	return file, nil
 }
@@ -0,0 +1,134 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/types"
+	"github.com/chongyangshi/yronwood/versions"
+)
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded.Bytes()
+}
+
+func newUploadRequest(t *testing.T, fileName, conflictPolicy string, content []byte) typhon.Request {
+	t.Helper()
+
+	payload := base64.StdEncoding.EncodeToString(content)
+	checksum := sha256.Sum256([]byte(payload))
+	return typhon.NewRequest(context.Background(), http.MethodPut, "https://images.example/upload", types.ImageUploadRequest{
+		Token:          testAdminToken(t),
+		Metadata:       types.ImageMetadata{FileName: fileName},
+		Payload:        payload,
+		Checksum:       hex.EncodeToString(checksum[:]),
+		AccessType:     config.ConfigAccessTypePublic,
+		ConflictPolicy: conflictPolicy,
+	})
+}
+
+func requestUpload(t *testing.T, fileName, conflictPolicy string, content []byte) typhon.Response {
+	t.Helper()
+
+	return uploadImage(newUploadRequest(t, fileName, conflictPolicy, content))
+}
+
+func readTestImage(t *testing.T, fileName string) []byte {
+	t.Helper()
+
+	content, err := os.ReadFile(path.Join(config.ConfigStorageDirectoryPublic, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+func TestUploadImageConflictPolicies(t *testing.T) {
+	useTestImages(t)
+	first, second, third := testPNG(t, 10, 10), testPNG(t, 20, 10), testPNG(t, 30, 10)
+
+	if rsp := requestUpload(t, "cat.png", "", first); rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	for _, conflictPolicy := range []string{"", conflictPolicyReject} {
+		if rsp := requestUpload(t, "cat.png", conflictPolicy, second); !terrors.PrefixMatches(rsp.Error, terrors.ErrBadRequest) {
+			t.Fatalf("Expected upload over an existing image to be rejected with policy %q, got %v", conflictPolicy, rsp.Error)
+		}
+	}
+	if !bytes.Equal(readTestImage(t, "cat.png"), first) {
+		t.Fatal("Expected rejected upload to leave the image as it was")
+	}
+
+	for _, expectedFileName := range []string{"cat-1.png", "cat-2.png"} {
+		rsp := requestUpload(t, "cat.png", conflictPolicyRename, second)
+		uploaded := types.ImageUploadResponse{}
+		if rsp.Error != nil || rsp.Decode(&uploaded) != nil || uploaded.FileName != expectedFileName {
+			t.Fatalf("Expected upload to be renamed to %s, got %+v, %v", expectedFileName, uploaded, rsp.Error)
+		}
+		if !bytes.Equal(readTestImage(t, expectedFileName), second) || !bytes.Equal(readTestImage(t, "cat.png"), first) {
+			t.Fatalf("Expected renamed upload to be stored as %s alongside the image", expectedFileName)
+		}
+	}
+
+	rsp := requestUpload(t, "cat.png", conflictPolicyOverwrite, third)
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	if !bytes.Equal(readTestImage(t, "cat.png"), third) {
+		t.Fatal("Expected image to be overwritten")
+	}
+	previousVersions, err := versions.ListVersions(context.Background(), "cat.png", config.ConfigAccessTypePublic)
+	if err != nil || len(previousVersions) != 1 || previousVersions[0].Size != int64(len(first)) {
+		t.Fatalf("Expected overwritten image to be kept as a version, got %+v, %v", previousVersions, err)
+	}
+
+	if rsp := requestUpload(t, "cat.png", "replace", third); !terrors.PrefixMatches(rsp.Error, terrors.ErrBadRequest) {
+		t.Fatalf("Expected unknown conflict policy to be rejected, got %v", rsp.Error)
+	}
+}
+
+func TestUploadImageConcurrently(t *testing.T) {
+	useTestImages(t)
+
+	// Of uploads under the same name at once, only one is stored under it.
+	const uploads = 8
+	results := make(chan typhon.Response, uploads)
+	for i := 0; i < uploads; i++ {
+		req := newUploadRequest(t, "cat.png", conflictPolicyRename, testPNG(t, 10+i, 10))
+		go func() { results <- uploadImage(req) }()
+	}
+
+	fileNames := map[string]bool{}
+	for i := 0; i < uploads; i++ {
+		rsp := <-results
+		uploaded := types.ImageUploadResponse{}
+		if rsp.Error != nil || rsp.Decode(&uploaded) != nil {
+			t.Fatalf("Unexpected error uploading concurrently: %v", rsp.Error)
+		}
+		if fileNames[uploaded.FileName] {
+			t.Fatalf("Expected each upload to be stored under its own name, got %s twice", uploaded.FileName)
+		}
+		fileNames[uploaded.FileName] = true
+	}
+}
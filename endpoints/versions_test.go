@@ -0,0 +1,198 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/types"
+)
+
+func requestReplace(t *testing.T, token, fileName string, content []byte) typhon.Response {
+	t.Helper()
+
+	payload := base64.StdEncoding.EncodeToString(content)
+	checksum := sha256.Sum256([]byte(payload))
+	return replaceImage(typhon.NewRequest(context.Background(), http.MethodPut, "https://images.example/replace", types.ImageReplaceRequest{
+		Token:      token,
+		FileName:   fileName,
+		AccessType: config.ConfigAccessTypePublic,
+		Payload:    payload,
+		Checksum:   hex.EncodeToString(checksum[:]),
+	}))
+}
+
+func requestVersions(t *testing.T, token, fileName string) typhon.Response {
+	t.Helper()
+
+	return listVersions(typhon.NewRequest(context.Background(), http.MethodPost, "https://images.example/versions", types.ImageVersionsRequest{
+		Token:      token,
+		FileName:   fileName,
+		AccessType: config.ConfigAccessTypePublic,
+	}))
+}
+
+func requestRollback(t *testing.T, token, fileName, version string) typhon.Response {
+	t.Helper()
+
+	return rollbackImage(typhon.NewRequest(context.Background(), http.MethodPost, "https://images.example/rollback", types.ImageRollbackRequest{
+		Token:      token,
+		FileName:   fileName,
+		AccessType: config.ConfigAccessTypePublic,
+		Version:    version,
+	}))
+}
+
+func requestVersion(t *testing.T, fileName, version, token string) typhon.Response {
+	t.Helper()
+
+	query := url.Values{"version": {version}}
+	if token != "" {
+		query.Set("token", token)
+	}
+	return viewImage(typhon.NewRequest(context.Background(), http.MethodGet, "https://images.example/uploads/public/"+fileName+"?"+query.Encode(), nil))
+}
+
+func TestReplaceAndRollBackImage(t *testing.T) {
+	useTestImages(t)
+	adminToken := testAdminToken(t)
+	first, second := testPNG(t, 10, 10), testPNG(t, 20, 10)
+
+	if rsp := requestUpload(t, "cat.png", "", first); rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+
+	rsp := requestReplace(t, adminToken, "cat.png", second)
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	replaced := types.ImageReplaceResponse{}
+	if err := rsp.Decode(&replaced); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readTestImage(t, "cat.png"), second) {
+		t.Fatal("Expected image to be replaced")
+	}
+
+	rsp = requestVersions(t, adminToken, "cat.png")
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	listed := types.ImageVersionsResponse{}
+	if err := rsp.Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	firstChecksum := sha256.Sum256(first)
+	if len(listed.Versions) != 1 || listed.Versions[0].Version != replaced.PreviousVersion || listed.Versions[0].Checksum != hex.EncodeToString(firstChecksum[:]) || listed.Versions[0].Size != int64(len(first)) {
+		t.Fatalf("Expected replaced content to be listed as version %s, got %+v", replaced.PreviousVersion, listed.Versions)
+	}
+
+	rsp = requestRollback(t, adminToken, "cat.png", replaced.PreviousVersion)
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	rolledBack := types.ImageRollbackResponse{}
+	if err := rsp.Decode(&rolledBack); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readTestImage(t, "cat.png"), first) {
+		t.Fatal("Expected image to be rolled back")
+	}
+
+	// The rollback can itself be undone.
+	rsp = requestRollback(t, adminToken, "cat.png", rolledBack.PreviousVersion)
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	if !bytes.Equal(readTestImage(t, "cat.png"), second) {
+		t.Fatal("Expected rollback to be undone")
+	}
+
+	if rsp := requestRollback(t, adminToken, "cat.png", "12345"); !terrors.PrefixMatches(rsp.Error, terrors.ErrNotFound) {
+		t.Fatalf("Expected %s rolling back to a missing version, got %v", terrors.ErrNotFound, rsp.Error)
+	}
+	if rsp := requestReplace(t, adminToken, "missing.png", second); !terrors.PrefixMatches(rsp.Error, terrors.ErrNotFound) {
+		t.Fatalf("Expected %s replacing a missing image, got %v", terrors.ErrNotFound, rsp.Error)
+	}
+}
+
+func TestVersionsRequireAdmin(t *testing.T) {
+	useTestImages(t)
+	adminToken := testAdminToken(t)
+	first := testPNG(t, 10, 10)
+
+	if rsp := requestUpload(t, "cat.png", "", first); rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	rsp := requestReplace(t, adminToken, "cat.png", testPNG(t, 20, 10))
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	replaced := types.ImageReplaceResponse{}
+	if err := rsp.Decode(&replaced); err != nil {
+		t.Fatal(err)
+	}
+
+	imageToken := testImageToken(t, "cat.png")
+	if rsp := requestReplace(t, imageToken, "cat.png", first); !terrors.PrefixMatches(rsp.Error, terrors.ErrForbidden) {
+		t.Fatalf("Expected %s replacing with an image token, got %v", terrors.ErrForbidden, rsp.Error)
+	}
+	if rsp := requestVersions(t, imageToken, "cat.png"); !terrors.PrefixMatches(rsp.Error, terrors.ErrForbidden) {
+		t.Fatalf("Expected %s listing versions with an image token, got %v", terrors.ErrForbidden, rsp.Error)
+	}
+	if rsp := requestRollback(t, imageToken, "cat.png", replaced.PreviousVersion); !terrors.PrefixMatches(rsp.Error, terrors.ErrForbidden) {
+		t.Fatalf("Expected %s rolling back with an image token, got %v", terrors.ErrForbidden, rsp.Error)
+	}
+	for _, rsp := range []typhon.Response{
+		requestReplace(t, "", "cat.png", first),
+		requestVersions(t, "", "cat.png"),
+		requestRollback(t, "", "cat.png", replaced.PreviousVersion),
+	} {
+		if rsp.Error == nil {
+			t.Fatal("Expected versions to not be managed without a token")
+		}
+	}
+
+	// Previous versions of images are not viewed by anyone else, even if the image is public.
+	for _, testCase := range []struct {
+		name  string
+		token string
+		code  string
+	}{
+		{"no token", "", terrors.ErrUnauthorized},
+		{"image token", imageToken, terrors.ErrForbidden},
+	} {
+		if rsp := requestVersion(t, "cat.png", replaced.PreviousVersion, testCase.token); !terrors.PrefixMatches(rsp.Error, testCase.code) {
+			t.Fatalf("Expected %s viewing a previous version with %s, got %v", testCase.code, testCase.name, rsp.Error)
+		}
+	}
+	if current := readTestImage(t, "cat.png"); bytes.Equal(current, first) {
+		t.Fatal("Expected image to be left as replaced by the admin")
+	}
+
+	rsp = requestVersion(t, "cat.png", replaced.PreviousVersion, adminToken)
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	content, err := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, first) {
+		t.Fatal("Expected previous version to be served to admins")
+	}
+	if cacheControl := rsp.Header.Get("Cache-Control"); cacheControl != config.ConfigCacheControlPrivate {
+		t.Fatalf("Expected previous version to be cached privately, got %s", cacheControl)
+	}
+}
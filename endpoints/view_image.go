@@ -1,11 +1,15 @@
 package endpoints
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/monzo/slog"
 	"github.com/monzo/terrors"
@@ -13,9 +17,23 @@ import (
 
 	"github.com/chongyangshi/yronwood/auth"
 	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/hotlink"
+	"github.com/chongyangshi/yronwood/metadata"
 	"github.com/chongyangshi/yronwood/thumbnail"
+	"github.com/chongyangshi/yronwood/versions"
 )
 
+const svgContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+
+var formatNegotiation = false
+
+func init() {
+	formatNegotiationParsed, err := strconv.ParseBool(config.ConfigFormatNegotiation)
+	if err == nil {
+		formatNegotiation = formatNegotiationParsed
+	}
+}
+
 func viewImage(req typhon.Request) typhon.Response {
 	err := req.ParseForm()
 	if err != nil {
@@ -29,22 +47,15 @@ func viewImage(req typhon.Request) typhon.Response {
 		return typhon.Response{Error: terrors.NotFound("not_found", "Requested image is not found", nil)}
 	}
 
-	if accessType == config.ConfigAccessTypePrivate {
-		// Auth optional for public images and unlisted images.
-		authenticated, err := auth.VerifyImageToken(
-			req.FormValue("token"),
-			fmt.Sprintf("%s/%s", config.ConfigAccessTypePrivate, fileName),
-		)
-		if err != nil {
-			slog.Error(req, "Error authenticating client: %v", err)
-			return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
-		}
+	if validAccessType, _ := validateAccessType(accessType); !validAccessType {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Requested image is not found", nil)}
+	}
 
-		if !authenticated {
-			if req.FormValue("token") == "" {
-				return typhon.Response{Error: terrors.Unauthorized("", "Authentication required", nil)}
-			}
-			return typhon.Response{Error: terrors.Forbidden("", "Authentication failure", nil)}
+	// Previous versions are only served to admins, whose tokens are checked instead.
+	if accessType == config.ConfigAccessTypePrivate && req.FormValue("version") == "" {
+		// Auth optional for public images and unlisted images.
+		if err := authenticateImageToken(req, fileName, req.FormValue("token")); err != nil {
+			return typhon.Response{Error: err}
 		}
 	}
 
@@ -52,52 +63,386 @@ func viewImage(req typhon.Request) typhon.Response {
 		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", fileName), nil)}
 	}
 
+	if allowed, action := hotlink.Check(req, accessType, &req.Request); !allowed {
+		return hotlinkResponse(req, action)
+	}
+
+	// Requests with tokens are from admins, or for private images.
+	return serveImage(req, fileName, accessType, req.FormValue("token") != "")
+}
+
+// serveImage serves the image as requested by the query of the request, which must have
+// been parsed, once the client is allowed to view the image. Images served privately are
+// only for the client they are served to, so are not to be kept by caches for others.
+func serveImage(req typhon.Request, fileName, accessType string, private bool) typhon.Response {
+	// Previous versions may hold what has since been cropped or redacted out of the image,
+	// so they are only served to admins.
+	if req.FormValue("version") != "" {
+		if err := authenticateAdminToken(req, req.FormValue("token")); err != nil {
+			return typhon.Response{Error: err}
+		}
+		private = true
+	}
+
+	derivativeParams, err := parseDerivativeParams(req, accessType, fileName)
+	if err != nil {
+		return typhon.Response{Error: err}
+	}
+
+	watermarked, err := watermarkApplies(req, fileName, accessType)
+	if err != nil {
+		return typhon.Response{Error: err}
+	}
+
+	// Resized and watermarked images are served in the format of thumbnails of the image,
+	// and other images as stored or as their web rendition, unless converted.
+	contentType := getContentTypeFromFilename(fileName)
+	if derivativeParams != nil || req.FormValue("thumbnail") == "yes" || watermarked {
+		contentType = thumbnail.ThumbnailContentType(fileName)
+	} else if thumbnail.NeedsWebRendition(fileName) && req.FormValue("original") != "yes" {
+		contentType = thumbnail.WebRenditionContentType()
+	}
+
+	// Previous versions are only ever served as they were stored.
+	var format string
+	if req.FormValue("version") == "" {
+		format, err = requestedFormat(req, fileName, contentType)
+		if err != nil {
+			return typhon.Response{Error: err}
+		}
+	}
+
+	// Stored images and previous versions are streamed from their files, while resized and
+	// converted images are served from the cache of them, where they are read into memory.
+	var content *imageContent
 	var imageBytes []byte
-	if req.FormValue("thumbnail") == "yes" {
-		imageBytes, err = readThumbnailByAccessType(req, fileName, accessType)
+	if req.FormValue("version") != "" {
+		content, err = newFileContent(req, versions.OpenVersion(req, fileName, accessType, req.FormValue("version")))
+		if err != nil {
+			return typhon.Response{Error: terrors.InternalService("", "Could not read image version due to an internal error", nil)}
+		}
+		contentType = getContentTypeFromFilename(fileName)
+	} else if derivativeParams != nil {
+		imageBytes, err = readRenditionByAccessType(req, fileName, accessType, thumbnail.Rendition{
+			Params:      *derivativeParams,
+			Watermarked: watermarked,
+			Format:      format,
+		})
+		if err != nil {
+			slog.Error(req, "Error reading derivative %s for image %s of access type %s: %v", derivativeParams.Canonical(), fileName, accessType, err)
+			return typhon.Response{Error: terrors.InternalService("derivative_error", "Could not read resized image due to an internal error", nil)}
+		}
+	} else if req.FormValue("thumbnail") == "yes" {
+		imageBytes, err = readRenditionByAccessType(req, fileName, accessType, thumbnail.Rendition{
+			Thumbnail:   true,
+			Watermarked: watermarked,
+			Format:      format,
+		})
 		if err != nil {
 			slog.Error(req, "Error reading thumbnail for image %s of access type %s: %v", fileName, accessType, err)
 			return typhon.Response{Error: terrors.InternalService("thumbnail_error", "Could not read thumbnail due to an internal error", nil)}
 		}
+	} else if watermarked || format != "" {
+		// Watermarked and converted images are made from the stored image at its original
+		// size, which for formats not displayed well by browsers also serves as their web
+		// rendition.
+		imageBytes, err = readRenditionByAccessType(req, fileName, accessType, thumbnail.Rendition{
+			Watermarked: watermarked,
+			Format:      format,
+		})
+		if err != nil {
+			slog.Error(req, "Error reading rendition of image %s of access type %s: %v", fileName, accessType, err)
+			return typhon.Response{Error: terrors.InternalService("conversion_error", "Could not read converted image due to an internal error", nil)}
+		}
+	} else if thumbnail.NeedsWebRendition(fileName) && req.FormValue("original") != "yes" {
+		// Formats not displayed well by browsers are served as a converted rendition by
+		// default, with the original still available on request.
+		imageBytes, err = readWebRenditionByAccessType(req, fileName, accessType)
+		if err != nil {
+			slog.Error(req, "Error reading web rendition for image %s of access type %s: %v", fileName, accessType, err)
+			return typhon.Response{Error: terrors.InternalService("rendition_error", "Could not read web rendition due to an internal error", nil)}
+		}
 	} else {
-		imageBytes = readStoredImageByAccessType(req, fileName, accessType)
+		content, err = newFileContent(req, openStoredImageByAccessType(req, fileName, accessType))
+		if err != nil {
+			return typhon.Response{Error: terrors.InternalService("", "Could not read image due to an internal error", nil)}
+		}
 	}
-
 	if imageBytes != nil {
-		response := typhon.NewResponse(req)
-		response.Body = ioutil.NopCloser(bytes.NewReader(imageBytes))
-		response.Header.Set("Content-Type", getContentTypeFromFilename(fileName))
+		content = newBytesContent(imageBytes)
+	}
+	if format != "" {
+		contentType = thumbnail.FormatContentType(format)
+	}
+
+	if content == nil {
+		return typhon.Response{Error: terrors.NotFound("not_found", fmt.Sprintf("Requested image %s is not found", fileName), nil)}
+	}
+
+	// Previous versions are served with their ETag alone, as their files are not dated by
+	// when they were uploaded. Renditions date from when the image they are made from was.
+	var lastModified time.Time
+	var etag string
+	switch {
+	case req.FormValue("version") != "":
+		etag, err = contentETag(content)
+	case imageBytes != nil:
+		lastModified = storedImageModTime(fileName, accessType)
+		etag, err = contentETag(content)
+	default:
+		lastModified = content.modTime
+		etag, err = storedImageETag(req, fileName, accessType, content)
+	}
+	if err != nil {
+		content.Close()
+		slog.Error(req, "Error hashing image %s of access type %s: %v", fileName, accessType, err)
+		return typhon.Response{Error: terrors.InternalService("", "Could not read image due to an internal error", nil)}
+	}
+
+	response := typhon.NewResponse(req)
+	setValidators(response, cacheControlForAccessType(accessType, private), etag, lastModified)
+	if formatNegotiation {
+		// Caches must not serve images converted for one client to others.
+		response.Header.Add("Vary", "Accept")
+	}
+	if hotlink.Applies(accessType) {
+		// Nor images allowed for one referrer to others.
+		response.Header.Add("Vary", "Origin, Referer")
+	}
+	if notModified(req, etag, lastModified) {
+		content.Close()
+		response.StatusCode = http.StatusNotModified
+		response.Body = nil
 		return response
 	}
 
-	return typhon.Response{Error: terrors.NotFound("not_found", fmt.Sprintf("Requested image %s is not found", fileName), nil)}
+	if contentType == svgContentType {
+		// SVG images are sanitized when uploaded, but as they are documents which can
+		// run scripts, browsers are also told not to load or run anything they contain.
+		response.Header.Set("Content-Security-Policy", svgContentSecurityPolicy)
+		response.Header.Set("X-Content-Type-Options", "nosniff")
+	}
+
+	if req.FormValue("download") == "1" {
+		response.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": downloadFileName(req, fileName, accessType, contentType),
+		}))
+	}
+
+	return serveContent(req, response, content, contentType, etag, lastModified)
 }
 
-func readStoredImageByAccessType(ctx context.Context, fileName, accessType string) []byte {
-	var imageBytes []byte
-	switch accessType {
-	case config.ConfigAccessTypePublic:
-		imageBytes = readFile(ctx, config.ConfigStorageDirectoryPublic, fileName)
-	case config.ConfigAccessTypeUnlisted:
-		imageBytes = readFile(ctx, config.ConfigStorageDirectoryUnlisted, fileName)
-	case config.ConfigAccessTypePrivate:
-		imageBytes = readFile(ctx, config.ConfigStorageDirectoryPrivate, fileName)
+// hotlinkResponse returns what is served in place of an image for a request blocked by
+// hotlink rules. Placeholders are not cached, as caches would serve them to others.
+func hotlinkResponse(req typhon.Request, action string) typhon.Response {
+	if action != hotlink.ActionPlaceholder {
+		return typhon.Response{Error: terrors.Forbidden("hotlink_denied", "Requested image cannot be embedded here", nil)}
+	}
+
+	placeholder, contentType := hotlink.Placeholder()
+	response := typhon.NewResponse(req)
+	response.Header.Set("Cache-Control", "no-store")
+	return serveContent(req, response, newBytesContent(placeholder), contentType, "", time.Time{})
+}
+
+// downloadFileName returns the name the image is saved as when downloaded, which is its
+// display name if given one, or otherwise its stored name. The extension is that of the
+// format the image is served in, as it may have been converted.
+func downloadFileName(ctx context.Context, fileName, accessType, contentType string) string {
+	downloadName := fileName
+	record, err := metadata.Get(ctx, fileName, accessType)
+	if err == nil && record.DisplayName != "" {
+		downloadName = record.DisplayName
+	}
+
+	extension := path.Ext(downloadName)
+	servedExtension := config.ContentTypeToFileExtension(contentType)
+	switch {
+	case servedExtension == "" || config.FileExtensionToContentType(strings.TrimPrefix(extension, ".")) == contentType:
+	case config.FileExtensionToContentType(strings.TrimPrefix(extension, ".")) == "application/octet-stream":
+		// Display names need not have an extension, or may only appear to.
+		downloadName = fmt.Sprintf("%s.%s", downloadName, servedExtension)
+	default:
+		downloadName = fmt.Sprintf("%s.%s", strings.TrimSuffix(downloadName, extension), servedExtension)
 	}
 
-	return imageBytes
+	return downloadName
 }
 
-func readThumbnailByAccessType(ctx context.Context, fileName, accessType string) ([]byte, error) {
+// openStoredImageByAccessType opens the stored image for reading, returning nil if it does
+// not exist. The caller is responsible for closing the file.
+func openStoredImageByAccessType(ctx context.Context, fileName, accessType string) *os.File {
+	var file *os.File
 	switch accessType {
 	case config.ConfigAccessTypePublic:
-		return thumbnail.GetThumbnailForImage(ctx, fileName, config.ConfigStorageDirectoryPublic, accessType)
+		file = openFile(ctx, config.ConfigStorageDirectoryPublic, fileName)
 	case config.ConfigAccessTypeUnlisted:
-		return thumbnail.GetThumbnailForImage(ctx, fileName, config.ConfigStorageDirectoryUnlisted, accessType)
+		file = openFile(ctx, config.ConfigStorageDirectoryUnlisted, fileName)
 	case config.ConfigAccessTypePrivate:
-		return thumbnail.GetThumbnailForImage(ctx, fileName, config.ConfigStorageDirectoryPrivate, accessType)
+		file = openFile(ctx, config.ConfigStorageDirectoryPrivate, fileName)
+	}
+
+	return file
+}
+
+// readRenditionByAccessType returns the rendition of the image, or nothing if the image
+// does not exist.
+func readRenditionByAccessType(ctx context.Context, fileName, accessType string, rendition thumbnail.Rendition) ([]byte, error) {
+	validAccessType, storagePath := validateAccessType(accessType)
+	if !validAccessType || !fileExists(storagePath, fileName) {
+		return nil, nil
+	}
+
+	return thumbnail.GetRenditionForImage(ctx, fileName, storagePath, accessType, rendition)
+}
+
+// parseDerivativeParams reads any resizing and cropping parameters from the request. To
+// stop clients from exhausting resources by requesting arbitrary sizes, only configured
+// presets or parameters we have signed for the image are accepted. Returns nil if no
+// derivative is requested.
+func parseDerivativeParams(req typhon.Request, accessType, fileName string) (*thumbnail.DerivativeParams, error) {
+	if preset := req.FormValue("preset"); preset != "" {
+		params, found := thumbnail.PresetDerivativeParams(preset)
+		if !found {
+			return nil, terrors.BadRequest("invalid_preset", fmt.Sprintf("Derivative preset %s is not configured", preset), nil)
+		}
+		return &params, nil
+	}
+
+	if req.FormValue("w") == "" && req.FormValue("h") == "" && req.FormValue("fit") == "" && req.FormValue("gravity") == "" {
+		return nil, nil
+	}
+
+	params := thumbnail.DerivativeParams{
+		Fit:     req.FormValue("fit"),
+		Gravity: req.FormValue("gravity"),
+	}
+	for formKey, dimension := range map[string]*int{"w": &params.Width, "h": &params.Height} {
+		if req.FormValue(formKey) == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(req.FormValue(formKey))
+		if err != nil {
+			return nil, terrors.BadRequest("invalid_derivative", fmt.Sprintf("Derivative dimension %s is not a number", formKey), nil)
+		}
+		*dimension = parsed
+	}
+
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	if req.FormValue("sig") == "" {
+		return nil, terrors.Forbidden("unsigned_derivative", "Resized images must be requested with a preset or signed parameters", nil)
+	}
+
+	verified, err := auth.VerifyDerivativeParams(req.FormValue("sig"), derivativeImagePath(accessType, fileName), params.Canonical())
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, terrors.Forbidden("bad_signature", "Resized image parameters are not signed for this image", nil)
+	}
+
+	return &params, nil
+}
+
+// requestedFormat returns the format to convert the image into, if it is to be served in
+// another format than its content type: either as requested, or as negotiated with the
+// client if enabled.
+func requestedFormat(req typhon.Request, fileName, contentType string) (string, error) {
+	if contentType == svgContentType {
+		if req.FormValue("format") != "" {
+			return "", terrors.BadRequest("invalid_format", "SVG images cannot be converted", nil)
+		}
+		return "", nil
+	}
+
+	var format string
+	if req.FormValue("format") != "" {
+		var err error
+		format, err = thumbnail.ParseFormat(req.FormValue("format"))
+		if err != nil {
+			return "", err
+		}
+	} else if formatNegotiation {
+		format = thumbnail.NegotiateFormat(req.Header.Get("Accept"), contentType)
+	}
+
+	if thumbnail.FormatContentType(format) == contentType {
+		return "", nil
+	}
+
+	return format, nil
+}
+
+// watermarkApplies returns whether the image is to be served with a watermark, which
+// admins can bypass by passing their token.
+func watermarkApplies(req typhon.Request, fileName, accessType string) (bool, error) {
+	if !thumbnail.WatermarkApplies(fileName, accessType) {
+		return false, nil
+	}
+	if req.FormValue("token") == "" {
+		return true, nil
+	}
+
+	authenticated, err := auth.VerifyAdminToken(req.FormValue("token"))
+	if err != nil {
+		slog.Error(req, "Error authenticating client: %v", err)
+		return false, terrors.InternalService("", "Error encountered handling request", nil)
+	}
+	if !authenticated {
+		return false, terrors.Forbidden("", "Authentication failure", nil)
+	}
+
+	return false, nil
+}
+
+// authenticateImageToken returns a client error unless the image token allows the private
+// image to be viewed.
+func authenticateImageToken(ctx context.Context, fileName, token string) error {
+	if token == "" {
+		return terrors.Unauthorized("", "Authentication required", nil)
+	}
+
+	authenticated, err := auth.VerifyImageToken(token, fmt.Sprintf("%s/%s", config.ConfigAccessTypePrivate, fileName))
+	if err != nil {
+		slog.Error(ctx, "Error authenticating client: %v", err)
+		return terrors.InternalService("", "Error encountered handling request", nil)
+	}
+
+	if !authenticated {
+		return terrors.Forbidden("", "Authentication failure", nil)
+	}
+
+	return nil
+}
+
+// authenticateAdminToken returns a client error unless the token is an admin's.
+func authenticateAdminToken(ctx context.Context, token string) error {
+	if token == "" {
+		return terrors.Unauthorized("", "Authentication required", nil)
+	}
+
+	authenticated, err := auth.VerifyAdminToken(token)
+	if err != nil {
+		slog.Error(ctx, "Error authenticating client: %v", err)
+		return terrors.InternalService("", "Error encountered handling request", nil)
+	}
+	if !authenticated {
+		return terrors.Forbidden("", "Authentication failure", nil)
+	}
+
+	return nil
+}
+
+func readWebRenditionByAccessType(ctx context.Context, fileName, accessType string) ([]byte, error) {
+	validAccessType, storagePath := validateAccessType(accessType)
+	if !validAccessType {
+		return nil, nil
 	}
 
-	return nil, nil
+	return thumbnail.GetWebRenditionForImage(ctx, fileName, storagePath, accessType)
 }
 
 // For legacy-compatible reasons, we process image url in a pseudo-static manner (apihost/accesstype/filename.jpg)
@@ -0,0 +1,79 @@
+package endpoints
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/optimize"
+)
+
+// viewOriginal serves the image as uploaded, where it was kept when the image was stored
+// optimized. Originals are only served to admins, as they may hold metadata or detail
+// which the optimized image does not.
+func viewOriginal(req typhon.Request) typhon.Response {
+	err := req.ParseForm()
+	if err != nil {
+		slog.Error(req, "Error processing query params: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	success, accessType, fileName := processURI(req.URL.Path)
+	if !success {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Requested original is not found", nil)}
+	}
+
+	if validAccessType, _ := validateAccessType(accessType); !validAccessType {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Requested original is not found", nil)}
+	}
+
+	if err := authenticateAdminToken(req, req.FormValue("token")); err != nil {
+		return typhon.Response{Error: err}
+	}
+
+	if !validateFilename(fileName) {
+		return typhon.Response{Error: terrors.BadRequest("invalid_filename", fmt.Sprintf("File name %s is invalid", fileName), nil)}
+	}
+
+	content, err := newFileContent(req, optimize.OpenOriginal(req, fileName, accessType))
+	if err != nil {
+		return typhon.Response{Error: terrors.InternalService("", "Could not read original due to an internal error", nil)}
+	}
+	if content == nil {
+		return typhon.Response{Error: terrors.NotFound("not_found", fmt.Sprintf("No original of image %s is kept", fileName), nil)}
+	}
+
+	etag, err := contentETag(content)
+	if err != nil {
+		content.Close()
+		slog.Error(req, "Error hashing original of image %s of access type %s: %v", fileName, accessType, err)
+		return typhon.Response{Error: terrors.InternalService("", "Could not read original due to an internal error", nil)}
+	}
+
+	response := typhon.NewResponse(req)
+	setValidators(response, cacheControlForAccessType(accessType, true), etag, content.modTime)
+	if notModified(req, etag, content.modTime) {
+		content.Close()
+		response.StatusCode = http.StatusNotModified
+		response.Body = nil
+		return response
+	}
+
+	return serveContent(req, response, content, getContentTypeFromFilename(fileName), etag, content.modTime)
+}
+
+// RemoveOrphanedOriginals removes originals kept of images which are no longer stored.
+func RemoveOrphanedOriginals(ctx context.Context) {
+	removed, err := optimize.RemoveOrphanedOriginals(ctx, accessTypeToPaths(config.ConfigAccessTypePrivate))
+	if err != nil {
+		slog.Error(ctx, "Could not remove orphaned originals: %v", err)
+		return
+	}
+
+	slog.Info(ctx, "Removed %d originals of images no longer stored", removed)
+}
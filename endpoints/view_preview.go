@@ -0,0 +1,97 @@
+package endpoints
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+const previewContentSecurityPolicy = "default-src 'none'; img-src *; style-src 'unsafe-inline'"
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+{{- if .NoIndex}}
+<meta name="robots" content="noindex">
+{{- end}}
+<meta property="og:type" content="website">
+<meta property="og:site_name" content="{{.SiteName}}">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:url" content="{{.PageURL}}">
+<meta property="og:image" content="{{.ImageURL}}">
+<meta property="og:image:type" content="{{.ContentType}}">
+<meta property="og:image:alt" content="{{.Title}}">
+{{- if .Width}}
+<meta property="og:image:width" content="{{.Width}}">
+<meta property="og:image:height" content="{{.Height}}">
+{{- end}}
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:title" content="{{.Title}}">
+<meta name="twitter:image" content="{{.ImageURL}}">
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}" title="{{.Title}}">
+<style>body{margin:0;min-height:100vh;display:flex;align-items:center;justify-content:center;background:#111}img{max-width:100%;max-height:100vh}</style>
+</head>
+<body>
+<img src="{{.ImageURL}}" alt="{{.Title}}">
+</body>
+</html>
+`))
+
+type previewPage struct {
+	imagePreview
+	SiteName  string
+	OEmbedURL string
+	NoIndex   bool
+}
+
+func viewPreview(req typhon.Request) typhon.Response {
+	err := req.ParseForm()
+	if err != nil {
+		slog.Error(req, "Error processing query params: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	success, accessType, fileName := processURI(req.URL.Path)
+	if !success {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Requested image is not found", nil)}
+	}
+
+	baseURL := previewBaseURL(req)
+	preview, err := getImagePreview(req, baseURL, fileName, accessType, req.FormValue("token"))
+	if err != nil {
+		return typhon.Response{Error: err}
+	}
+
+	// Only public images are listed, so pages of others are not to be indexed either.
+	page := previewPage{
+		imagePreview: preview,
+		SiteName:     config.ConfigPreviewSiteName,
+		OEmbedURL:    fmt.Sprintf("%s/oembed?format=json&url=%s", baseURL, url.QueryEscape(preview.PageURL)),
+		NoIndex:      accessType != config.ConfigAccessTypePublic,
+	}
+
+	var rendered bytes.Buffer
+	if err := previewTemplate.Execute(&rendered, page); err != nil {
+		slog.Error(req, "Error rendering preview of %s: %v", fileName, err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	rsp := typhon.NewResponse(req)
+	rsp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	rsp.Header.Set("Content-Security-Policy", previewContentSecurityPolicy)
+	setPreviewCacheControl(rsp, accessType)
+	rsp.Body = ioutil.NopCloser(bytes.NewReader(rendered.Bytes()))
+
+	return rsp
+}
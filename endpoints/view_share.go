@@ -0,0 +1,85 @@
+package endpoints
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/share"
+)
+
+func viewShare(req typhon.Request) typhon.Response {
+	err := req.ParseForm()
+	if err != nil {
+		slog.Error(req, "Error processing query params: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	// Links share the image as it is now, so previous versions of it are not shared.
+	if req.FormValue("version") != "" {
+		return typhon.Response{Error: terrors.BadRequest("invalid_version", "Previous versions of images cannot be viewed through share links", nil)}
+	}
+
+	// Passwords are preferably sent in a header, as query parameters are more often logged,
+	// but browsers following links can only send them as a parameter.
+	password := req.Header.Get("X-Share-Password")
+	if password == "" {
+		password = req.FormValue("password")
+	}
+
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, "/s/"), "/")
+	link, err := share.Open(req, id, password)
+	switch err {
+	case nil:
+	case share.ErrNotFound:
+		return typhon.Response{Error: terrors.NotFound("not_found", "Share link is not found", nil)}
+	case share.ErrExpired:
+		return typhon.Response{Error: terrors.NotFound("share_expired", "Share link has expired", nil)}
+	case share.ErrViewsExhausted:
+		return typhon.Response{Error: terrors.NotFound("share_exhausted", "Share link has been viewed as many times as allowed", nil)}
+	case share.ErrPasswordRequired:
+		return typhon.Response{Error: terrors.Unauthorized("password_required", "Share link requires a password", nil)}
+	case share.ErrWrongPassword:
+		return typhon.Response{Error: terrors.Forbidden("bad_password", "Share link password is wrong", nil)}
+	case share.ErrLocked:
+		return typhon.Response{Error: terrors.RateLimited("share_locked", "Share link is locked after too many wrong passwords, try again later", nil)}
+	default:
+		slog.Error(req, "Error opening share link %s: %v", id, err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	if !validateFilename(link.FileName) {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Requested image is not found", nil)}
+	}
+
+	// Links limited in views serve their image only in full, as otherwise it could be
+	// downloaded in ranges without any of them counting as a view.
+	if link.MaxViews > 0 {
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+	}
+
+	// Links can be revoked and limited in views, so what they serve is not to be cached
+	// for anyone else.
+	response := serveImage(req, link.FileName, link.AccessType, true)
+
+	// Only the image served in full counts as a view, rather than requests which check
+	// for it, revalidate it or resume downloading it where not limited in views.
+	if req.Method != http.MethodGet || response.Error != nil || response.StatusCode != http.StatusOK {
+		return response
+	}
+	if err := share.CountView(req, link.ID); err != nil {
+		if response.Body != nil {
+			response.Body.Close()
+		}
+		if err == share.ErrNotFound {
+			return typhon.Response{Error: terrors.NotFound("not_found", "Share link is not found", nil)}
+		}
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	return response
+}
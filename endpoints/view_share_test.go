@@ -0,0 +1,69 @@
+package endpoints
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/share"
+)
+
+func requestShare(id string, header map[string]string) typhon.Response {
+	req := typhon.NewRequest(context.Background(), http.MethodGet, "https://images.example/s/"+id, nil)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+
+	return viewShare(req)
+}
+
+func TestViewShareCountsRanges(t *testing.T) {
+	useTestImages(t)
+	writeTestImage(t, config.ConfigAccessTypePrivate, "cat.png", 10, 10)
+	_, storagePath := validateAccessType(config.ConfigAccessTypePrivate)
+	content, err := ioutil.ReadFile(path.Join(storagePath, "cat.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limited, err := share.Create(context.Background(), "cat.png", config.ConfigAccessTypePrivate, time.Hour, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranges of images shared by links limited in views are served in full, and counted.
+	rsp := requestShare(limited.ID, map[string]string{"Range": "bytes=0-"})
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	served, err := rsp.BodyBytes(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.StatusCode != http.StatusOK || len(served) != len(content) {
+		t.Fatalf("Expected image to be served in full, got %d with %d bytes", rsp.StatusCode, len(served))
+	}
+	if rsp := requestShare(limited.ID, map[string]string{"Range": "bytes=0-9"}); !terrors.PrefixMatches(rsp.Error, terrors.ErrNotFound) {
+		t.Fatalf("Expected views of link to be exhausted after a range was served, got %v", rsp.Error)
+	}
+
+	// Links not limited in views serve ranges as they are.
+	unlimited, err := share.Create(context.Background(), "cat.png", config.ConfigAccessTypePrivate, time.Hour, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp = requestShare(unlimited.ID, map[string]string{"Range": "bytes=0-9"})
+	if rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	if rsp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected range to be served, got %d", rsp.StatusCode)
+	}
+}
@@ -0,0 +1,110 @@
+package endpoints
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/auth"
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/hotlink"
+	"github.com/chongyangshi/yronwood/shortlink"
+)
+
+func viewShortLink(req typhon.Request) typhon.Response {
+	err := req.ParseForm()
+	if err != nil {
+		slog.Error(req, "Error processing query params: %v", err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	// Links resolve to the image as it is now, so previous versions of it are not resolved.
+	if req.FormValue("version") != "" {
+		return typhon.Response{Error: terrors.BadRequest("invalid_version", "Previous versions of images cannot be viewed through short links", nil)}
+	}
+
+	slug := strings.Trim(strings.TrimPrefix(req.URL.Path, "/i/"), "/")
+	link, err := shortlink.Resolve(req, slug, false)
+	switch err {
+	case nil:
+	case shortlink.ErrNotFound:
+		return typhon.Response{Error: terrors.NotFound("not_found", "Short link is not found", nil)}
+	default:
+		slog.Error(req, "Error resolving short link %s: %v", slug, err)
+		return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+	}
+
+	if !validateFilename(link.FileName) {
+		return typhon.Response{Error: terrors.NotFound("not_found", "Requested image is not found", nil)}
+	}
+
+	var response typhon.Response
+	if link.Mode == shortlink.ModeRedirect {
+		response = redirectToImage(req, link)
+	} else {
+		if allowed, action := hotlink.Check(req, link.AccessType, &req.Request); !allowed {
+			return hotlinkResponse(req, action)
+		}
+
+		// Links can be deleted and given to other images, so what they serve is not to be
+		// cached for anyone else.
+		response = serveImage(req, link.FileName, link.AccessType, true)
+	}
+
+	// Only redirects and images served count as hits, rather than requests which check
+	// for the image or revalidate it.
+	if req.Method != http.MethodGet || response.Error != nil {
+		return response
+	}
+	switch response.StatusCode {
+	case http.StatusFound, http.StatusOK, http.StatusPartialContent:
+	default:
+		return response
+	}
+	if err := shortlink.CountHit(req, link.Slug); err != nil && err != shortlink.ErrNotFound {
+		// The link was resolved, so the image is still served if its hit is not counted.
+		slog.Error(req, "Error counting hit of short link %s: %v", link.Slug, err)
+	}
+
+	return response
+}
+
+// redirectToImage redirects to the image the link resolves to, with the query parameters
+// of the request, such as for thumbnails. Private images are redirected to with an image
+// token signed for the redirect, as anyone given the link can view the image.
+func redirectToImage(req typhon.Request, link shortlink.Link) typhon.Response {
+	query := req.URL.Query()
+	query.Del("token")
+	if link.AccessType == config.ConfigAccessTypePrivate {
+		imageToken, err := auth.SignImageToken(imageTokenValidity, fmt.Sprintf("%s/%s", config.ConfigAccessTypePrivate, link.FileName))
+		if err != nil {
+			slog.Error(req, "Error signing image token for short link %s: %v", link.Slug, err)
+			return typhon.Response{Error: terrors.InternalService("", "Error encountered handling request", nil)}
+		}
+		query.Set("token", imageToken)
+	}
+
+	location := fmt.Sprintf("%s/uploads/%s/%s", strings.TrimSuffix(config.ConfigPublicURL, "/"), url.PathEscape(link.AccessType), url.PathEscape(link.FileName))
+	if len(query) > 0 {
+		location = fmt.Sprintf("%s?%s", location, query.Encode())
+	}
+	response := fmt.Sprintf("Click <a href='%s'>here</a> if you are not being redirected automatically.", html.EscapeString(location))
+
+	rsp := typhon.NewResponse(req)
+	rsp.Header.Set("Location", location)
+	rsp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	// Redirects are not cached, so that hits are counted and tokens signed for each.
+	rsp.Header.Set("Cache-Control", "no-store")
+	rsp.StatusCode = http.StatusFound
+	rsp.Body = ioutil.NopCloser(bytes.NewReader([]byte(response)))
+
+	return rsp
+}
@@ -0,0 +1,62 @@
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/shortlink"
+)
+
+func TestViewShortLinkCountsHits(t *testing.T) {
+	useTestImages(t)
+	writeTestImage(t, config.ConfigAccessTypePublic, "cat.png", 10, 10)
+	for slug, mode := range map[string]string{"inline": shortlink.ModeInline, "redirect": shortlink.ModeRedirect} {
+		if _, err := shortlink.Create(context.Background(), slug, "cat.png", config.ConfigAccessTypePublic, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	view := func(method, slug string, header map[string]string) typhon.Response {
+		req := typhon.NewRequest(context.Background(), method, "https://images.example/i/"+slug, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		rsp := viewShortLink(req)
+		if rsp.Error != nil {
+			t.Fatal(rsp.Error)
+		}
+		return rsp
+	}
+
+	etag := view(http.MethodGet, "inline", nil).Header.Get("ETag")
+	for _, testCase := range []struct {
+		name   string
+		method string
+		slug   string
+		header map[string]string
+		status int
+		hits   int64
+	}{
+		{"image served", http.MethodGet, "inline", nil, http.StatusOK, 2},
+		{"range served", http.MethodGet, "inline", map[string]string{"Range": "bytes=0-9"}, http.StatusPartialContent, 3},
+		{"revalidation", http.MethodGet, "inline", map[string]string{"If-None-Match": etag}, http.StatusNotModified, 3},
+		{"image checked", http.MethodHead, "inline", nil, http.StatusOK, 3},
+		{"redirect", http.MethodGet, "redirect", nil, http.StatusFound, 1},
+		{"redirect checked", http.MethodHead, "redirect", nil, http.StatusFound, 1},
+	} {
+		if rsp := view(testCase.method, testCase.slug, testCase.header); rsp.StatusCode != testCase.status {
+			t.Fatalf("Expected %d for %s, got %d", testCase.status, testCase.name, rsp.StatusCode)
+		}
+		link, err := shortlink.Resolve(context.Background(), testCase.slug, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.Hits != testCase.hits {
+			t.Fatalf("Expected %d hits after %s, got %d", testCase.hits, testCase.name, link.Hits)
+		}
+	}
+}
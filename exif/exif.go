@@ -0,0 +1,471 @@
+package exif
+
+// EXIF data is a TIFF structure of directories (IFDs) of tagged values, embedded by
+// cameras in JPEG, PNG, WebP and TIFF images. We only need a handful of values from it,
+// so rather than take on a dependency this reads the directories defensively: any offset
+// or count outside the data is treated as the end of the data, as uploads are untrusted.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Directories of tags, as they are named in Tag.Directory.
+const (
+	DirectoryImage = "image"
+	DirectoryPhoto = "photo"
+	DirectoryGPS   = "gps"
+)
+
+// Tags read for summaries of images.
+const (
+	TagMake               = 0x010F
+	TagModel              = 0x0110
+	TagDateTime           = 0x0132
+	TagExifPointer        = 0x8769
+	TagGPSPointer         = 0x8825
+	TagExposureTime       = 0x829A
+	TagFNumber            = 0x829D
+	TagISOSpeedRatings    = 0x8827
+	TagDateTimeOriginal   = 0x9003
+	TagOffsetTimeOriginal = 0x9011
+	TagFocalLength        = 0x920A
+	TagLensModel          = 0xA434
+	TagGPSLatitudeRef     = 0x0001
+	TagGPSLatitude        = 0x0002
+	TagGPSLongitudeRef    = 0x0003
+	TagGPSLongitude       = 0x0004
+)
+
+// Types of values, which determine their size.
+const (
+	typeByte           = 1
+	typeASCII          = 2
+	typeShort          = 3
+	typeLong           = 4
+	typeRational       = 5
+	typeSignedByte     = 6
+	typeUndefined      = 7
+	typeSignedShort    = 8
+	typeSignedLong     = 9
+	typeSignedRational = 10
+	typeFloat          = 11
+	typeDouble         = 12
+)
+
+const (
+	exifDateTimeLayout      = "2006:01:02 15:04:05"
+	exifDateTimeZoneLayout  = "2006:01:02 15:04:05-07:00"
+	maxDirectorySize        = 1000
+	maxUndefinedValueLength = 64
+)
+
+// ErrNoExif is returned for images without EXIF data, or in formats which cannot carry it.
+var ErrNoExif = errors.New("Image has no EXIF data")
+
+var typeSizes = map[uint16]int{
+	typeByte: 1, typeASCII: 1, typeShort: 2, typeLong: 4, typeRational: 8, typeSignedByte: 1,
+	typeUndefined: 1, typeSignedShort: 2, typeSignedLong: 4, typeSignedRational: 8, typeFloat: 4, typeDouble: 8,
+}
+
+// Tag is a single value from the EXIF data. Numeric values are kept as numbers, with
+// rationals as numerator and denominator pairs.
+type Tag struct {
+	Directory string
+	ID        uint16
+	Type      uint16
+	Numbers   []float64 // Numeric values, in order
+	Text      string    // ASCII values, or undefined values which are printable
+	Raw       []byte    // Undefined values which are not printable
+	rationals [][2]int64
+}
+
+// Name returns the name of the tag as given by the EXIF standard, if known.
+func (t Tag) Name() string {
+	if name, found := tagNames[t.Directory][t.ID]; found {
+		return name
+	}
+
+	return fmt.Sprintf("0x%04X", t.ID)
+}
+
+// String formats the value of the tag for display.
+func (t Tag) String() string {
+	switch {
+	case t.Text != "":
+		return t.Text
+	case t.Raw != nil:
+		if len(t.Raw) > maxUndefinedValueLength {
+			return fmt.Sprintf("(%d bytes)", len(t.Raw))
+		}
+		return fmt.Sprintf("%x", t.Raw)
+	case t.rationals != nil:
+		values := []string{}
+		for _, rational := range t.rationals {
+			values = append(values, fmt.Sprintf("%d/%d", rational[0], rational[1]))
+		}
+		return strings.Join(values, ", ")
+	}
+
+	values := []string{}
+	for _, number := range t.Numbers {
+		values = append(values, fmt.Sprintf("%g", number))
+	}
+	return strings.Join(values, ", ")
+}
+
+// Data holds all tags read from the EXIF data of an image.
+type Data struct {
+	Tags []Tag
+}
+
+// Get returns the tag with the ID in the directory, if present.
+func (d *Data) Get(directory string, id uint16) (Tag, bool) {
+	for _, tag := range d.Tags {
+		if tag.Directory == directory && tag.ID == id {
+			return tag, true
+		}
+	}
+
+	return Tag{}, false
+}
+
+// Taken returns when the image was taken, preferring when it was captured over when it
+// was last written, in the time zone recorded if any. Times without a time zone are
+// taken to be UTC, as cameras often do not record one.
+func (d *Data) Taken() (time.Time, bool) {
+	for _, candidate := range []struct {
+		directory string
+		id        uint16
+	}{
+		{DirectoryPhoto, TagDateTimeOriginal},
+		{DirectoryImage, TagDateTime},
+	} {
+		tag, found := d.Get(candidate.directory, candidate.id)
+		if !found {
+			continue
+		}
+
+		if candidate.id == TagDateTimeOriginal {
+			if offset, found := d.Get(DirectoryPhoto, TagOffsetTimeOriginal); found {
+				if taken, err := time.Parse(exifDateTimeZoneLayout, tag.Text+offset.Text); err == nil {
+					return taken, true
+				}
+			}
+		}
+
+		if taken, err := time.Parse(exifDateTimeLayout, tag.Text); err == nil {
+			return taken, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// Position returns the latitude and longitude where the image was taken, in degrees.
+func (d *Data) Position() (float64, float64, bool) {
+	latitude, latitudeFound := d.coordinate(TagGPSLatitude, TagGPSLatitudeRef, "S")
+	longitude, longitudeFound := d.coordinate(TagGPSLongitude, TagGPSLongitudeRef, "W")
+	if !latitudeFound || !longitudeFound {
+		return 0, 0, false
+	}
+
+	return latitude, longitude, true
+}
+
+func (d *Data) coordinate(id, refID uint16, negativeRef string) (float64, bool) {
+	tag, found := d.Get(DirectoryGPS, id)
+	if !found || len(tag.Numbers) != 3 {
+		return 0, false
+	}
+
+	coordinate := tag.Numbers[0] + tag.Numbers[1]/60 + tag.Numbers[2]/3600
+	if math.IsNaN(coordinate) || math.IsInf(coordinate, 0) {
+		return 0, false
+	}
+	if ref, found := d.Get(DirectoryGPS, refID); found && strings.EqualFold(ref.Text, negativeRef) {
+		coordinate = -coordinate
+	}
+
+	return coordinate, true
+}
+
+// Decode reads the EXIF data embedded in a JPEG, PNG, WebP or TIFF image.
+func Decode(payload []byte) (*Data, error) {
+	tiffData, err := findTIFFData(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeTIFF(tiffData)
+}
+
+// findTIFFData finds the EXIF data of the image by the container format.
+func findTIFFData(payload []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(payload, []byte{0xFF, 0xD8}):
+		return findJPEGExif(payload)
+	case bytes.HasPrefix(payload, []byte("\x89PNG\r\n\x1a\n")):
+		return findPNGExif(payload)
+	case len(payload) >= 12 && bytes.Equal(payload[0:4], []byte("RIFF")) && bytes.Equal(payload[8:12], []byte("WEBP")):
+		return findWebPExif(payload)
+	case bytes.HasPrefix(payload, []byte("II*\x00")), bytes.HasPrefix(payload, []byte("MM\x00*")):
+		return payload, nil
+	}
+
+	return nil, ErrNoExif
+}
+
+func findJPEGExif(payload []byte) ([]byte, error) {
+	offset := 2
+	for offset+4 <= len(payload) {
+		if payload[offset] != 0xFF {
+			return nil, ErrNoExif
+		}
+		marker := payload[offset+1]
+		if marker == 0xFF {
+			// Fill byte before a marker.
+			offset++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Image data starts, after which there are no more metadata segments.
+			return nil, ErrNoExif
+		}
+
+		length := int(binary.BigEndian.Uint16(payload[offset+2 : offset+4]))
+		if length < 2 || offset+2+length > len(payload) {
+			return nil, ErrNoExif
+		}
+		segment := payload[offset+4 : offset+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+
+		offset += 2 + length
+	}
+
+	return nil, ErrNoExif
+}
+
+func findPNGExif(payload []byte) ([]byte, error) {
+	offset := 8
+	for offset+8 <= len(payload) {
+		length := int(binary.BigEndian.Uint32(payload[offset : offset+4]))
+		chunkType := string(payload[offset+4 : offset+8])
+		if length < 0 || offset+8+length > len(payload) {
+			return nil, ErrNoExif
+		}
+		if chunkType == "eXIf" {
+			return payload[offset+8 : offset+8+length], nil
+		}
+		if chunkType == "IDAT" || chunkType == "IEND" {
+			// eXIf must come before image data.
+			return nil, ErrNoExif
+		}
+
+		// Length, type, data and CRC.
+		offset += 12 + length
+	}
+
+	return nil, ErrNoExif
+}
+
+func findWebPExif(payload []byte) ([]byte, error) {
+	offset := 12
+	for offset+8 <= len(payload) {
+		chunkType := string(payload[offset : offset+4])
+		length := int(binary.LittleEndian.Uint32(payload[offset+4 : offset+8]))
+		if length < 0 || offset+8+length > len(payload) {
+			return nil, ErrNoExif
+		}
+		if chunkType == "EXIF" {
+			// Some encoders keep the JPEG segment prefix.
+			return bytes.TrimPrefix(payload[offset+8:offset+8+length], []byte("Exif\x00\x00")), nil
+		}
+
+		// Chunks are padded to an even length.
+		offset += 8 + length + length%2
+	}
+
+	return nil, ErrNoExif
+}
+
+// decodeTIFF reads the tags of the first image directory, and of the photo and GPS
+// directories it points to.
+func decodeTIFF(tiffData []byte) (*Data, error) {
+	if len(tiffData) < 8 {
+		return nil, ErrNoExif
+	}
+
+	var byteOrder binary.ByteOrder
+	switch string(tiffData[0:2]) {
+	case "II":
+		byteOrder = binary.LittleEndian
+	case "MM":
+		byteOrder = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("Invalid EXIF byte order %x", tiffData[0:2])
+	}
+	if byteOrder.Uint16(tiffData[2:4]) != 42 {
+		return nil, fmt.Errorf("Invalid EXIF header")
+	}
+
+	reader := tiffReader{data: tiffData, byteOrder: byteOrder, visited: map[uint32]bool{}}
+	data := &Data{}
+	imageTags, err := reader.readDirectory(DirectoryImage, byteOrder.Uint32(tiffData[4:8]))
+	if err != nil {
+		return nil, err
+	}
+	data.Tags = append(data.Tags, imageTags...)
+
+	for _, pointer := range []struct {
+		id        uint16
+		directory string
+	}{
+		{TagExifPointer, DirectoryPhoto},
+		{TagGPSPointer, DirectoryGPS},
+	} {
+		tag, found := data.Get(DirectoryImage, pointer.id)
+		if !found || len(tag.Numbers) != 1 {
+			continue
+		}
+
+		// Damaged sub-directories lose their own tags only.
+		subTags, err := reader.readDirectory(pointer.directory, uint32(tag.Numbers[0]))
+		if err == nil {
+			data.Tags = append(data.Tags, subTags...)
+		}
+	}
+
+	return data, nil
+}
+
+type tiffReader struct {
+	data      []byte
+	byteOrder binary.ByteOrder
+	visited   map[uint32]bool // Directories already read, as offsets may loop
+}
+
+func (r *tiffReader) readDirectory(directory string, offset uint32) ([]Tag, error) {
+	if r.visited[offset] {
+		return nil, fmt.Errorf("EXIF directory at %d is referenced more than once", offset)
+	}
+	r.visited[offset] = true
+
+	if int64(offset)+2 > int64(len(r.data)) {
+		return nil, fmt.Errorf("EXIF directory at %d is outside data", offset)
+	}
+	entries := int(r.byteOrder.Uint16(r.data[offset : offset+2]))
+	if entries > maxDirectorySize || int64(offset)+2+int64(entries)*12 > int64(len(r.data)) {
+		return nil, fmt.Errorf("EXIF directory at %d with %d entries is outside data", offset, entries)
+	}
+
+	tags := []Tag{}
+	for i := 0; i < entries; i++ {
+		entry := r.data[int(offset)+2+i*12 : int(offset)+2+(i+1)*12]
+		tag, ok := r.readTag(directory, entry)
+		if ok {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags, nil
+}
+
+// readTag reads the value of a directory entry, returning false if the value is of an
+// unknown type or outside the data.
+func (r *tiffReader) readTag(directory string, entry []byte) (Tag, bool) {
+	tag := Tag{
+		Directory: directory,
+		ID:        r.byteOrder.Uint16(entry[0:2]),
+		Type:      r.byteOrder.Uint16(entry[2:4]),
+	}
+	count := int64(r.byteOrder.Uint32(entry[4:8]))
+
+	typeSize, known := typeSizes[tag.Type]
+	if !known {
+		return tag, false
+	}
+
+	// Values of up to four bytes are stored in the entry itself.
+	var value []byte
+	size := count * int64(typeSize)
+	if size <= 4 {
+		value = entry[8 : 8+size]
+	} else {
+		valueOffset := int64(r.byteOrder.Uint32(entry[8:12]))
+		if valueOffset+size > int64(len(r.data)) {
+			return tag, false
+		}
+		value = r.data[valueOffset : valueOffset+size]
+	}
+
+	switch tag.Type {
+	case typeASCII:
+		tag.Text = strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+	case typeUndefined:
+		if isPrintable(value) {
+			tag.Text = strings.TrimRight(string(value), "\x00")
+		} else {
+			tag.Raw = value
+		}
+	default:
+		for i := 0; i < int(count); i++ {
+			element := value[i*typeSize : (i+1)*typeSize]
+			tag.Numbers = append(tag.Numbers, r.readNumber(&tag, element))
+		}
+	}
+
+	return tag, true
+}
+
+func (r *tiffReader) readNumber(tag *Tag, element []byte) float64 {
+	switch tag.Type {
+	case typeByte:
+		return float64(element[0])
+	case typeSignedByte:
+		return float64(int8(element[0]))
+	case typeShort:
+		return float64(r.byteOrder.Uint16(element))
+	case typeSignedShort:
+		return float64(int16(r.byteOrder.Uint16(element)))
+	case typeLong:
+		return float64(r.byteOrder.Uint32(element))
+	case typeSignedLong:
+		return float64(int32(r.byteOrder.Uint32(element)))
+	case typeRational:
+		numerator, denominator := int64(r.byteOrder.Uint32(element[0:4])), int64(r.byteOrder.Uint32(element[4:8]))
+		tag.rationals = append(tag.rationals, [2]int64{numerator, denominator})
+		return float64(numerator) / float64(denominator)
+	case typeSignedRational:
+		numerator, denominator := int64(int32(r.byteOrder.Uint32(element[0:4]))), int64(int32(r.byteOrder.Uint32(element[4:8])))
+		tag.rationals = append(tag.rationals, [2]int64{numerator, denominator})
+		return float64(numerator) / float64(denominator)
+	case typeFloat:
+		return float64(math.Float32frombits(r.byteOrder.Uint32(element)))
+	case typeDouble:
+		return math.Float64frombits(r.byteOrder.Uint64(element))
+	}
+
+	return 0
+}
+
+func isPrintable(value []byte) bool {
+	trimmed := bytes.TrimRight(value, "\x00")
+	if len(trimmed) == 0 {
+		return false
+	}
+	for _, b := range trimmed {
+		if b < 0x20 || b > 0x7E {
+			return false
+		}
+	}
+
+	return true
+}
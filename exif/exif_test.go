@@ -0,0 +1,260 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// testEntry is a directory entry to write, with its value already encoded.
+type testEntry struct {
+	id        uint16
+	valueType uint16
+	count     uint32
+	value     []byte
+}
+
+// buildTIFF writes EXIF data with the image, photo and GPS directories given, laying out
+// values which don't fit in entries after each directory.
+func buildTIFF(byteOrder binary.ByteOrder, imageEntries, photoEntries, gpsEntries []testEntry) []byte {
+	var data bytes.Buffer
+	if byteOrder == binary.LittleEndian {
+		data.WriteString("II")
+	} else {
+		data.WriteString("MM")
+	}
+	binary.Write(&data, byteOrder, uint16(42))
+	binary.Write(&data, byteOrder, uint32(8))
+
+	directorySize := func(entries []testEntry) int {
+		size := 2 + len(entries)*12 + 4
+		for _, entry := range entries {
+			if len(entry.value) > 4 {
+				size += len(entry.value)
+			}
+		}
+		return size
+	}
+
+	imageOffset := 8
+	photoOffset := imageOffset + directorySize(imageEntries) + 24 // Room for pointers
+	gpsOffset := photoOffset + directorySize(photoEntries)
+	if len(photoEntries) > 0 {
+		imageEntries = append(imageEntries, testEntry{TagExifPointer, typeLong, 1, encodeLong(byteOrder, uint32(photoOffset))})
+	}
+	if len(gpsEntries) > 0 {
+		imageEntries = append(imageEntries, testEntry{TagGPSPointer, typeLong, 1, encodeLong(byteOrder, uint32(gpsOffset))})
+	}
+
+	writeDirectory := func(offset int, entries []testEntry) {
+		for data.Len() < offset {
+			data.WriteByte(0)
+		}
+		binary.Write(&data, byteOrder, uint16(len(entries)))
+		valueOffset := offset + 2 + len(entries)*12 + 4
+		values := bytes.Buffer{}
+		for _, entry := range entries {
+			binary.Write(&data, byteOrder, entry.id)
+			binary.Write(&data, byteOrder, entry.valueType)
+			binary.Write(&data, byteOrder, entry.count)
+			if len(entry.value) <= 4 {
+				data.Write(append(entry.value, make([]byte, 4-len(entry.value))...))
+			} else {
+				binary.Write(&data, byteOrder, uint32(valueOffset+values.Len()))
+				values.Write(entry.value)
+			}
+		}
+		binary.Write(&data, byteOrder, uint32(0))
+		data.Write(values.Bytes())
+	}
+
+	writeDirectory(imageOffset, imageEntries)
+	writeDirectory(photoOffset, photoEntries)
+	writeDirectory(gpsOffset, gpsEntries)
+
+	return data.Bytes()
+}
+
+func encodeLong(byteOrder binary.ByteOrder, value uint32) []byte {
+	encoded := make([]byte, 4)
+	byteOrder.PutUint32(encoded, value)
+	return encoded
+}
+
+func encodeRationals(byteOrder binary.ByteOrder, rationals ...[2]uint32) []byte {
+	encoded := []byte{}
+	for _, rational := range rationals {
+		encoded = append(encoded, encodeLong(byteOrder, rational[0])...)
+		encoded = append(encoded, encodeLong(byteOrder, rational[1])...)
+	}
+	return encoded
+}
+
+func ascii(value string) testEntry {
+	return testEntry{value: append([]byte(value), 0), valueType: typeASCII, count: uint32(len(value) + 1)}
+}
+
+func withID(entry testEntry, id uint16) testEntry {
+	entry.id = id
+	return entry
+}
+
+func cameraTIFF(byteOrder binary.ByteOrder) []byte {
+	return buildTIFF(byteOrder,
+		[]testEntry{
+			withID(ascii("Canon"), TagMake),
+			withID(ascii("Canon EOS R5"), TagModel),
+			withID(ascii("2024:01:01 00:00:00"), TagDateTime),
+		},
+		[]testEntry{
+			{TagExposureTime, typeRational, 1, encodeRationals(byteOrder, [2]uint32{1, 250})},
+			{TagFNumber, typeRational, 1, encodeRationals(byteOrder, [2]uint32{28, 10})},
+			{TagISOSpeedRatings, typeShort, 1, func() []byte {
+				encoded := make([]byte, 2)
+				byteOrder.PutUint16(encoded, 400)
+				return encoded
+			}()},
+			withID(ascii("2023:06:15 14:30:05"), TagDateTimeOriginal),
+			withID(ascii("+01:00"), TagOffsetTimeOriginal),
+			withID(ascii("RF24-70mm F2.8 L IS USM"), TagLensModel),
+			{0x9000, typeUndefined, 4, []byte("0232")},
+		},
+		[]testEntry{
+			withID(ascii("N"), TagGPSLatitudeRef),
+			{TagGPSLatitude, typeRational, 3, encodeRationals(byteOrder, [2]uint32{51, 1}, [2]uint32{30, 1}, [2]uint32{0, 1})},
+			withID(ascii("W"), TagGPSLongitudeRef),
+			{TagGPSLongitude, typeRational, 3, encodeRationals(byteOrder, [2]uint32{0, 1}, [2]uint32{7, 1}, [2]uint32{3960, 100})},
+		},
+	)
+}
+
+func wrapJPEG(tiffData []byte) []byte {
+	var jpeg bytes.Buffer
+	jpeg.Write([]byte{0xFF, 0xD8})
+	// An unrelated segment before EXIF data.
+	jpeg.Write([]byte{0xFF, 0xE0, 0x00, 0x07, 'J', 'F', 'I', 'F', 0})
+	jpeg.Write([]byte{0xFF, 0xE1})
+	binary.Write(&jpeg, binary.BigEndian, uint16(2+6+len(tiffData)))
+	jpeg.WriteString("Exif\x00\x00")
+	jpeg.Write(tiffData)
+	jpeg.Write([]byte{0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9})
+	return jpeg.Bytes()
+}
+
+func TestDecodeJPEG(t *testing.T) {
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data, err := Decode(wrapJPEG(cameraTIFF(byteOrder)))
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %v EXIF: %v", byteOrder, err)
+		}
+
+		if model, found := data.Get(DirectoryImage, TagModel); !found || model.String() != "Canon EOS R5" {
+			t.Fatalf("Unexpected model %+v", model)
+		}
+		if exposure, found := data.Get(DirectoryPhoto, TagExposureTime); !found || exposure.String() != "1/250" {
+			t.Fatalf("Unexpected exposure time %+v", exposure)
+		}
+		if fNumber, found := data.Get(DirectoryPhoto, TagFNumber); !found || fNumber.Numbers[0] != 2.8 {
+			t.Fatalf("Unexpected f-number %+v", fNumber)
+		}
+		if iso, found := data.Get(DirectoryPhoto, TagISOSpeedRatings); !found || iso.String() != "400" || iso.Name() != "ISOSpeedRatings" {
+			t.Fatalf("Unexpected ISO %+v", iso)
+		}
+		if version, found := data.Get(DirectoryPhoto, 0x9000); !found || version.String() != "0232" {
+			t.Fatalf("Unexpected EXIF version %+v", version)
+		}
+
+		taken, found := data.Taken()
+		expectedTaken := time.Date(2023, 6, 15, 13, 30, 5, 0, time.UTC)
+		if !found || !taken.Equal(expectedTaken) {
+			t.Fatalf("Expected taken time %v, got %v", expectedTaken, taken)
+		}
+
+		latitude, longitude, found := data.Position()
+		if !found || math.Abs(latitude-51.5) > 1e-9 || math.Abs(longitude+0.1276667) > 1e-6 {
+			t.Fatalf("Unexpected position %f, %f", latitude, longitude)
+		}
+	}
+}
+
+func TestDecodeContainers(t *testing.T) {
+	tiffData := cameraTIFF(binary.LittleEndian)
+
+	var png bytes.Buffer
+	png.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&png, binary.BigEndian, uint32(13))
+	png.WriteString("IHDR")
+	png.Write(make([]byte, 13+4))
+	binary.Write(&png, binary.BigEndian, uint32(len(tiffData)))
+	png.WriteString("eXIf")
+	png.Write(tiffData)
+	png.Write(make([]byte, 4))
+
+	var webp bytes.Buffer
+	webp.WriteString("RIFF")
+	binary.Write(&webp, binary.LittleEndian, uint32(0))
+	webp.WriteString("WEBPVP8X")
+	binary.Write(&webp, binary.LittleEndian, uint32(10))
+	webp.Write(make([]byte, 10))
+	webp.WriteString("EXIF")
+	binary.Write(&webp, binary.LittleEndian, uint32(len(tiffData)))
+	webp.Write(tiffData)
+
+	for name, payload := range map[string][]byte{
+		"png":  png.Bytes(),
+		"webp": webp.Bytes(),
+		"tiff": tiffData,
+	} {
+		data, err := Decode(payload)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding EXIF in %s: %v", name, err)
+		}
+		if make, found := data.Get(DirectoryImage, TagMake); !found || make.String() != "Canon" {
+			t.Fatalf("Unexpected make %+v in %s", make, name)
+		}
+	}
+}
+
+func TestDecodeWithoutExif(t *testing.T) {
+	for name, payload := range map[string][]byte{
+		"empty":          {},
+		"gif":            []byte("GIF89a"),
+		"jpeg":           {0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9},
+		"png":            []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x00IEND\x00\x00\x00\x00"),
+		"truncated jpeg": {0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 'E'},
+	} {
+		if _, err := Decode(payload); err != ErrNoExif {
+			t.Fatalf("Expected no EXIF in %s, got %v", name, err)
+		}
+	}
+}
+
+func TestDecodeDamagedData(t *testing.T) {
+	tiffData := cameraTIFF(binary.BigEndian)
+
+	// Truncating anywhere must not read outside the data.
+	for length := 0; length < len(tiffData); length++ {
+		Decode(wrapJPEG(tiffData[:length]))
+	}
+
+	// A directory pointing back to itself is not read again.
+	looping := buildTIFF(binary.LittleEndian, []testEntry{
+		{TagExifPointer, typeLong, 1, encodeLong(binary.LittleEndian, 8)},
+	}, nil, nil)
+	data, err := Decode(looping)
+	if err != nil || len(data.Tags) != 1 {
+		t.Fatalf("Expected looping directory to be read once, got %+v, %v", data, err)
+	}
+
+	// Values claiming to be larger than the data are skipped.
+	oversized := buildTIFF(binary.LittleEndian, []testEntry{
+		{TagMake, typeASCII, 0xFFFFFFFF, encodeLong(binary.LittleEndian, 8)},
+		withID(ascii("Model"), TagModel),
+	}, nil, nil)
+	data, err = Decode(oversized)
+	if err != nil || len(data.Tags) != 1 || data.Tags[0].ID != TagModel {
+		t.Fatalf("Expected oversized value to be skipped, got %+v, %v", data, err)
+	}
+}
@@ -1,12 +1,13 @@
 module github.com/chongyangshi/yronwood
 
-go 1.20
+go 1.23.0
 
 require (
 	github.com/monzo/slog v0.0.0-20211123154010-52a5ddb2ba55
 	github.com/monzo/terrors v0.0.0-20230309194234-a3df3e6f2be0
 	github.com/monzo/typhon v1.1.8
-	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	golang.org/x/crypto v0.36.0
+	golang.org/x/image v0.25.0
 )
 
 require (
@@ -0,0 +1,209 @@
+package hotlink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+// Images embedded in pages elsewhere are fetched by browsers with the page as referrer,
+// so each access type can have a rule allowing only pages on some hosts to embed them.
+// Requests from elsewhere are denied or served a placeholder image in place of the one
+// requested. Referrers are easily left out or faked, so this stops casual hotlinking
+// rather than determined copying.
+
+const (
+	ActionDeny        = "deny"
+	ActionPlaceholder = "placeholder"
+
+	placeholderSize = 64
+)
+
+var (
+	rules = map[string]Rule{}
+
+	placeholder            []byte
+	placeholderContentType string
+
+	statsMutex sync.Mutex
+	stats      Stats
+)
+
+func init() {
+	// Rules are configured as accesstype:action:hosts[:noempty], separated by "|".
+	for _, rule := range strings.Split(config.ConfigHotlinkRules, "|") {
+		ruleComponents := strings.Split(rule, ":")
+		if len(ruleComponents) < 3 {
+			continue
+		}
+
+		switch ruleComponents[1] {
+		case ActionDeny, ActionPlaceholder:
+		default:
+			continue
+		}
+
+		allowedHosts := []string{}
+		for _, host := range strings.Split(ruleComponents[2], ",") {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				allowedHosts = append(allowedHosts, host)
+			}
+		}
+
+		rules[ruleComponents[0]] = Rule{
+			Action:       ruleComponents[1],
+			AllowedHosts: allowedHosts,
+			AllowEmpty:   len(ruleComponents) < 4 || ruleComponents[3] != "noempty",
+		}
+	}
+}
+
+// Rule describes which requests may fetch images of an access type.
+type Rule struct {
+	Action       string   // What blocked requests are served
+	AllowedHosts []string // Hosts of pages allowed to embed images, with *. allowing subdomains
+	AllowEmpty   bool     // Whether requests without a referrer are allowed, such as when visited directly
+}
+
+// Stats counts requests blocked since the service started.
+type Stats struct {
+	Denied       int64
+	Placeholders int64
+}
+
+// LoadPlaceholder prepares the configured placeholder image to serve in place of images
+// hotlinked, or a plain grey image if none is configured.
+func LoadPlaceholder() error {
+	if config.ConfigHotlinkPlaceholder != "" {
+		file, err := ioutil.ReadFile(config.ConfigHotlinkPlaceholder)
+		if err != nil {
+			return fmt.Errorf("Could not read hotlink placeholder %s: %v", config.ConfigHotlinkPlaceholder, err)
+		}
+		placeholder, placeholderContentType = file, http.DetectContentType(file)
+		return nil
+	}
+
+	grey := image.NewRGBA(image.Rect(0, 0, placeholderSize, placeholderSize))
+	draw.Draw(grey, grey.Bounds(), image.NewUniform(color.RGBA{R: 0xCC, G: 0xCC, B: 0xCC, A: 0xFF}), image.Point{}, draw.Src)
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, grey); err != nil {
+		return fmt.Errorf("Could not encode hotlink placeholder: %v", err)
+	}
+	placeholder, placeholderContentType = encoded.Bytes(), "image/png"
+
+	return nil
+}
+
+// Placeholder returns the image served in place of those hotlinked, and its content type.
+func Placeholder() ([]byte, string) {
+	return placeholder, placeholderContentType
+}
+
+// Applies returns whether requests for images of the access type are checked, so that
+// responses to them depend on where they were made from.
+func Applies(accessType string) bool {
+	_, found := rules[accessType]
+	return found
+}
+
+// Check returns whether the request for an image of the access type is allowed by the
+// rule for the access type, and if not, the action to take. Pages on the host serving
+// images are always allowed, as are requests for images of access types without a rule.
+// Blocked requests are logged and counted.
+func Check(ctx context.Context, accessType string, req *http.Request) (bool, string) {
+	rule, found := rules[accessType]
+	if !found {
+		return true, ""
+	}
+
+	referrer := referringHost(req)
+	if referrer == "" && rule.AllowEmpty {
+		return true, ""
+	}
+	if referrer != "" && (referrer == requestHost(req) || hostAllowed(referrer, rule.AllowedHosts)) {
+		return true, ""
+	}
+
+	slog.Info(ctx, "Blocked request for %s from referrer %q with action %s", req.URL.Path, referrer, rule.Action)
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	switch rule.Action {
+	case ActionDeny:
+		stats.Denied++
+	case ActionPlaceholder:
+		stats.Placeholders++
+	}
+
+	return false, rule.Action
+}
+
+// GetStats returns the counts of requests blocked.
+func GetStats() Stats {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	return stats
+}
+
+// referringHost returns the host of the page the request was made from, preferring the
+// Origin header to the Referer header as it is sent by more requests made by scripts.
+// Nothing is returned if neither is sent, or if the origin is opaque.
+func referringHost(req *http.Request) string {
+	for _, header := range []string{"Origin", "Referer"} {
+		value := req.Header.Get(header)
+		if value == "" || value == "null" {
+			continue
+		}
+
+		parsed, err := url.Parse(value)
+		if err != nil || parsed.Hostname() == "" {
+			// Malformed referrers are not from any host allowed.
+			return value
+		}
+		return strings.ToLower(parsed.Hostname())
+	}
+
+	return ""
+}
+
+func requestHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+
+	return strings.ToLower(host)
+}
+
+// hostAllowed returns whether the host is one of those allowed, or a subdomain of one
+// allowed with a *. prefix.
+func hostAllowed(host string, allowedHosts []string) bool {
+	for _, allowedHost := range allowedHosts {
+		if domain, wildcard := strings.CutPrefix(allowedHost, "*."); wildcard {
+			if strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+			continue
+		}
+		if host == allowedHost {
+			return true
+		}
+	}
+
+	return false
+}
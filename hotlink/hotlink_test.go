@@ -0,0 +1,63 @@
+package hotlink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	defer func(configured map[string]Rule) { rules = configured }(rules)
+	rules = map[string]Rule{
+		"public": {Action: ActionPlaceholder, AllowedHosts: []string{"example.com", "*.example.org"}, AllowEmpty: true},
+		"big":    {Action: ActionDeny, AllowedHosts: []string{"example.com"}},
+	}
+
+	for _, testCase := range []struct {
+		accessType string
+		headers    map[string]string
+		allowed    bool
+		action     string
+	}{
+		{"public", map[string]string{}, true, ""},
+		{"public", map[string]string{"Referer": "https://example.com/page"}, true, ""},
+		{"public", map[string]string{"Referer": "https://EXAMPLE.com:8443/page"}, true, ""},
+		{"public", map[string]string{"Referer": "https://images.example.org/"}, true, ""},
+		{"public", map[string]string{"Referer": "https://example.org/"}, false, ActionPlaceholder},
+		{"public", map[string]string{"Referer": "https://notexample.com/"}, false, ActionPlaceholder},
+		{"public", map[string]string{"Referer": "https://example.com.forum.net/"}, false, ActionPlaceholder},
+		{"public", map[string]string{"Origin": "https://forum.net", "Referer": "https://example.com/"}, false, ActionPlaceholder},
+		{"public", map[string]string{"Origin": "null"}, true, ""},
+		{"public", map[string]string{"Referer": "https://images.local/gallery"}, true, ""},
+		{"public", map[string]string{"Referer": "not a url"}, false, ActionPlaceholder},
+		{"big", map[string]string{}, false, ActionDeny},
+		{"big", map[string]string{"Origin": "https://example.com"}, true, ""},
+		{"private", map[string]string{"Referer": "https://forum.net/"}, true, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "https://images.local/uploads/"+testCase.accessType+"/test.png", nil)
+		for header, value := range testCase.headers {
+			req.Header.Set(header, value)
+		}
+
+		allowed, action := Check(context.Background(), testCase.accessType, req)
+		if allowed != testCase.allowed || action != testCase.action {
+			t.Fatalf("Expected %s request with %v to be allowed %t with action %q, got %t with %q", testCase.accessType, testCase.headers, testCase.allowed, testCase.action, allowed, action)
+		}
+	}
+
+	if blocked := GetStats(); blocked.Placeholders != 5 || blocked.Denied != 1 {
+		t.Fatalf("Expected 5 placeholders and 1 denial to be counted, got %+v", blocked)
+	}
+}
+
+func TestLoadPlaceholder(t *testing.T) {
+	if err := LoadPlaceholder(); err != nil {
+		t.Fatal(err)
+	}
+
+	image, contentType := Placeholder()
+	if len(image) == 0 || contentType != "image/png" {
+		t.Fatalf("Expected default placeholder to be a PNG image, got %d bytes of %s", len(image), contentType)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -13,10 +14,30 @@ import (
 
 	"github.com/chongyangshi/yronwood/config"
 	"github.com/chongyangshi/yronwood/endpoints"
+	"github.com/chongyangshi/yronwood/hotlink"
+	"github.com/chongyangshi/yronwood/thumbnail"
 )
 
 func main() {
 	initContext := context.Background()
+	workerContext, stopWorkers := context.WithCancel(initContext)
+	defer stopWorkers()
+	if err := thumbnail.LoadWatermark(); err != nil {
+		panic(err)
+	}
+	if err := hotlink.LoadPlaceholder(); err != nil {
+		panic(err)
+	}
+	thumbnail.StartWorkers(workerContext)
+	endpoints.StartImageDetailsWorker(workerContext)
+	if err := thumbnail.StartCacheManager(workerContext); err != nil {
+		panic(err)
+	}
+	endpoints.RemoveOrphanedOriginals(initContext)
+	if backfill, _ := strconv.ParseBool(config.ConfigThumbnailBackfillOnStartup); backfill {
+		endpoints.BackfillThumbnails(workerContext)
+	}
+
 	svc := endpoints.Service()
 	srv, err := typhon.Listen(svc, config.ConfigListenAddr)
 	if err != nil {
@@ -0,0 +1,108 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/store"
+)
+
+var records = store.New(config.ConfigStorageDirectoryMetadata)
+
+// Record holds what we know about a stored image beyond the file itself, kept alongside
+// it so that it doesn't need to be worked out from the image on every listing.
+type Record struct {
+	// Details of the stored file, recorded when it is uploaded or changed. Dimensions are
+	// zero for images without a fixed size, such as SVG.
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+
+	// Which revision of details the record holds, so that details added since the image
+	// was uploaded can be filled in.
+	DetailsVersion int `json:"details_version,omitempty"`
+
+	// Summary of the EXIF data of the image, if it has any.
+	Exif *Exif `json:"exif,omitempty"`
+
+	// Name the image is saved as when downloaded, as given when uploaded.
+	DisplayName string `json:"display_name,omitempty"`
+
+	// Placeholders for clients to show while the image loads, made from its thumbnail.
+	BlurHash       string `json:"blur_hash,omitempty"`
+	DominantColour string `json:"dominant_colour,omitempty"` // As #rrggbb
+
+	// Set when placeholders could not be made from the image, so that it is not queued for
+	// them again until its content changes.
+	PlaceholderFailed bool `json:"placeholder_failed,omitempty"`
+}
+
+// Exif summarises how a photo was taken. Values missing from the EXIF data are left
+// empty, and the position is only kept for private images.
+type Exif struct {
+	Taken        *time.Time `json:"taken,omitempty"`
+	CameraMake   string     `json:"camera_make,omitempty"`
+	CameraModel  string     `json:"camera_model,omitempty"`
+	LensModel    string     `json:"lens_model,omitempty"`
+	ExposureTime string     `json:"exposure_time,omitempty"` // As a fraction of a second, such as 1/125
+	FNumber      float64    `json:"f_number,omitempty"`
+	ISO          int        `json:"iso,omitempty"`
+	FocalLength  float64    `json:"focal_length,omitempty"` // In millimetres
+	Latitude     *float64   `json:"latitude,omitempty"`
+	Longitude    *float64   `json:"longitude,omitempty"`
+}
+
+// Get returns the record of the image, which is empty if nothing is known about it yet.
+func Get(ctx context.Context, fileName, accessType string) (Record, error) {
+	record := Record{}
+	if _, err := records.Get(recordKey(fileName, accessType), &record); err != nil {
+		slog.Error(ctx, "Could not read metadata of %s of access type %s: %v", fileName, accessType, err)
+		return Record{}, err
+	}
+
+	return record, nil
+}
+
+// Update modifies the record of the image with update, creating it if needed.
+func Update(ctx context.Context, fileName, accessType string, update func(*Record)) error {
+	record := Record{}
+	err := records.Update(recordKey(fileName, accessType), &record, func() error {
+		update(&record)
+		return nil
+	})
+	if err != nil {
+		slog.Error(ctx, "Could not update metadata of %s of access type %s: %v", fileName, accessType, err)
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes the record of the image, for when the image itself is deleted.
+func Delete(ctx context.Context, fileName, accessType string) error {
+	if err := records.Delete(recordKey(fileName, accessType)); err != nil {
+		slog.Error(ctx, "Could not delete metadata of %s of access type %s: %v", fileName, accessType, err)
+		return err
+	}
+
+	return nil
+}
+
+// UseStore keeps records in the store given rather than in the configured directory, and
+// returns the store they were kept in, so that tests of packages describing images can
+// keep records in a temporary directory.
+func UseStore(s *store.Store) *store.Store {
+	previous := records
+	records = s
+	return previous
+}
+
+func recordKey(fileName, accessType string) string {
+	return fmt.Sprintf("%s/%s", accessType, fileName)
+}
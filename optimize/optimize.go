@@ -0,0 +1,351 @@
+package optimize
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+// Uploads are often larger than they need to be, such as screenshots saved as PNG with
+// little compression, or photos exported as JPEG at full quality. Each access type can
+// have a policy of re-encoding such images when they are uploaded, which is only done if
+// it saves enough space to be worth it. Metadata of images such as EXIF data and colour
+// profiles is carried over, as the encoders would otherwise drop it.
+
+const (
+	ModeNone     = "none"     // Images are stored as uploaded
+	ModeLossless = "lossless" // PNG images are compressed again, without changing any pixels
+	ModeLossy    = "lossy"    // As lossless, with JPEG images also encoded again at the configured quality
+)
+
+var errInvalidImage = errors.New("Image is not valid")
+
+var (
+	policies       = map[string]Policy{}
+	jpegQuality    = 85
+	pngCompression = png.BestCompression
+	minSavings     = 0.1
+
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+	// Chunks of PNG images describing how to display them, which may precede image data.
+	carriedPNGChunks = map[string]bool{"iCCP": true, "sRGB": true, "gAMA": true, "cHRM": true, "pHYs": true, "eXIf": true}
+)
+
+func init() {
+	// Policies are configured as accesstype:mode[:keep], separated by "|".
+	for _, policy := range strings.Split(config.ConfigOptimizePolicies, "|") {
+		policyComponents := strings.Split(policy, ":")
+		if len(policyComponents) < 2 {
+			continue
+		}
+
+		switch policyComponents[1] {
+		case ModeNone, ModeLossless, ModeLossy:
+		default:
+			continue
+		}
+
+		policies[policyComponents[0]] = Policy{
+			Mode:         policyComponents[1],
+			KeepOriginal: len(policyComponents) > 2 && policyComponents[2] == "keep",
+		}
+	}
+
+	jpegQualityParsed, err := strconv.Atoi(config.ConfigOptimizeJPEGQuality)
+	if err == nil && jpegQualityParsed >= 1 && jpegQualityParsed <= 100 {
+		jpegQuality = jpegQualityParsed
+	}
+
+	switch config.ConfigOptimizePNGCompression {
+	case "default":
+		pngCompression = png.DefaultCompression
+	case "speed":
+		pngCompression = png.BestSpeed
+	}
+
+	minSavingsParsed, err := strconv.ParseFloat(config.ConfigOptimizeMinSavings, 64)
+	if err == nil && minSavingsParsed >= 0 && minSavingsParsed < 1 {
+		minSavings = minSavingsParsed
+	}
+}
+
+// Policy describes how images uploaded with an access type are optimized.
+type Policy struct {
+	Mode         string
+	KeepOriginal bool // Whether the image as uploaded is kept when optimized
+}
+
+// PolicyForAccessType returns the policy of optimizing images of the access type, which
+// is to store them as uploaded unless configured otherwise.
+func PolicyForAccessType(accessType string) Policy {
+	if policy, found := policies[accessType]; found {
+		return policy
+	}
+
+	return Policy{Mode: ModeNone}
+}
+
+// Optimize returns the image encoded again according to the mode, and whether it was.
+// The image is returned as it is if it cannot be optimized in the mode, or if doing so
+// does not save enough space.
+func Optimize(ctx context.Context, fileName string, payload []byte, mode string) ([]byte, bool) {
+	var optimized []byte
+	var err error
+	switch strings.ToLower(strings.TrimPrefix(path.Ext(fileName), ".")) {
+	case "png":
+		if mode != ModeLossless && mode != ModeLossy {
+			return payload, false
+		}
+		optimized, err = optimizePNG(payload)
+	case "jpg", "jpeg":
+		if mode != ModeLossy {
+			return payload, false
+		}
+		optimized, err = optimizeJPEG(payload)
+	default:
+		return payload, false
+	}
+
+	if err != nil {
+		slog.Warn(ctx, "Could not optimize image %s, storing it as uploaded: %v", fileName, err)
+		return payload, false
+	}
+	if optimized == nil || float64(len(optimized)) > float64(len(payload))*(1-minSavings) {
+		return payload, false
+	}
+
+	return optimized, true
+}
+
+// optimizePNG compresses the image again at the configured level. Animated PNGs are left
+// alone, as only their first frame would be kept.
+func optimizePNG(payload []byte) ([]byte, error) {
+	chunks, err := readPNGChunks(payload)
+	if err != nil {
+		return nil, err
+	}
+	carriedChunks := []byte{}
+	for _, chunk := range chunks {
+		if chunk.chunkType == "acTL" {
+			return nil, nil
+		}
+		if carriedPNGChunks[chunk.chunkType] {
+			carriedChunks = append(carriedChunks, chunk.raw...)
+		}
+	}
+
+	img, err := png.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: pngCompression}
+	if err := encoder.Encode(&encoded, img); err != nil {
+		return nil, err
+	}
+
+	// Chunks carried over follow the header chunk, which is first.
+	headerEnd := len(pngSignature) + 4 + 4 + 13 + 4
+	optimized := append([]byte{}, encoded.Bytes()[:headerEnd]...)
+	optimized = append(optimized, carriedChunks...)
+	optimized = append(optimized, encoded.Bytes()[headerEnd:]...)
+
+	return optimized, nil
+}
+
+// optimizeJPEG encodes the image again at the configured quality. Images in CMYK are left
+// alone, as their colours are not reliably kept by converting them.
+func optimizeJPEG(payload []byte) ([]byte, error) {
+	segments, err := readJPEGMetadataSegments(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if _, cmyk := img.(*image.CMYK); cmyk {
+		return nil, nil
+	}
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+
+	// Segments carried over follow the start of image marker.
+	optimized := append([]byte{}, encoded.Bytes()[:2]...)
+	for _, segment := range segments {
+		optimized = append(optimized, segment...)
+	}
+	optimized = append(optimized, encoded.Bytes()[2:]...)
+
+	return optimized, nil
+}
+
+type pngChunk struct {
+	chunkType string
+	raw       []byte // The whole chunk, including its length, type and CRC
+}
+
+// readPNGChunks splits the image into its chunks, checking each is complete and intact.
+func readPNGChunks(payload []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(payload, pngSignature) {
+		return nil, errInvalidImage
+	}
+
+	chunks := []pngChunk{}
+	for offset := len(pngSignature); offset < len(payload); {
+		if offset+8 > len(payload) {
+			return nil, errInvalidImage
+		}
+		length := int64(binary.BigEndian.Uint32(payload[offset : offset+4]))
+		end := int64(offset) + 12 + length
+		if end > int64(len(payload)) {
+			return nil, errInvalidImage
+		}
+
+		raw := payload[offset:end]
+		if crc32.ChecksumIEEE(raw[4:len(raw)-4]) != binary.BigEndian.Uint32(raw[len(raw)-4:]) {
+			return nil, errInvalidImage
+		}
+
+		chunks = append(chunks, pngChunk{chunkType: string(raw[4:8]), raw: raw})
+		offset = int(end)
+	}
+
+	return chunks, nil
+}
+
+// readJPEGMetadataSegments returns the application segments of the image holding its
+// EXIF data, XMP data and colour profile.
+func readJPEGMetadataSegments(payload []byte) ([][]byte, error) {
+	if len(payload) < 2 || payload[0] != 0xFF || payload[1] != 0xD8 {
+		return nil, errInvalidImage
+	}
+
+	segments := [][]byte{}
+	for offset := 2; offset+4 <= len(payload); {
+		if payload[offset] != 0xFF {
+			return nil, errInvalidImage
+		}
+		marker := payload[offset+1]
+		if marker == 0xFF {
+			// Padding before a marker.
+			offset++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Metadata precedes the image data.
+			break
+		}
+
+		end := offset + 2 + int(binary.BigEndian.Uint16(payload[offset+2:offset+4]))
+		if end > len(payload) {
+			return nil, errInvalidImage
+		}
+		if marker == 0xE1 || marker == 0xE2 {
+			segments = append(segments, payload[offset:end])
+		}
+		offset = end
+	}
+
+	return segments, nil
+}
+
+func originalsDirectory(accessType string) string {
+	return path.Join(config.ConfigStorageDirectoryOriginals, accessType)
+}
+
+// KeepOriginal stores the image as uploaded, for images stored optimized.
+func KeepOriginal(ctx context.Context, fileName, accessType string, payload []byte) error {
+	originalsPath := originalsDirectory(accessType)
+	if err := os.MkdirAll(originalsPath, 0755); err != nil {
+		slog.Error(ctx, "Could not create originals directory %s: %v", originalsPath, err)
+		return err
+	}
+
+	originalPath := path.Join(originalsPath, fileName)
+	if err := ioutil.WriteFile(originalPath, payload, 0644); err != nil {
+		slog.Error(ctx, "Could not keep original of %s: %v", fileName, err)
+		return err
+	}
+
+	return nil
+}
+
+// RemoveOriginal removes the image as uploaded if it was kept, for when the image stored
+// changes or is deleted.
+func RemoveOriginal(ctx context.Context, fileName, accessType string) error {
+	originalPath := path.Join(originalsDirectory(accessType), fileName)
+	if err := os.Remove(originalPath); err != nil && !os.IsNotExist(err) {
+		slog.Error(ctx, "Could not remove original of %s: %v", fileName, err)
+		return err
+	}
+
+	return nil
+}
+
+// OpenOriginal opens the image as uploaded if it was kept, or returns nil if it was not.
+// The caller is responsible for closing the file. The fileName MUST be validated before
+// passing in.
+func OpenOriginal(ctx context.Context, fileName, accessType string) *os.File {
+	file, err := os.Open(path.Join(originalsDirectory(accessType), fileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error(ctx, "Could not open original of %s: %v", fileName, err)
+		}
+		return nil
+	}
+
+	return file
+}
+
+// RemoveOrphanedOriginals removes originals kept of images no longer stored in the storage
+// paths of each access type, such as when storing an optimized upload failed after its
+// original was kept. Returns the number of originals removed.
+func RemoveOrphanedOriginals(ctx context.Context, storagePaths map[string]string) (int, error) {
+	removed := 0
+	for accessType, storagePath := range storagePaths {
+		originals, err := ioutil.ReadDir(originalsDirectory(accessType))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			slog.Error(ctx, "Could not list originals of access type %s: %v", accessType, err)
+			return removed, err
+		}
+
+		for _, original := range originals {
+			if original.IsDir() {
+				continue
+			}
+			if _, err := os.Lstat(path.Join(storagePath, original.Name())); !os.IsNotExist(err) {
+				continue
+			}
+			if err := RemoveOriginal(ctx, original.Name(), accessType); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+
+	return removed, nil
+}
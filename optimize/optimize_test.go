@@ -0,0 +1,179 @@
+package optimize
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+// testImage returns an image with smooth gradients, which compresses well.
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x + y), A: 255})
+		}
+	}
+
+	return img
+}
+
+func testPNGChunk(chunkType string, data []byte) []byte {
+	chunk := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// insertPNGChunk adds the chunk after the header chunk of the image.
+func insertPNGChunk(payload, chunk []byte) []byte {
+	headerEnd := len(pngSignature) + 4 + 4 + 13 + 4
+	inserted := append([]byte{}, payload[:headerEnd]...)
+	inserted = append(inserted, chunk...)
+	return append(inserted, payload[headerEnd:]...)
+}
+
+func testPNG(t *testing.T, compression png.CompressionLevel) []byte {
+	var encoded bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: compression}
+	if err := encoder.Encode(&encoded, testImage(256, 256)); err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded.Bytes()
+}
+
+func testJPEG(t *testing.T, quality int) []byte {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(256, 256), &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded.Bytes()
+}
+
+func TestOptimizePNGKeepsMetadata(t *testing.T) {
+	exifChunk := testPNGChunk("eXIf", []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00"))
+	payload := insertPNGChunk(testPNG(t, png.NoCompression), exifChunk)
+
+	optimized, ok := Optimize(context.Background(), "test.png", payload, ModeLossless)
+	if !ok {
+		t.Fatalf("Expected uncompressed PNG of %d bytes to be optimized", len(payload))
+	}
+	if len(optimized) >= len(payload) {
+		t.Fatalf("Expected optimized PNG to be smaller than %d bytes, got %d", len(payload), len(optimized))
+	}
+	if !bytes.Contains(optimized, exifChunk) {
+		t.Fatal("Expected optimized PNG to keep its EXIF chunk")
+	}
+
+	img, err := png.Decode(bytes.NewReader(optimized))
+	if err != nil {
+		t.Fatalf("Could not decode optimized PNG: %v", err)
+	}
+	original, _ := png.Decode(bytes.NewReader(payload))
+	for _, point := range []image.Point{{0, 0}, {100, 200}, {255, 255}} {
+		if img.At(point.X, point.Y) != original.At(point.X, point.Y) {
+			t.Fatalf("Expected pixel at %v to be unchanged, got %v rather than %v", point, img.At(point.X, point.Y), original.At(point.X, point.Y))
+		}
+	}
+}
+
+func TestOptimizeJPEGKeepsMetadata(t *testing.T) {
+	exifSegment := []byte("\xff\xe1\x00\x10Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08")
+	encoded := testJPEG(t, 100)
+	payload := append(append(append([]byte{}, encoded[:2]...), exifSegment...), encoded[2:]...)
+
+	optimized, ok := Optimize(context.Background(), "test.jpg", payload, ModeLossy)
+	if !ok {
+		t.Fatalf("Expected JPEG of %d bytes at full quality to be optimized", len(payload))
+	}
+	if !bytes.HasPrefix(optimized, append([]byte{0xFF, 0xD8}, exifSegment...)) {
+		t.Fatal("Expected optimized JPEG to keep its EXIF segment")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(optimized)); err != nil {
+		t.Fatalf("Could not decode optimized JPEG: %v", err)
+	}
+}
+
+func TestOptimizeSkipped(t *testing.T) {
+	ctx := context.Background()
+	uncompressedPNG := testPNG(t, png.NoCompression)
+	animatedPNG := insertPNGChunk(uncompressedPNG, testPNGChunk("acTL", []byte{0, 0, 0, 1, 0, 0, 0, 0}))
+	corruptedPNG := append([]byte{}, uncompressedPNG...)
+	corruptedPNG[len(pngSignature)+8] ^= 0xFF
+
+	for _, testCase := range []struct {
+		description string
+		fileName    string
+		payload     []byte
+		mode        string
+	}{
+		{"JPEG in lossless mode", "test.jpg", testJPEG(t, 100), ModeLossless},
+		{"PNG with no policy", "test.png", uncompressedPNG, ModeNone},
+		{"animated PNG", "test.png", animatedPNG, ModeLossy},
+		{"corrupted PNG", "test.png", corruptedPNG, ModeLossy},
+		{"PNG already compressed", "test.png", testPNG(t, png.BestCompression), ModeLossy},
+		{"JPEG already at configured quality", "test.jpeg", testJPEG(t, jpegQuality), ModeLossy},
+		{"GIF", "test.gif", []byte("GIF89a"), ModeLossy},
+	} {
+		optimized, ok := Optimize(ctx, testCase.fileName, testCase.payload, testCase.mode)
+		if ok || !bytes.Equal(optimized, testCase.payload) {
+			t.Fatalf("Expected %s to be left as uploaded", testCase.description)
+		}
+	}
+}
+
+func TestPolicyForAccessType(t *testing.T) {
+	defer func(configured map[string]Policy) { policies = configured }(policies)
+	policies = map[string]Policy{"public": {Mode: ModeLossy, KeepOriginal: true}}
+
+	if policy := PolicyForAccessType("public"); policy.Mode != ModeLossy || !policy.KeepOriginal {
+		t.Fatalf("Expected configured policy for public images, got %+v", policy)
+	}
+	if policy := PolicyForAccessType("private"); policy.Mode != ModeNone || policy.KeepOriginal {
+		t.Fatalf("Expected images to be stored as uploaded without a policy, got %+v", policy)
+	}
+}
+
+func TestRemoveOrphanedOriginals(t *testing.T) {
+	defer func(configured string) { config.ConfigStorageDirectoryOriginals = configured }(config.ConfigStorageDirectoryOriginals)
+	config.ConfigStorageDirectoryOriginals = t.TempDir()
+	storagePath := t.TempDir()
+	ctx := context.Background()
+
+	for _, fileName := range []string{"stored.png", "orphan.png"} {
+		if err := KeepOriginal(ctx, fileName, "public", []byte(fileName)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path.Join(storagePath, "stored.png"), []byte("optimized"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := RemoveOrphanedOriginals(ctx, map[string]string{"public": storagePath, "private": t.TempDir()})
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected one original to be removed, got %d, %v", removed, err)
+	}
+
+	for fileName, kept := range map[string]bool{"stored.png": true, "orphan.png": false} {
+		original := OpenOriginal(ctx, fileName, "public")
+		if (original != nil) != kept {
+			t.Fatalf("Expected original of %s to be kept %t", fileName, kept)
+		}
+		if original != nil {
+			original.Close()
+		}
+	}
+}
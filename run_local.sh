@@ -10,6 +10,12 @@ mkdir -p /tmp/yronwood_public
 mkdir -p /tmp/yronwood_unlisted
 mkdir -p /tmp/yronwood_private
 mkdir -p /tmp/yronwood_thumbnail
+mkdir -p /tmp/yronwood_versions
+mkdir -p /tmp/yronwood_rendition
+mkdir -p /tmp/yronwood_metadata
+mkdir -p /tmp/yronwood_originals
+mkdir -p /tmp/yronwood_shares
+mkdir -p /tmp/yronwood_slugs
 
 export YRONWOOD_LISTEN_ADDR="127.0.0.1:18080"
 export YRONWOOD_INDEX_REDIRECT="https://google.co.uk"
@@ -17,6 +23,12 @@ export YRONWOOD_STORAGE_DIRECTORY_PUBLIC="/tmp/yronwood_public"
 export YRONWOOD_STORAGE_DIRECTORY_UNLISTED="/tmp/yronwood_unlisted"
 export YRONWOOD_STORAGE_DIRECTORY_PRIVATE="/tmp/yronwood_private"
 export YRONWOOD_STORAGE_DIRECTORY_THUMBNAIL="/tmp/yronwood_thumbnail"
+export YRONWOOD_STORAGE_DIRECTORY_VERSIONS="/tmp/yronwood_versions"
+export YRONWOOD_STORAGE_DIRECTORY_RENDITION="/tmp/yronwood_rendition"
+export YRONWOOD_STORAGE_DIRECTORY_METADATA="/tmp/yronwood_metadata"
+export YRONWOOD_STORAGE_DIRECTORY_ORIGINALS="/tmp/yronwood_originals"
+export YRONWOOD_STORAGE_DIRECTORY_SHARES="/tmp/yronwood_shares"
+export YRONWOOD_STORAGE_DIRECTORY_SLUGS="/tmp/yronwood_slugs"
 export YRONWOOD_AUTHENTICATION_SIGHNING_KEY="${LOCAL_SIGNING_KEY}"
 export YRONWOOD_AUTHENTICATION_BASIC_SECRET="e5b84d4fe648cb166e6b14c87b55852b51b94aedd865f0c39ceac1c2b8edb367"
 export YRONWOOD_AUTHENTICATION_BASIC_SALT="local-salt" # ^ = $(echo -n "local-secret:local-salt" | openssl dgst -sha256 -hex)
@@ -0,0 +1,302 @@
+package share
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/store"
+)
+
+// Images can be shared through links which admins create, list and revoke, rather than
+// through image tokens, which are valid until they expire once signed. Links are kept in
+// a store and checked against it whenever used, so that they can be revoked and limited
+// to a number of views. Links protected by a password are locked for a while after too
+// many wrong passwords are tried, so that they cannot be guessed at speed.
+
+const (
+	idBytes = 9 // Encoded as 12 characters
+
+	// MaxPasswordLength is the longest password links can be protected by, in bytes, as
+	// longer passwords cannot be hashed.
+	MaxPasswordLength = 72
+
+	maxFailedAttempts = 5
+	lockoutDuration   = 15 * time.Minute
+)
+
+var (
+	links = store.New(config.ConfigStorageDirectoryShares)
+
+	validID = regexp.MustCompile(`^[A-Za-z0-9_-]{12}$`)
+
+	ErrNotFound         = errors.New("Share link is not found")
+	ErrExpired          = errors.New("Share link has expired")
+	ErrViewsExhausted   = errors.New("Share link has been viewed as many times as allowed")
+	ErrPasswordRequired = errors.New("Share link requires a password")
+	ErrWrongPassword    = errors.New("Share link password is wrong")
+	ErrLocked           = errors.New("Share link is locked after too many wrong passwords")
+)
+
+// Link shares an image until it expires, is viewed as many times as allowed, or is revoked.
+type Link struct {
+	ID             string    `json:"id"`
+	FileName       string    `json:"file_name"`
+	AccessType     string    `json:"access_type"`
+	Created        time.Time `json:"created"`
+	Expires        time.Time `json:"expires"`
+	MaxViews       int       `json:"max_views,omitempty"` // Unlimited if zero
+	Views          int       `json:"views"`
+	PasswordHash   string    `json:"password_hash,omitempty"`   // bcrypt hash of the password, if set
+	FailedAttempts int       `json:"failed_attempts,omitempty"` // Wrong passwords tried since the last right one or lockout
+	LockedUntil    time.Time `json:"locked_until"`
+}
+
+// PasswordProtected returns whether the link can only be used with a password.
+func (l Link) PasswordProtected() bool {
+	return l.PasswordHash != ""
+}
+
+// Usable returns whether the link can still be used, and if not, why.
+func (l Link) Usable(now time.Time) error {
+	if !now.Before(l.Expires) {
+		return ErrExpired
+	}
+	if l.MaxViews > 0 && l.Views >= l.MaxViews {
+		return ErrViewsExhausted
+	}
+
+	return nil
+}
+
+// ValidID returns whether the identifier could be of a link, so that it can be used as
+// a key in the store.
+func ValidID(id string) bool {
+	return validID.MatchString(id)
+}
+
+// Create creates a link sharing the image until the validity elapses. The image must be
+// validated by callers, and the password must be no longer than MaxPasswordLength.
+func Create(ctx context.Context, fileName, accessType string, validity time.Duration, maxViews int, password string) (Link, error) {
+	now := time.Now()
+	link := Link{
+		FileName:   fileName,
+		AccessType: accessType,
+		Created:    now,
+		Expires:    now.Add(validity),
+		MaxViews:   maxViews,
+	}
+
+	if password != "" {
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			slog.Error(ctx, "Could not hash share link password: %v", err)
+			return Link{}, err
+		}
+		link.PasswordHash = string(passwordHash)
+	}
+
+	// Identifiers are random, but are not reused should they ever collide.
+	_, err := links.CreateWithGeneratedKey(func() (string, error) {
+		return randomString(idBytes)
+	}, func(id string) interface{} {
+		link.ID = id
+		return link
+	})
+	if err != nil {
+		slog.Error(ctx, "Could not store share link for %s of access type %s: %v", fileName, accessType, err)
+		return Link{}, err
+	}
+
+	return link, nil
+}
+
+// List returns all links, including those no longer usable until revoked, most recently
+// created first.
+func List(ctx context.Context) ([]Link, error) {
+	keys, err := links.Keys("")
+	if err != nil {
+		slog.Error(ctx, "Could not list share links: %v", err)
+		return nil, err
+	}
+
+	sharedLinks := []Link{}
+	for _, key := range keys {
+		link := Link{}
+		found, err := links.Get(key, &link)
+		if err != nil {
+			slog.Error(ctx, "Could not read share link %s: %v", key, err)
+			return nil, err
+		}
+		if found {
+			sharedLinks = append(sharedLinks, link)
+		}
+	}
+
+	sort.Slice(sharedLinks, func(i, j int) bool {
+		return sharedLinks[i].Created.After(sharedLinks[j].Created)
+	})
+
+	return sharedLinks, nil
+}
+
+// Revoke removes the link, returning whether it existed.
+func Revoke(ctx context.Context, id string) (bool, error) {
+	if !ValidID(id) {
+		return false, nil
+	}
+
+	link := Link{}
+	found, err := links.Get(id, &link)
+	if err != nil || !found {
+		return false, err
+	}
+
+	if err := links.Delete(id); err != nil {
+		slog.Error(ctx, "Could not revoke share link %s: %v", id, err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RevokeForImage removes all links sharing the image, for when it is deleted.
+func RevokeForImage(ctx context.Context, fileName, accessType string) error {
+	sharedLinks, err := List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, link := range sharedLinks {
+		if link.FileName != fileName || link.AccessType != accessType {
+			continue
+		}
+		if _, err := Revoke(ctx, link.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Open checks that the link can be used with the password given, without counting a view
+// of it. Returns one of the errors of this package if it cannot be used.
+func Open(ctx context.Context, id, password string) (Link, error) {
+	if !ValidID(id) {
+		return Link{}, ErrNotFound
+	}
+
+	link := Link{}
+	found, err := links.Get(id, &link)
+	if err != nil {
+		return Link{}, err
+	}
+	if !found {
+		return Link{}, ErrNotFound
+	}
+	if err := checkUsable(link, time.Now()); err != nil {
+		return Link{}, err
+	}
+	if !link.PasswordProtected() {
+		return link, nil
+	}
+	if password == "" {
+		return Link{}, ErrPasswordRequired
+	}
+
+	// Passwords are compared outside of updates, which would hold up every other link
+	// while hashing, so the outcome is recorded against the link as it is by then.
+	passwordMatched := bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) == nil
+	var openErr error
+	current := Link{}
+	err = links.Update(id, &current, func() error {
+		now := time.Now()
+		if current.ID == "" {
+			return ErrNotFound
+		}
+		if err := checkUsable(current, now); err != nil {
+			return err
+		}
+
+		if passwordMatched {
+			current.FailedAttempts = 0
+			return nil
+		}
+		openErr = ErrWrongPassword
+		current.FailedAttempts++
+		if current.FailedAttempts >= maxFailedAttempts {
+			current.FailedAttempts = 0
+			current.LockedUntil = now.Add(lockoutDuration)
+		}
+		return nil
+	})
+	if err != nil {
+		return Link{}, err
+	}
+	if openErr != nil {
+		return Link{}, openErr
+	}
+
+	return current, nil
+}
+
+// CountView counts a view of the link, once its image has been served in full. Links
+// viewed at the same time when one view short of their limit can each be served.
+func CountView(ctx context.Context, id string) error {
+	if !ValidID(id) {
+		return ErrNotFound
+	}
+
+	link := Link{}
+	err := links.Update(id, &link, func() error {
+		if link.ID == "" {
+			return ErrNotFound
+		}
+		link.Views++
+		return nil
+	})
+	if err != nil && err != ErrNotFound {
+		slog.Error(ctx, "Could not count view of share link %s: %v", id, err)
+	}
+
+	return err
+}
+
+// UseStore keeps links in the store given rather than in the configured directory, and
+// returns the store they were kept in, so that tests of packages serving links can keep
+// them in a temporary directory.
+func UseStore(s *store.Store) *store.Store {
+	previous := links
+	links = s
+	return previous
+}
+
+// checkUsable returns why the link cannot be used, including when it is locked.
+func checkUsable(link Link, now time.Time) error {
+	if err := link.Usable(now); err != nil {
+		return err
+	}
+	if now.Before(link.LockedUntil) {
+		return ErrLocked
+	}
+
+	return nil
+}
+
+func randomString(size int) (string, error) {
+	randomBytes := make([]byte, size)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(randomBytes), "="), nil
+}
@@ -0,0 +1,161 @@
+package share
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chongyangshi/yronwood/store/storetest"
+)
+
+func TestOpen(t *testing.T) {
+	storetest.Use(t, &links)
+	ctx := context.Background()
+
+	link, err := Create(ctx, "test.png", "private", time.Hour, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidID(link.ID) {
+		t.Fatalf("Expected valid identifier for created link, got %q", link.ID)
+	}
+
+	for view := 1; view <= 2; view++ {
+		opened, err := Open(ctx, link.ID, "")
+		if err != nil {
+			t.Fatalf("Expected view %d of link to be allowed, got %v", view, err)
+		}
+		if opened.Views != view-1 || opened.FileName != "test.png" || opened.AccessType != "private" {
+			t.Fatalf("Expected test.png to be opened without counting view %d, got %+v", view, opened)
+		}
+		if err := CountView(ctx, link.ID); err != nil {
+			t.Fatalf("Expected view %d of link to be counted, got %v", view, err)
+		}
+	}
+	if _, err := Open(ctx, link.ID, ""); err != ErrViewsExhausted {
+		t.Fatalf("Expected views of link to be exhausted, got %v", err)
+	}
+
+	for _, id := range []string{"", "../../secret", "aaaaaaaaaaaa"} {
+		if _, err := Open(ctx, id, ""); err != ErrNotFound {
+			t.Fatalf("Expected link %q to not be found, got %v", id, err)
+		}
+		if err := CountView(ctx, id); err != ErrNotFound {
+			t.Fatalf("Expected no view of link %q to be counted, got %v", id, err)
+		}
+	}
+}
+
+func TestOpenExpired(t *testing.T) {
+	storetest.Use(t, &links)
+	ctx := context.Background()
+
+	link, err := Create(ctx, "test.png", "private", time.Nanosecond, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	if _, err := Open(ctx, link.ID, ""); err != ErrExpired {
+		t.Fatalf("Expected link to have expired, got %v", err)
+	}
+}
+
+func TestOpenWithPassword(t *testing.T) {
+	storetest.Use(t, &links)
+	ctx := context.Background()
+
+	link, err := Create(ctx, "test.png", "big", time.Hour, 0, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !link.PasswordProtected() || strings.Contains(link.PasswordHash, "hunter2") {
+		t.Fatalf("Expected link to be protected by a hashed password, got %+v", link)
+	}
+
+	if _, err := Open(ctx, link.ID, ""); err != ErrPasswordRequired {
+		t.Fatalf("Expected password to be required, got %v", err)
+	}
+	if _, err := Open(ctx, link.ID, "hunter3"); err != ErrWrongPassword {
+		t.Fatalf("Expected wrong password to be refused, got %v", err)
+	}
+	opened, err := Open(ctx, link.ID, "hunter2")
+	if err != nil || opened.FailedAttempts != 0 {
+		t.Fatalf("Expected link to be opened with password, clearing failed attempts, got %+v, %v", opened, err)
+	}
+}
+
+func TestOpenLockedAfterWrongPasswords(t *testing.T) {
+	storetest.Use(t, &links)
+	ctx := context.Background()
+
+	link, err := Create(ctx, "test.png", "private", time.Hour, 0, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Create(ctx, "test.png", "private", time.Hour, 0, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= maxFailedAttempts; attempt++ {
+		if _, err := Open(ctx, link.ID, "hunter3"); err != ErrWrongPassword {
+			t.Fatalf("Expected wrong password to be refused on attempt %d, got %v", attempt, err)
+		}
+	}
+	if _, err := Open(ctx, link.ID, "hunter2"); err != ErrLocked {
+		t.Fatalf("Expected link to be locked even with the right password, got %v", err)
+	}
+	if _, err := Open(ctx, other.ID, "hunter2"); err != nil {
+		t.Fatalf("Expected other links to the same image to not be locked, got %v", err)
+	}
+
+	// Once the lockout has passed, the right password opens the link again.
+	err = links.Update(link.ID, &link, func() error {
+		link.LockedUntil = time.Now().Add(-time.Second)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(ctx, link.ID, "hunter2"); err != nil {
+		t.Fatalf("Expected link to be usable after lockout, got %v", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	storetest.Use(t, &links)
+	ctx := context.Background()
+
+	kept, err := Create(ctx, "kept.png", "private", time.Hour, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileName := range []string{"test.png", "test.png"} {
+		if _, err := Create(ctx, fileName, "private", time.Hour, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RevokeForImage(ctx, "test.png", "private"); err != nil {
+		t.Fatal(err)
+	}
+	sharedLinks, err := List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sharedLinks) != 1 || sharedLinks[0].ID != kept.ID {
+		t.Fatalf("Expected only link to kept.png to remain, got %+v", sharedLinks)
+	}
+
+	if revoked, err := Revoke(ctx, kept.ID); err != nil || !revoked {
+		t.Fatalf("Expected link to be revoked, got %t, %v", revoked, err)
+	}
+	if revoked, err := Revoke(ctx, kept.ID); err != nil || revoked {
+		t.Fatalf("Expected revoked link to no longer exist, got %t, %v", revoked, err)
+	}
+	if _, err := Open(ctx, kept.ID, ""); err != ErrNotFound {
+		t.Fatalf("Expected revoked link to not be found, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package shortlink
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/store"
+)
+
+// Images can be given short slugs, which are easier to paste than their full URLs, and
+// which resolve to the image either by redirecting to it or by serving it directly. Slugs
+// are kept in a store along with how many times each has been followed.
+
+const (
+	ModeRedirect = "redirect"
+	ModeInline   = "inline"
+
+	generatedSlugLength = 7
+
+	// Without characters easily confused with others when read out or retyped.
+	generatedSlugAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+)
+
+var (
+	links = store.New(config.ConfigStorageDirectorySlugs)
+
+	validSlug = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+	ErrNotFound   = errors.New("Short link is not found")
+	ErrSlugExists = errors.New("Short link slug is already in use")
+)
+
+// Link resolves a slug to an image.
+type Link struct {
+	Slug       string    `json:"slug"`
+	FileName   string    `json:"file_name"`
+	AccessType string    `json:"access_type"`
+	Mode       string    `json:"mode"`
+	Created    time.Time `json:"created"`
+	Hits       int64     `json:"hits"`
+}
+
+// ValidSlug returns whether the slug can be given to a link, so that it can be used as a
+// key in the store.
+func ValidSlug(slug string) bool {
+	return validSlug.MatchString(slug)
+}
+
+// ValidMode returns whether links can resolve to images in the mode.
+func ValidMode(mode string) bool {
+	return mode == ModeRedirect || mode == ModeInline
+}
+
+// Create creates a link to the image under the slug, or under a generated slug if none is
+// given. Returns ErrSlugExists if the slug given is in use. The image, slug and mode must
+// be validated by callers.
+func Create(ctx context.Context, slug, fileName, accessType, mode string) (Link, error) {
+	link := Link{
+		FileName:   fileName,
+		AccessType: accessType,
+		Mode:       mode,
+		Created:    time.Now(),
+	}
+
+	if slug != "" {
+		link.Slug = slug
+		err := links.Create(slug, link)
+		if err == store.ErrKeyExists {
+			return Link{}, ErrSlugExists
+		}
+		if err != nil {
+			slog.Error(ctx, "Could not store short link %s for %s of access type %s: %v", slug, fileName, accessType, err)
+			return Link{}, err
+		}
+		return link, nil
+	}
+
+	// Generated slugs are not reused should they ever collide.
+	_, err := links.CreateWithGeneratedKey(generateSlug, func(slug string) interface{} {
+		link.Slug = slug
+		return link
+	})
+	if err != nil {
+		slog.Error(ctx, "Could not store short link for %s of access type %s: %v", fileName, accessType, err)
+		return Link{}, err
+	}
+
+	return link, nil
+}
+
+// List returns all links, most recently created first.
+func List(ctx context.Context) ([]Link, error) {
+	keys, err := links.Keys("")
+	if err != nil {
+		slog.Error(ctx, "Could not list short links: %v", err)
+		return nil, err
+	}
+
+	shortLinks := []Link{}
+	for _, key := range keys {
+		link := Link{}
+		found, err := links.Get(key, &link)
+		if err != nil {
+			slog.Error(ctx, "Could not read short link %s: %v", key, err)
+			return nil, err
+		}
+		if found {
+			shortLinks = append(shortLinks, link)
+		}
+	}
+
+	sort.Slice(shortLinks, func(i, j int) bool {
+		return shortLinks[i].Created.After(shortLinks[j].Created)
+	})
+
+	return shortLinks, nil
+}
+
+// Delete removes the link, returning whether it existed.
+func Delete(ctx context.Context, slug string) (bool, error) {
+	if !ValidSlug(slug) {
+		return false, nil
+	}
+
+	link := Link{}
+	found, err := links.Get(slug, &link)
+	if err != nil || !found {
+		return false, err
+	}
+
+	if err := links.Delete(slug); err != nil {
+		slog.Error(ctx, "Could not delete short link %s: %v", slug, err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DeleteForImage removes all links to the image, for when it is deleted.
+func DeleteForImage(ctx context.Context, fileName, accessType string) error {
+	shortLinks, err := List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, link := range shortLinks {
+		if link.FileName != fileName || link.AccessType != accessType {
+			continue
+		}
+		if _, err := Delete(ctx, link.Slug); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Resolve returns the link with the slug, counting a hit of it if countHit is set.
+// Returns ErrNotFound if there is no such link.
+func Resolve(ctx context.Context, slug string, countHit bool) (Link, error) {
+	if !ValidSlug(slug) {
+		return Link{}, ErrNotFound
+	}
+
+	link := Link{}
+	err := links.Update(slug, &link, func() error {
+		if link.Slug == "" {
+			return ErrNotFound
+		}
+		if countHit {
+			link.Hits++
+		}
+		return nil
+	})
+	if err != nil {
+		return Link{}, err
+	}
+
+	return link, nil
+}
+
+// CountHit counts a hit of the link, once it has redirected to or served its image.
+// Returns ErrNotFound if there is no such link.
+func CountHit(ctx context.Context, slug string) error {
+	_, err := Resolve(ctx, slug, true)
+	return err
+}
+
+// UseStore keeps links in the store given rather than in the configured directory, and
+// returns the store they were kept in, so that tests of packages serving links can keep
+// them in a temporary directory.
+func UseStore(s *store.Store) *store.Store {
+	previous := links
+	links = s
+	return previous
+}
+
+func generateSlug() (string, error) {
+	slug := make([]byte, generatedSlugLength)
+	for i := range slug {
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(generatedSlugAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		slug[i] = generatedSlugAlphabet[index.Int64()]
+	}
+
+	return string(slug), nil
+}
@@ -0,0 +1,112 @@
+package shortlink
+
+import (
+	"context"
+	"testing"
+
+	"github.com/chongyangshi/yronwood/store/storetest"
+)
+
+func TestCreate(t *testing.T) {
+	storetest.Use(t, &links)
+	ctx := context.Background()
+
+	named, err := Create(ctx, "cat", "cat.png", "public", ModeRedirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if named.Slug != "cat" || named.FileName != "cat.png" || named.Mode != ModeRedirect {
+		t.Fatalf("Expected link cat to cat.png, got %+v", named)
+	}
+	if _, err := Create(ctx, "cat", "dog.png", "public", ModeInline); err != ErrSlugExists {
+		t.Fatalf("Expected slug cat to already be in use, got %v", err)
+	}
+
+	generated, err := Create(ctx, "", "dog.png", "private", ModeInline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated.Slug) != generatedSlugLength || !ValidSlug(generated.Slug) {
+		t.Fatalf("Expected valid generated slug, got %q", generated.Slug)
+	}
+
+	for _, slug := range []string{"", "../../secret", "a/b", "a.png"} {
+		if ValidSlug(slug) {
+			t.Fatalf("Expected slug %q to be invalid", slug)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	storetest.Use(t, &links)
+	ctx := context.Background()
+
+	if _, err := Create(ctx, "cat", "cat.png", "big", ModeInline); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Resolve(ctx, "cat", false); err != nil {
+		t.Fatal(err)
+	}
+	for hit := int64(1); hit <= 2; hit++ {
+		link, err := Resolve(ctx, "cat", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.Hits != hit || link.FileName != "cat.png" || link.AccessType != "big" {
+			t.Fatalf("Expected hit %d of cat.png to be counted, got %+v", hit, link)
+		}
+	}
+
+	if err := CountHit(ctx, "cat"); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := Resolve(ctx, "cat", false); err != nil || link.Hits != 3 {
+		t.Fatalf("Expected hit 3 of cat.png to be counted, got %+v and %v", link, err)
+	}
+
+	for _, slug := range []string{"", "../../secret", "dog"} {
+		if _, err := Resolve(ctx, slug, true); err != ErrNotFound {
+			t.Fatalf("Expected link %q to not be found, got %v", slug, err)
+		}
+		if err := CountHit(ctx, slug); err != ErrNotFound {
+			t.Fatalf("Expected no hit of link %q to be counted, got %v", slug, err)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	storetest.Use(t, &links)
+	ctx := context.Background()
+
+	for _, slug := range []string{"kept", "cat", "kitten"} {
+		fileName := "cat.png"
+		if slug == "kept" {
+			fileName = "kept.png"
+		}
+		if _, err := Create(ctx, slug, fileName, "public", ModeRedirect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := DeleteForImage(ctx, "cat.png", "public"); err != nil {
+		t.Fatal(err)
+	}
+	shortLinks, err := List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shortLinks) != 1 || shortLinks[0].Slug != "kept" {
+		t.Fatalf("Expected only link to kept.png to remain, got %+v", shortLinks)
+	}
+
+	if deleted, err := Delete(ctx, "kept"); err != nil || !deleted {
+		t.Fatalf("Expected link to be deleted, got %t, %v", deleted, err)
+	}
+	if deleted, err := Delete(ctx, "kept"); err != nil || deleted {
+		t.Fatalf("Expected deleted link to no longer exist, got %t, %v", deleted, err)
+	}
+	if _, err := Resolve(ctx, "kept", true); err != ErrNotFound {
+		t.Fatalf("Expected deleted link to not be found, got %v", err)
+	}
+}
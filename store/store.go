@@ -0,0 +1,198 @@
+package store
+
+// Records such as image metadata are kept as JSON files in a directory, one file per key.
+// The service handles small numbers of images and runs as a single instance, so this is
+// enough without a database to run alongside it.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	recordExtension = ".json"
+
+	maxGeneratedKeyAttempts = 10
+)
+
+var ErrKeyExists = errors.New("A record already exists for the key")
+
+// Store keeps JSON records under a directory. Keys may contain slashes to group records
+// into subdirectories, and must be validated by callers to not escape the directory.
+type Store struct {
+	directory string
+	mutex     sync.Mutex
+}
+
+func New(directory string) *Store {
+	return &Store{directory: directory}
+}
+
+// Get reads the record for the key into value, and returns whether it exists.
+func (s *Store) Get(key string, value interface{}) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.get(key, value)
+}
+
+// Put writes the record for the key, replacing any existing record.
+func (s *Store) Put(key string, value interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.put(key, value)
+}
+
+// Update reads the record for the key into value, which is left as is if there is no
+// record, then writes it back after update has modified it. Records are not changed by
+// other calls in between.
+func (s *Store) Update(key string, value interface{}, update func() error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.get(key, value); err != nil {
+		return err
+	}
+	if err := update(); err != nil {
+		return err
+	}
+
+	return s.put(key, value)
+}
+
+// Create writes the record for the key, returning ErrKeyExists if there already is one.
+func (s *Store) Create(key string, value interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.create(key, value)
+}
+
+// CreateWithGeneratedKey writes the record returned for a key from generateKey, trying
+// other keys should they ever collide with existing records, and returns the key used.
+func (s *Store) CreateWithGeneratedKey(generateKey func() (string, error), record func(key string) interface{}) (string, error) {
+	for attempt := 0; attempt < maxGeneratedKeyAttempts; attempt++ {
+		key, err := generateKey()
+		if err != nil {
+			return "", err
+		}
+
+		s.mutex.Lock()
+		err = s.create(key, record(key))
+		s.mutex.Unlock()
+		switch err {
+		case nil:
+			return key, nil
+		case ErrKeyExists:
+			continue
+		default:
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("Could not generate an unused key after %d attempts", maxGeneratedKeyAttempts)
+}
+
+// Delete removes the record for the key, if it exists.
+func (s *Store) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := os.Remove(s.recordPath(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Keys lists the keys of records in the group, which is a subdirectory of the store, or
+// the store itself if empty.
+func (s *Store) Keys(group string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	recordFiles, err := ioutil.ReadDir(path.Join(s.directory, group))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, recordFile := range recordFiles {
+		if recordFile.IsDir() || !strings.HasSuffix(recordFile.Name(), recordExtension) || strings.HasPrefix(recordFile.Name(), ".") {
+			continue
+		}
+		keys = append(keys, path.Join(group, strings.TrimSuffix(recordFile.Name(), recordExtension)))
+	}
+
+	return keys, nil
+}
+
+func (s *Store) get(key string, value interface{}) (bool, error) {
+	record, err := ioutil.ReadFile(s.recordPath(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal(record, value)
+}
+
+func (s *Store) create(key string, value interface{}) error {
+	if _, err := os.Stat(s.recordPath(key)); err == nil {
+		return ErrKeyExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.put(key, value)
+}
+
+// put writes the record to a temporary file and renames it into place, so that records
+// are never left partially written.
+func (s *Store) put(key string, value interface{}) error {
+	record, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	recordPath := s.recordPath(key)
+	if err := os.MkdirAll(path.Dir(recordPath), 0755); err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(path.Dir(recordPath), "."+path.Base(recordPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, writeErr := tempFile.Write(record)
+	closeErr := tempFile.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(tempFile.Name())
+		return writeErr
+	}
+
+	if err := os.Rename(tempFile.Name(), recordPath); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (s *Store) recordPath(key string) string {
+	return path.Join(s.directory, key+recordExtension)
+}
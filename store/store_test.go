@@ -0,0 +1,118 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"testing"
+)
+
+type testRecord struct {
+	Name  string
+	Count int
+}
+
+func TestStoreRecords(t *testing.T) {
+	testStore := New(t.TempDir())
+
+	record := testRecord{}
+	found, err := testStore.Get("public/a.png", &record)
+	if err != nil || found {
+		t.Fatalf("Expected no record before writing, got %v, %v", found, err)
+	}
+
+	if err := testStore.Put("public/a.png", testRecord{Name: "a", Count: 1}); err != nil {
+		t.Fatalf("Unexpected error writing record: %v", err)
+	}
+	if err := testStore.Put("public/b.png", testRecord{Name: "b"}); err != nil {
+		t.Fatalf("Unexpected error writing record: %v", err)
+	}
+
+	err = testStore.Update("public/a.png", &record, func() error {
+		record.Count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error updating record: %v", err)
+	}
+
+	record = testRecord{}
+	found, err = testStore.Get("public/a.png", &record)
+	if err != nil || !found || record.Name != "a" || record.Count != 2 {
+		t.Fatalf("Unexpected record after update: %+v, %v, %v", record, found, err)
+	}
+
+	// Failed updates are not written.
+	err = testStore.Update("public/a.png", &record, func() error {
+		record.Count = 100
+		return errors.New("invalid")
+	})
+	if err == nil {
+		t.Fatal("Expected error from failed update")
+	}
+	record = testRecord{}
+	if _, err := testStore.Get("public/a.png", &record); err != nil || record.Count != 2 {
+		t.Fatalf("Failed update should not be written, got %+v", record)
+	}
+
+	keys, err := testStore.Keys("public")
+	sort.Strings(keys)
+	if err != nil || len(keys) != 2 || keys[0] != "public/a.png" || keys[1] != "public/b.png" {
+		t.Fatalf("Unexpected keys %v, %v", keys, err)
+	}
+
+	if err := testStore.Delete("public/a.png"); err != nil {
+		t.Fatalf("Unexpected error deleting record: %v", err)
+	}
+	if err := testStore.Delete("public/a.png"); err != nil {
+		t.Fatalf("Deleting a missing record should not fail: %v", err)
+	}
+	if found, _ := testStore.Get("public/a.png", &record); found {
+		t.Fatal("Deleted record should not be found")
+	}
+
+	keys, err = testStore.Keys("private")
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("Expected no keys in empty group, got %v, %v", keys, err)
+	}
+}
+
+func TestStoreCreate(t *testing.T) {
+	testStore := New(t.TempDir())
+
+	if err := testStore.Create("a", testRecord{Name: "a"}); err != nil {
+		t.Fatalf("Unexpected error creating record: %v", err)
+	}
+	if err := testStore.Create("a", testRecord{Name: "b"}); err != ErrKeyExists {
+		t.Fatalf("Expected record to already exist, got %v", err)
+	}
+
+	// Keys colliding with existing records are skipped for the next one generated.
+	keys := []string{"a", "a", "c"}
+	key, err := testStore.CreateWithGeneratedKey(func() (string, error) {
+		key := keys[0]
+		keys = keys[1:]
+		return key, nil
+	}, func(key string) interface{} {
+		return testRecord{Name: key}
+	})
+	if err != nil || key != "c" {
+		t.Fatalf("Expected record to be created under c, got %q, %v", key, err)
+	}
+
+	record := testRecord{}
+	if _, err := testStore.Get("a", &record); err != nil || record.Name != "a" {
+		t.Fatalf("Expected existing record to be kept, got %+v, %v", record, err)
+	}
+	if _, err := testStore.Get("c", &record); err != nil || record.Name != "c" {
+		t.Fatalf("Expected generated record to be written, got %+v, %v", record, err)
+	}
+
+	_, err = testStore.CreateWithGeneratedKey(func() (string, error) {
+		return "a", nil
+	}, func(key string) interface{} {
+		return testRecord{Name: key}
+	})
+	if err == nil {
+		t.Fatal("Expected error once no unused key is generated")
+	}
+}
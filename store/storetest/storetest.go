@@ -0,0 +1,17 @@
+package storetest
+
+import (
+	"testing"
+
+	"github.com/chongyangshi/yronwood/store"
+)
+
+// Use replaces the store of a package with one in a temporary directory for the duration
+// of the test, so that tests do not read or write records of the configured directory.
+func Use(t testing.TB, configured **store.Store) {
+	t.Helper()
+
+	previous := *configured
+	*configured = store.New(t.TempDir())
+	t.Cleanup(func() { *configured = previous })
+}
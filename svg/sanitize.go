@@ -0,0 +1,280 @@
+package svg
+
+// SVG images are XML documents which browsers will happily run scripts from, and which
+// can pull in external resources. We only accept them after stripping anything active or
+// external, leaving the drawing itself. Images are also served with a strict content
+// security policy, so this is not the only line of defence.
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Elements removed together with everything inside them.
+var disallowedElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"audio":         true,
+	"video":         true,
+	"handler":       true,
+	"listener":      true,
+	"set":           true,
+}
+
+// Data URIs of raster images are allowed as references, as they cannot run scripts.
+var (
+	permittedDataURI = regexp.MustCompile(`^data:image/(png|jpeg|jpg|gif|webp);`)
+	cssURLReference  = regexp.MustCompile(`(?i)url\(\s*['"]?\s*([^'")\s]*)`)
+	cssComment       = regexp.MustCompile(`(?s)/\*.*?(\*/|$)`)
+)
+
+// Sanitize parses the SVG image and returns it with scripts, event handlers, external
+// references and foreign objects removed. An error is returned if the payload is not a
+// well-formed SVG document.
+func Sanitize(payload []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	decoder.Strict = true
+
+	var (
+		sanitized  bytes.Buffer
+		openNames  []string
+		skipDepth  int
+		seenRoot   bool
+		inStyle    bool
+		styleBlock bytes.Buffer
+	)
+
+	for {
+		// Raw tokens keep namespace prefixes as written, so that the document can be
+		// written back as it was without namespace rewriting.
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse SVG: %v", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if skipDepth > 0 {
+				openNames = append(openNames, qualifiedName(t.Name))
+				skipDepth++
+				continue
+			}
+
+			if !seenRoot {
+				if strings.ToLower(t.Name.Local) != "svg" {
+					return nil, fmt.Errorf("Root element %s is not svg", qualifiedName(t.Name))
+				}
+				seenRoot = true
+			} else if len(openNames) == 0 {
+				return nil, fmt.Errorf("Multiple root elements in SVG")
+			}
+
+			openNames = append(openNames, qualifiedName(t.Name))
+
+			// Style sheets hold only text, so elements within them are dropped too rather
+			// than let their text escape the checks on the style sheet.
+			if inStyle || isDisallowedElement(t) {
+				// Keep track of nesting without writing anything, until the matching
+				// end element is reached.
+				skipDepth = 1
+				continue
+			}
+
+			if strings.ToLower(t.Name.Local) == "style" {
+				inStyle = true
+				styleBlock.Reset()
+			}
+
+			sanitized.WriteString("<")
+			sanitized.WriteString(qualifiedName(t.Name))
+			for _, attr := range t.Attr {
+				if !isPermittedAttribute(attr) {
+					continue
+				}
+				sanitized.WriteString(" ")
+				sanitized.WriteString(qualifiedName(attr.Name))
+				sanitized.WriteString(`="`)
+				xml.EscapeText(&sanitized, []byte(attr.Value))
+				sanitized.WriteString(`"`)
+			}
+			sanitized.WriteString(">")
+
+		case xml.EndElement:
+			if len(openNames) == 0 || openNames[len(openNames)-1] != qualifiedName(t.Name) {
+				return nil, fmt.Errorf("Unexpected end element %s in SVG", qualifiedName(t.Name))
+			}
+			openNames = openNames[:len(openNames)-1]
+
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+
+			// Elements within style sheets are skipped, so this ends the style sheet, whose
+			// text is checked as a whole.
+			if inStyle {
+				// Style sheets referencing anything external are dropped as a whole.
+				if !hasExternalReference(styleBlock.String()) {
+					xml.EscapeText(&sanitized, styleBlock.Bytes())
+				}
+				inStyle = false
+			}
+
+			sanitized.WriteString("</")
+			sanitized.WriteString(qualifiedName(t.Name))
+			sanitized.WriteString(">")
+
+		case xml.CharData:
+			if skipDepth > 0 || len(openNames) == 0 {
+				continue
+			}
+			if inStyle {
+				styleBlock.Write(t)
+				continue
+			}
+			xml.EscapeText(&sanitized, t)
+
+		case xml.ProcInst:
+			// Only the XML declaration is kept, as other instructions such as style
+			// sheets can reference external resources.
+			if t.Target == "xml" && !seenRoot {
+				sanitized.WriteString("<?xml ")
+				sanitized.Write(t.Inst)
+				sanitized.WriteString("?>\n")
+			}
+
+		case xml.Directive, xml.Comment:
+			// Document type declarations can define entities and external references,
+			// and comments are of no use to a viewer; both are dropped.
+		}
+	}
+
+	if !seenRoot || len(openNames) != 0 {
+		return nil, fmt.Errorf("Incomplete SVG document")
+	}
+
+	return sanitized.Bytes(), nil
+}
+
+func isDisallowedElement(element xml.StartElement) bool {
+	name := strings.ToLower(element.Name.Local)
+	if disallowedElements[name] {
+		return true
+	}
+
+	// Animations can change links into script URIs after sanitization.
+	if strings.HasPrefix(name, "animate") {
+		for _, attr := range element.Attr {
+			if strings.ToLower(attr.Name.Local) == "attributename" && strings.Contains(strings.ToLower(attr.Value), "href") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isPermittedAttribute(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	value := strings.TrimSpace(attr.Value)
+
+	// Event handlers such as onload and onclick.
+	if strings.HasPrefix(name, "on") {
+		return false
+	}
+
+	// Base URIs would change what relative references resolve to.
+	if strings.ToLower(attr.Name.Space) == "xml" && name == "base" {
+		return false
+	}
+
+	// Links must point within the document, or to embedded raster data.
+	if name == "href" || name == "src" {
+		return strings.HasPrefix(value, "#") || permittedDataURI.MatchString(strings.ToLower(value))
+	}
+
+	return !hasExternalReference(value)
+}
+
+// hasExternalReference returns whether CSS references anything other than an element
+// within the document. Escapes and comments are removed first, as browsers would see
+// through them, and imports and image sets are never allowed.
+func hasExternalReference(value string) bool {
+	normalized := strings.ToLower(unescapeCSS(cssComment.ReplaceAllString(value, "")))
+	if strings.Contains(normalized, "@import") || strings.Contains(normalized, "image-set(") {
+		return true
+	}
+
+	for _, match := range cssURLReference.FindAllStringSubmatch(normalized, -1) {
+		if !strings.HasPrefix(match[1], "#") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unescapeCSS replaces CSS escapes with the characters they stand for: a backslash
+// followed by up to six hex digits and an optional space, or by any other character.
+func unescapeCSS(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			unescaped.WriteByte(value[i])
+			continue
+		}
+
+		hexEnd := i + 1
+		for hexEnd < len(value) && hexEnd-i <= 6 && isHexDigit(value[hexEnd]) {
+			hexEnd++
+		}
+		if hexEnd == i+1 {
+			// Escaped newlines continue the line, and other characters stand for themselves.
+			if value[i+1] != '\n' {
+				unescaped.WriteByte(value[i+1])
+			}
+			i++
+			continue
+		}
+
+		codePoint, err := strconv.ParseUint(value[i+1:hexEnd], 16, 32)
+		if err != nil || codePoint == 0 || codePoint > utf8.MaxRune {
+			codePoint = utf8.RuneError
+		}
+		unescaped.WriteRune(rune(codePoint))
+		if hexEnd < len(value) && strings.ContainsRune(" \t\n\r\f", rune(value[hexEnd])) {
+			hexEnd++
+		}
+		i = hexEnd - 1
+	}
+
+	return unescaped.String()
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+
+	return fmt.Sprintf("%s:%s", name.Space, name.Local)
+}
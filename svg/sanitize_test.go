@@ -0,0 +1,92 @@
+package svg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeKeepsDrawing(t *testing.T) {
+	input := `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="10" height="10">
+<defs><linearGradient id="g"><stop offset="0" stop-color="red"/></linearGradient></defs>
+<rect width="10" height="10" fill="url(#g)"/>
+<use xlink:href="#g"/>
+<text x="1" y="5">a &amp; b</text>
+<style>rect { fill: url(#g); stroke: \72 ed }</style>
+</svg>`
+
+	sanitized, err := Sanitize([]byte(input))
+	if err != nil {
+		t.Fatalf("Unexpected error sanitizing valid SVG: %+v", err)
+	}
+
+	for _, expected := range []string{
+		`<?xml version="1.0" encoding="UTF-8"?>`,
+		`xmlns:xlink="http://www.w3.org/1999/xlink"`,
+		`fill="url(#g)"`,
+		`<use xlink:href="#g"></use>`,
+		`a &amp; b`,
+		`<style>rect { fill: url(#g); stroke: \72 ed }</style>`,
+	} {
+		if !strings.Contains(string(sanitized), expected) {
+			t.Fatalf("Sanitized SVG %s does not contain %s", sanitized, expected)
+		}
+	}
+}
+
+func TestSanitizeStripsActiveContent(t *testing.T) {
+	input := `<!DOCTYPE svg [<!ENTITY x "y">]>
+<?xml-stylesheet href="https://example.com/style.css"?>
+<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)">
+<script>alert(1)</script>
+<SCRIPT type="text/javascript"><![CDATA[alert(1)]]></SCRIPT>
+<foreignObject><div xmlns="http://www.w3.org/1999/xhtml"><iframe src="https://example.com"></iframe></div></foreignObject>
+<a href="javascript:alert(1)"><rect onclick="alert(1)" width="1" height="1"/></a>
+<image href="https://example.com/tracker.png"/>
+<image href="data:image/svg+xml;base64,PHN2Zz48L3N2Zz4="/>
+<rect style="fill: url(https://example.com/x)" width="1" height="1"/>
+<animate attributeName="href" to="javascript:alert(1)"/>
+<set attributeName="onload" to="alert(1)"/>
+<style>@import url(https://example.com/style.css);</style>
+<style><g></g>@import url(http://evil.example/x.css); rect{fill:url(http://evil.example/a)}</style>
+<style>rect{fill:u\rl(http://evil.example/b)}</style>
+<style>\40import "http://evil.example/c.css";</style>
+<style>@im/**/port "http://evil.example/d.css";</style>
+<style>rect{background:image-set("http://evil.example/e.png" 1x)}</style>
+<style><style>@import "http://evil.example/f.css";</style></style>
+<rect style="fill: u\72 l(http://evil.example/g)" width="2" height="2"/>
+</svg>`
+
+	sanitized, err := Sanitize([]byte(input))
+	if err != nil {
+		t.Fatalf("Unexpected error sanitizing SVG: %+v", err)
+	}
+
+	for _, unexpected := range []string{
+		"DOCTYPE", "ENTITY", "xml-stylesheet", "onload", "onclick", "script", "SCRIPT",
+		"alert", "foreignObject", "iframe", "javascript", "example.com", "data:image/svg+xml",
+		"animate", "<set", "@import", "evil.example", "import", "<g>",
+	} {
+		if strings.Contains(string(sanitized), unexpected) {
+			t.Fatalf("Sanitized SVG %s still contains %s", sanitized, unexpected)
+		}
+	}
+
+	if !strings.Contains(string(sanitized), `<rect width="1" height="1"></rect>`) {
+		t.Fatalf("Sanitized SVG %s lost harmless elements", sanitized)
+	}
+}
+
+func TestSanitizeRejectsInvalidDocuments(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"not xml",
+		`<html><body></body></html>`,
+		`<svg xmlns="http://www.w3.org/2000/svg"><rect></svg>`,
+		`<svg xmlns="http://www.w3.org/2000/svg"></svg><svg></svg>`,
+	} {
+		if _, err := Sanitize([]byte(input)); err == nil {
+			t.Fatalf("Sanitizing invalid SVG %q should trigger an error", input)
+		}
+	}
+}
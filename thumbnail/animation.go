@@ -0,0 +1,240 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+var (
+	maxAnimationFrames int64 = 300
+	maxAnimationPixels int64 = 100000000
+)
+
+func init() {
+	maxAnimationFramesParsed, err := strconv.ParseInt(config.ConfigThumbnailMaxAnimationFrames, 10, 32)
+	if err == nil {
+		maxAnimationFrames = maxAnimationFramesParsed
+	}
+
+	maxAnimationPixelsParsed, err := strconv.ParseInt(config.ConfigThumbnailMaxAnimationPixels, 10, 64)
+	if err == nil {
+		maxAnimationPixels = maxAnimationPixelsParsed
+	}
+}
+
+// makeAnimatedDerivative resizes every frame of an animated GIF to make a derivative which
+// stays animated, keeping the delays and disposal methods of the original frames. If the
+// image is not an animated GIF, the animation is too large to resize within reasonable time
+// and memory, or the derivative is cropped, no derivative is made so that a static one can
+// be made from the first frame instead.
+func makeAnimatedDerivative(ctx context.Context, fileName, derivativeFilePath string, filePayload []byte, params DerivativeParams) (bool, error) {
+	if params.Fit != FitContain {
+		return false, nil
+	}
+
+	// Animations are measured before their frames are decoded, as decoding every frame of
+	// one too large to resize would take the memory that the limits are there to save.
+	canvas, frames, err := measureAnimation(fileName, filePayload)
+	if err != nil {
+		return false, err
+	}
+	if frames < 2 {
+		return false, nil
+	}
+	if !animationWithinLimits(canvas, frames) {
+		slog.Info(ctx, "Animated image %s with %d frames is too large to thumbnail with animation, falling back to static thumbnail", fileName, frames)
+		return false, nil
+	}
+
+	animation, err := gif.DecodeAll(bytes.NewReader(filePayload))
+	if err != nil {
+		return false, err
+	}
+
+	derivative := resizeAnimation(animation, params.containWidth(animation.Config.Width, animation.Config.Height))
+
+	return true, writeFileAtomically(derivativeFilePath, func(derivativeFile io.Writer) error {
+		return gif.EncodeAll(derivativeFile, derivative)
+	})
+}
+
+// measureAnimation returns the size of the canvas of a GIF and the number of frames in it,
+// without decoding the frames. Images which are not GIFs have no frames.
+func measureAnimation(fileName string, filePayload []byte) (image.Config, int, error) {
+	fileNameComponents := strings.Split(fileName, ".")
+	if len(fileNameComponents) < 2 || strings.ToLower(fileNameComponents[len(fileNameComponents)-1]) != "gif" {
+		return image.Config{}, 0, nil
+	}
+
+	canvas, err := gif.DecodeConfig(bytes.NewReader(filePayload))
+	if err != nil {
+		return image.Config{}, 0, err
+	}
+
+	frames, err := countGIFFrames(filePayload)
+	if err != nil {
+		return image.Config{}, 0, err
+	}
+
+	return canvas, frames, nil
+}
+
+func animationWithinLimits(canvas image.Config, frames int) bool {
+	canvasPixels := int64(canvas.Width) * int64(canvas.Height)
+	return int64(frames) <= maxAnimationFrames && canvasPixels*int64(frames) <= maxAnimationPixels
+}
+
+// countGIFFrames counts the image descriptors in a GIF by walking its blocks, skipping
+// over colour tables and image data rather than decompressing them.
+func countGIFFrames(filePayload []byte) (int, error) {
+	reader := bytes.NewReader(filePayload)
+
+	// Header and logical screen descriptor, followed by the global colour table if any.
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, err
+	}
+	if !bytes.HasPrefix(header, []byte("GIF")) {
+		return 0, errors.New("gif: not a GIF file")
+	}
+	if header[10]&0x80 != 0 {
+		if err := skipGIFBytes(reader, 3<<(header[10]&0x07+1)); err != nil {
+			return 0, err
+		}
+	}
+
+	frames := 0
+	for {
+		introducer, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch introducer {
+		case 0x21: // Extension, labelled by its next byte.
+			if _, err := reader.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipGIFSubBlocks(reader); err != nil {
+				return 0, err
+			}
+		case 0x2c: // Image descriptor, followed by its local colour table if any, then image data.
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(reader, descriptor); err != nil {
+				return 0, err
+			}
+			if descriptor[8]&0x80 != 0 {
+				if err := skipGIFBytes(reader, 3<<(descriptor[8]&0x07+1)); err != nil {
+					return 0, err
+				}
+			}
+			if err := skipGIFBytes(reader, 1); err != nil { // LZW minimum code size
+				return 0, err
+			}
+			if err := skipGIFSubBlocks(reader); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3b: // Trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("gif: unknown block type %#x", introducer)
+		}
+	}
+}
+
+func skipGIFSubBlocks(reader *bytes.Reader) error {
+	for {
+		blockSize, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if blockSize == 0 {
+			return nil
+		}
+		if err := skipGIFBytes(reader, int(blockSize)); err != nil {
+			return err
+		}
+	}
+}
+
+func skipGIFBytes(reader *bytes.Reader, n int) error {
+	if int64(n) > int64(reader.Len()) {
+		return io.ErrUnexpectedEOF
+	}
+
+	_, err := reader.Seek(int64(n), io.SeekCurrent)
+	return err
+}
+
+// resizeAnimation scales every frame of the animation to the given width, including
+// the position of frames which only cover part of the canvas.
+func resizeAnimation(animation *gif.GIF, width int) *gif.GIF {
+	scale := float64(width) / float64(animation.Config.Width)
+	canvasWidth := width
+	canvasHeight := scaleDimension(animation.Config.Height, scale)
+
+	resized := &gif.GIF{
+		Image:           make([]*image.Paletted, len(animation.Image)),
+		Delay:           animation.Delay,
+		Disposal:        animation.Disposal,
+		LoopCount:       animation.LoopCount,
+		BackgroundIndex: animation.BackgroundIndex,
+		Config: image.Config{
+			ColorModel: animation.Config.ColorModel,
+			Width:      canvasWidth,
+			Height:     canvasHeight,
+		},
+	}
+
+	for i, frame := range animation.Image {
+		frameBounds := frame.Bounds()
+		resizedBounds := image.Rect(
+			minInt(scaleDimension(frameBounds.Min.X, scale), canvasWidth-1),
+			minInt(scaleDimension(frameBounds.Min.Y, scale), canvasHeight-1),
+			minInt(scaleDimension(frameBounds.Max.X, scale), canvasWidth),
+			minInt(scaleDimension(frameBounds.Max.Y, scale), canvasHeight),
+		)
+		if resizedBounds.Dx() < 1 {
+			resizedBounds.Max.X = resizedBounds.Min.X + 1
+		}
+		if resizedBounds.Dy() < 1 {
+			resizedBounds.Max.Y = resizedBounds.Min.Y + 1
+		}
+
+		resizedFrame := scaleImage(frame, resizedBounds.Dx(), resizedBounds.Dy())
+
+		// Map the resized frame back onto the palette of the original frame. Dithering is
+		// not used, as it would vary between frames and make the animation flicker.
+		palettedFrame := image.NewPaletted(resizedBounds, frame.Palette)
+		draw.Draw(palettedFrame, resizedBounds, resizedFrame, resizedFrame.Bounds().Min, draw.Src)
+		resized.Image[i] = palettedFrame
+	}
+
+	return resized
+}
+
+func scaleDimension(dimension int, scale float64) int {
+	return int(math.Round(float64(dimension) * scale))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,134 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path"
+	"testing"
+)
+
+func testAnimation(t *testing.T, width, height, frames int) []byte {
+	t.Helper()
+
+	palette := color.Palette{color.Black, color.White, color.RGBA{R: 255, A: 255}}
+	animation := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		for x := 0; x < width; x++ {
+			frame.SetColorIndex(x, i%height, uint8(i%len(palette)))
+		}
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10*(i+1))
+	}
+
+	var encoded bytes.Buffer
+	if err := gif.EncodeAll(&encoded, animation); err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded.Bytes()
+}
+
+func TestMeasureAnimation(t *testing.T) {
+	for _, frames := range []int{1, 2, 7} {
+		canvas, measured, err := measureAnimation("cat.gif", testAnimation(t, 40, 20, frames))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if measured != frames || canvas.Width != 40 || canvas.Height != 20 {
+			t.Fatalf("Expected %d frames on a 40x20 canvas, got %d frames on %dx%d", frames, measured, canvas.Width, canvas.Height)
+		}
+	}
+
+	if _, frames, err := measureAnimation("cat.png", testAnimation(t, 40, 20, 3)); err != nil || frames != 0 {
+		t.Fatalf("Expected images not named as GIFs to not be measured, got %d frames and %v", frames, err)
+	}
+
+	truncated := testAnimation(t, 40, 20, 3)
+	if _, _, err := measureAnimation("cat.gif", truncated[:len(truncated)-10]); err == nil {
+		t.Fatal("Expected truncated animation to not be measured")
+	}
+}
+
+func TestAnimatedDerivativeLimits(t *testing.T) {
+	defer func(frames, pixels int64) {
+		maxAnimationFrames, maxAnimationPixels = frames, pixels
+	}(maxAnimationFrames, maxAnimationPixels)
+	animation := testAnimation(t, 40, 20, 5)
+	params := DerivativeParams{Width: 20, Fit: FitContain}
+
+	for _, testCase := range []struct {
+		name     string
+		frames   int64
+		pixels   int64
+		animated bool
+	}{
+		{"within limits", 5, 40 * 20 * 5, true},
+		{"too many frames", 4, 40 * 20 * 5, false},
+		{"too many pixels", 5, 40*20*5 - 1, false},
+	} {
+		maxAnimationFrames, maxAnimationPixels = testCase.frames, testCase.pixels
+		derivativeFilePath := path.Join(t.TempDir(), "cat.gif")
+
+		animated, err := makeAnimatedDerivative(context.Background(), "cat.gif", derivativeFilePath, animation, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if animated != testCase.animated {
+			t.Fatalf("Expected animated derivative to be made %v %s, got %v", testCase.animated, testCase.name, animated)
+		}
+		if _, err := os.Stat(derivativeFilePath); os.IsNotExist(err) == testCase.animated {
+			t.Fatalf("Expected derivative to be written %v %s, got %v", testCase.animated, testCase.name, err)
+		}
+	}
+
+	// Animations resized with animation need memory for every frame.
+	maxAnimationFrames, maxAnimationPixels = 5, 40*20*5
+	static := estimateDerivativeMemory("cat.gif", testAnimation(t, 40, 20, 1))
+	if memory := estimateDerivativeMemory("cat.gif", animation); memory != static+40*20*5 {
+		t.Fatalf("Expected %d bytes estimated for animation, got %d", static+40*20*5, memory)
+	}
+	maxAnimationFrames = 4
+	if memory := estimateDerivativeMemory("cat.gif", animation); memory != static {
+		t.Fatalf("Expected %d bytes estimated for animation made static, got %d", static, memory)
+	}
+}
+
+func TestAnimatedDerivativeStaysAnimated(t *testing.T) {
+	derivativeFilePath := path.Join(t.TempDir(), "cat.gif")
+	animated, err := makeAnimatedDerivative(context.Background(), "cat.gif", derivativeFilePath, testAnimation(t, 40, 20, 3), DerivativeParams{Width: 20, Fit: FitContain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !animated {
+		t.Fatal("Expected animated derivative to be made")
+	}
+
+	derivativeFile, err := os.Open(derivativeFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer derivativeFile.Close()
+	derivative, err := gif.DecodeAll(derivativeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(derivative.Image) != 3 || derivative.Config.Width != 20 || derivative.Config.Height != 10 {
+		t.Fatalf("Expected 3 frames of 20x10, got %d frames of %dx%d", len(derivative.Image), derivative.Config.Width, derivative.Config.Height)
+	}
+	for i, delay := range derivative.Delay {
+		if delay != 10*(i+1) {
+			t.Fatalf("Expected delay of frame %d to be kept, got %d", i, delay)
+		}
+	}
+
+	// Cropped derivatives are made from the first frame instead.
+	animated, err = makeAnimatedDerivative(context.Background(), "cat.gif", derivativeFilePath, testAnimation(t, 40, 20, 3), DerivativeParams{Width: 20, Height: 20, Fit: FitCover})
+	if err != nil || animated {
+		t.Fatalf("Expected no animated derivative when cropped, got %v and %v", animated, err)
+	}
+}
@@ -0,0 +1,345 @@
+package thumbnail
+
+import (
+	"container/list"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+// Derivatives are cached on disk once made, within a budget of bytes. When the budget is
+// exceeded, the least recently viewed derivatives are evicted in the background, to be
+// made again if viewed later. The most viewed derivatives are also kept in memory, so
+// that they can be served without reading the disk.
+
+const (
+	// Access times are only written to disk this often for each derivative, so that the
+	// order of use survives restarts without a write on every view.
+	accessTimePersistInterval = time.Minute
+)
+
+var (
+	cacheEvictionInterval = 5 * time.Minute
+	hotCacheMinViews      = 3
+	derivativeCache       = newCache(2*1024*1024*1024, 32*1024*1024)
+)
+
+func init() {
+	cacheEvictionIntervalParsed, err := time.ParseDuration(config.ConfigThumbnailCacheEvictionInterval)
+	if err == nil && cacheEvictionIntervalParsed > 0 {
+		cacheEvictionInterval = cacheEvictionIntervalParsed
+	}
+
+	hotCacheMinViewsParsed, err := strconv.Atoi(config.ConfigThumbnailHotCacheMinViews)
+	if err == nil && hotCacheMinViewsParsed > 0 {
+		hotCacheMinViews = hotCacheMinViewsParsed
+	}
+
+	cacheBudget, err := strconv.ParseInt(config.ConfigThumbnailCacheBudget, 10, 64)
+	if err != nil || cacheBudget <= 0 {
+		cacheBudget = derivativeCache.budget
+	}
+	hotCacheBudget, err := strconv.ParseInt(config.ConfigThumbnailHotCacheBudget, 10, 64)
+	if err != nil || hotCacheBudget < 0 {
+		hotCacheBudget = derivativeCache.hotBudget
+	}
+	derivativeCache = newCache(cacheBudget, hotCacheBudget)
+}
+
+// CacheStats describes the usage of the derivative cache.
+type CacheStats struct {
+	Files     int
+	Bytes     int64
+	Budget    int64
+	HotFiles  int
+	HotBytes  int64
+	HotBudget int64
+	Hits      int64 // Views served from disk
+	HotHits   int64 // Views served from memory
+	Misses    int64 // Views which needed a derivative to be made
+	Evictions int64
+}
+
+type cache struct {
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+	lru     *list.List // Of entry names, most recently viewed first
+	hotLRU  *list.List // Of entry names with content kept in memory
+	evict   chan struct{}
+
+	budget    int64
+	hotBudget int64
+	stats     CacheStats
+}
+
+type cacheEntry struct {
+	size      int64
+	accessed  time.Time
+	persisted time.Time // When the access time was last written to disk
+	views     int
+	element   *list.Element
+	hot       *list.Element
+	content   []byte // Only for entries in the hot tier
+}
+
+func newCache(budget, hotBudget int64) *cache {
+	return &cache{
+		entries:   map[string]*cacheEntry{},
+		lru:       list.New(),
+		hotLRU:    list.New(),
+		evict:     make(chan struct{}, 1),
+		budget:    budget,
+		hotBudget: hotBudget,
+	}
+}
+
+// StartCacheManager loads the derivatives already on disk into the cache, and evicts
+// derivatives over the budget in the background until the context is done.
+func StartCacheManager(ctx context.Context) error {
+	if err := derivativeCache.load(); err != nil {
+		slog.Error(ctx, "Could not load derivative cache from %s: %v", config.ConfigStorageDirectoryThumbnail, err)
+		return err
+	}
+
+	stats := derivativeCache.usage()
+	slog.Info(ctx, "Derivative cache holds %d files of %d bytes, within budget of %d bytes", stats.Files, stats.Bytes, stats.Budget)
+
+	go func() {
+		ticker := time.NewTicker(cacheEvictionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-derivativeCache.evict:
+			}
+			derivativeCache.evictOverBudget(ctx)
+		}
+	}()
+
+	return nil
+}
+
+// GetCacheStats returns the current usage of the derivative cache.
+func GetCacheStats() CacheStats {
+	return derivativeCache.usage()
+}
+
+// load adds derivatives on disk to the cache, ordered by when they were last viewed.
+func (c *cache) load() error {
+	thumbnailFiles, err := ioutil.ReadDir(config.ConfigStorageDirectoryThumbnail)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Files are listed by name, so are sorted by when they were last viewed to be added
+	// in order of access, most recent first.
+	sort.Slice(thumbnailFiles, func(i, j int) bool {
+		return thumbnailFiles[i].ModTime().After(thumbnailFiles[j].ModTime())
+	})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, thumbnailFile := range thumbnailFiles {
+		// Temporary files of derivatives being written are not cached yet.
+		if thumbnailFile.IsDir() || strings.HasPrefix(thumbnailFile.Name(), ".") {
+			continue
+		}
+		if _, found := c.entries[thumbnailFile.Name()]; found {
+			continue
+		}
+
+		c.entries[thumbnailFile.Name()] = &cacheEntry{
+			size:      thumbnailFile.Size(),
+			accessed:  thumbnailFile.ModTime(),
+			persisted: thumbnailFile.ModTime(),
+			element:   c.lru.PushBack(thumbnailFile.Name()),
+		}
+		c.stats.Bytes += thumbnailFile.Size()
+	}
+
+	return nil
+}
+
+// hotContent returns the derivative from memory if it is in the hot tier.
+func (c *cache) hotContent(name string) ([]byte, bool) {
+	c.mutex.Lock()
+	entry, found := c.entries[name]
+	if !found || entry.hot == nil {
+		c.mutex.Unlock()
+		return nil, false
+	}
+
+	persist := c.touch(entry)
+	c.stats.HotHits++
+	content := entry.content
+	c.mutex.Unlock()
+
+	persistAccessTime(name, persist)
+	return content, true
+}
+
+// viewed records a view of a derivative read from disk, and keeps it in memory if it has
+// been viewed often enough.
+func (c *cache) viewed(name string, content []byte) {
+	c.mutex.Lock()
+	c.stats.Hits++
+	entry, found := c.entries[name]
+	if !found {
+		// Made before the cache was loaded, or by a previous version.
+		c.add(name, int64(len(content)))
+		c.mutex.Unlock()
+		return
+	}
+
+	persist := c.touch(entry)
+	if entry.hot == nil && entry.views >= hotCacheMinViews && int64(len(content)) <= c.hotBudget {
+		entry.content = content
+		entry.hot = c.hotLRU.PushFront(name)
+		c.stats.HotBytes += int64(len(content))
+		for c.stats.HotBytes > c.hotBudget {
+			c.demote(c.entries[c.hotLRU.Back().Value.(string)])
+		}
+	}
+	c.mutex.Unlock()
+
+	persistAccessTime(name, persist)
+}
+
+// stored records a derivative just made.
+func (c *cache) stored(name string, size int64) {
+	c.mutex.Lock()
+	c.stats.Misses++
+	c.add(name, size)
+	overBudget := c.stats.Bytes > c.budget
+	c.mutex.Unlock()
+
+	if overBudget {
+		select {
+		case c.evict <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// removed forgets a derivative which has been removed from disk.
+func (c *cache) removed(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if entry, found := c.entries[name]; found {
+		c.remove(name, entry)
+	}
+}
+
+func (c *cache) usage() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Files = len(c.entries)
+	stats.HotFiles = c.hotLRU.Len()
+	stats.Budget = c.budget
+	stats.HotBudget = c.hotBudget
+
+	return stats
+}
+
+// evictOverBudget removes the least recently viewed derivatives from disk until the cache
+// is within its budget.
+func (c *cache) evictOverBudget(ctx context.Context) {
+	for {
+		c.mutex.Lock()
+		if c.stats.Bytes <= c.budget || c.lru.Len() == 0 {
+			c.mutex.Unlock()
+			return
+		}
+		name := c.lru.Back().Value.(string)
+		c.remove(name, c.entries[name])
+		c.stats.Evictions++
+		c.mutex.Unlock()
+
+		// Requests already reading the file keep their handle, while later requests will
+		// find it missing and make it again.
+		err := os.Remove(path.Join(config.ConfigStorageDirectoryThumbnail, name))
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error(ctx, "Could not evict derivative %s from cache: %v", name, err)
+		}
+	}
+}
+
+// persistAccessTime writes when the derivative was last viewed to its file, unless the
+// time is zero, so that the order of use survives restarts. Called without the mutex
+// held, so that views are not held up by each other's writes.
+func persistAccessTime(name string, accessed time.Time) {
+	if accessed.IsZero() {
+		return
+	}
+
+	// Best effort only, as the file may have been removed since.
+	os.Chtimes(path.Join(config.ConfigStorageDirectoryThumbnail, name), accessed, accessed)
+}
+
+// The following must be called with the mutex held.
+
+func (c *cache) add(name string, size int64) {
+	if entry, found := c.entries[name]; found {
+		c.remove(name, entry)
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		size:      size,
+		accessed:  now,
+		persisted: now,
+		element:   c.lru.PushFront(name),
+	}
+	c.entries[name] = entry
+	c.stats.Bytes += size
+}
+
+// touch records a view of the derivative, returning when it was viewed if the time is
+// due to be persisted, or zero otherwise.
+func (c *cache) touch(entry *cacheEntry) time.Time {
+	entry.views++
+	entry.accessed = time.Now()
+	c.lru.MoveToFront(entry.element)
+	if entry.hot != nil {
+		c.hotLRU.MoveToFront(entry.hot)
+	}
+
+	if entry.accessed.Sub(entry.persisted) <= accessTimePersistInterval {
+		return time.Time{}
+	}
+	entry.persisted = entry.accessed
+
+	return entry.accessed
+}
+
+func (c *cache) demote(entry *cacheEntry) {
+	c.hotLRU.Remove(entry.hot)
+	c.stats.HotBytes -= int64(len(entry.content))
+	entry.hot = nil
+	entry.content = nil
+}
+
+func (c *cache) remove(name string, entry *cacheEntry) {
+	if entry.hot != nil {
+		c.demote(entry)
+	}
+	c.lru.Remove(entry.element)
+	c.stats.Bytes -= entry.size
+	delete(c.entries, name)
+}
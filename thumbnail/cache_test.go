@@ -0,0 +1,105 @@
+package thumbnail
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+func TestCacheEvictsLeastRecentlyViewed(t *testing.T) {
+	config.ConfigStorageDirectoryThumbnail = t.TempDir()
+	testCache := newCache(300, 0)
+
+	for _, name := range []string{"a_public_thumb.png", "b_public_thumb.png", "c_public_thumb.png"} {
+		writeTestDerivative(t, name, 100)
+		testCache.stored(name, 100)
+	}
+
+	// Viewing the oldest makes the second oldest least recently viewed.
+	testCache.viewed("a_public_thumb.png", make([]byte, 100))
+	writeTestDerivative(t, "d_public_thumb.png", 100)
+	testCache.stored("d_public_thumb.png", 100)
+
+	testCache.evictOverBudget(context.Background())
+	assertDirectoryContents(t, config.ConfigStorageDirectoryThumbnail, "a_public_thumb.png", "c_public_thumb.png", "d_public_thumb.png")
+
+	stats := testCache.usage()
+	if stats.Files != 3 || stats.Bytes != 300 || stats.Evictions != 1 || stats.Misses != 4 || stats.Hits != 1 {
+		t.Fatalf("Unexpected cache stats after eviction: %+v", stats)
+	}
+}
+
+func TestCacheKeepsMostViewedInMemory(t *testing.T) {
+	config.ConfigStorageDirectoryThumbnail = t.TempDir()
+	testCache := newCache(1000, 150)
+
+	testCache.stored("a_public_thumb.png", 100)
+	testCache.stored("b_public_thumb.png", 100)
+
+	for i := 0; i < hotCacheMinViews; i++ {
+		if _, found := testCache.hotContent("a_public_thumb.png"); found {
+			t.Fatalf("Derivative should not be in memory after %d views", i)
+		}
+		testCache.viewed("a_public_thumb.png", make([]byte, 100))
+	}
+
+	content, found := testCache.hotContent("a_public_thumb.png")
+	if !found || len(content) != 100 {
+		t.Fatal("Most viewed derivative should be kept in memory")
+	}
+
+	// Promoting another derivative over the memory budget demotes the least recently viewed.
+	for i := 0; i < hotCacheMinViews; i++ {
+		testCache.viewed("b_public_thumb.png", make([]byte, 100))
+	}
+	if _, found := testCache.hotContent("a_public_thumb.png"); found {
+		t.Fatal("Least recently viewed derivative should be demoted from memory")
+	}
+	if _, found := testCache.hotContent("b_public_thumb.png"); !found {
+		t.Fatal("Most recently promoted derivative should be in memory")
+	}
+
+	testCache.removed("b_public_thumb.png")
+	if _, found := testCache.hotContent("b_public_thumb.png"); found {
+		t.Fatal("Removed derivative should not be served from memory")
+	}
+
+	stats := testCache.usage()
+	if stats.Files != 1 || stats.Bytes != 100 || stats.HotFiles != 0 || stats.HotBytes != 0 {
+		t.Fatalf("Unexpected cache stats after removal: %+v", stats)
+	}
+}
+
+func TestCacheLoadsInOrderOfAccess(t *testing.T) {
+	config.ConfigStorageDirectoryThumbnail = t.TempDir()
+	testCache := newCache(200, 0)
+
+	now := time.Now()
+	for i, name := range []string{"c_public_thumb.png", "a_public_thumb.png", "b_public_thumb.png"} {
+		writeTestDerivative(t, name, 100)
+		accessed := now.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path.Join(config.ConfigStorageDirectoryThumbnail, name), accessed, accessed); err != nil {
+			t.Fatalf("Could not set access time: %v", err)
+		}
+	}
+	writeTestDerivative(t, ".a_public_thumb.png.tmp-1", 100)
+
+	if err := testCache.load(); err != nil {
+		t.Fatalf("Unexpected error loading cache: %v", err)
+	}
+
+	testCache.evictOverBudget(context.Background())
+	assertDirectoryContents(t, config.ConfigStorageDirectoryThumbnail, ".a_public_thumb.png.tmp-1", "a_public_thumb.png", "b_public_thumb.png")
+}
+
+func writeTestDerivative(t *testing.T, name string, size int) {
+	t.Helper()
+
+	if err := os.WriteFile(path.Join(config.ConfigStorageDirectoryThumbnail, name), make([]byte, size), 0644); err != nil {
+		t.Fatalf("Could not write test derivative %s: %v", name, err)
+	}
+}
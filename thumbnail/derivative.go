@@ -0,0 +1,262 @@
+package thumbnail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+const (
+	FitContain = "contain" // Scale to fit within the width and height, keeping aspect ratio
+	FitCover   = "cover"   // Scale to cover the width and height, then crop any excess
+	FitCrop    = "crop"    // Crop to the width and height without scaling
+
+	GravityCenter    = "center"
+	GravityNorth     = "north"
+	GravitySouth     = "south"
+	GravityEast      = "east"
+	GravityWest      = "west"
+	GravityNorthEast = "northeast"
+	GravityNorthWest = "northwest"
+	GravitySouthEast = "southeast"
+	GravitySouthWest = "southwest"
+)
+
+var (
+	maxDerivativeDimension = 4096
+	derivativePresets      = map[string]DerivativeParams{}
+)
+
+func init() {
+	maxDerivativeDimensionParsed, err := strconv.ParseInt(config.ConfigDerivativeMaxDimension, 10, 32)
+	if err == nil {
+		maxDerivativeDimension = int(maxDerivativeDimensionParsed)
+	}
+
+	// Presets are configured as name:widthxheight:fit[:gravity], separated by "|".
+	for _, preset := range strings.Split(config.ConfigDerivativePresets, "|") {
+		presetComponents := strings.Split(preset, ":")
+		if len(presetComponents) < 3 {
+			continue
+		}
+
+		dimensions := strings.SplitN(presetComponents[1], "x", 2)
+		if len(dimensions) != 2 {
+			continue
+		}
+		width, widthErr := strconv.Atoi(dimensions[0])
+		height, heightErr := strconv.Atoi(dimensions[1])
+		if widthErr != nil || heightErr != nil {
+			continue
+		}
+
+		params := DerivativeParams{
+			Width:  width,
+			Height: height,
+			Fit:    presetComponents[2],
+		}
+		if len(presetComponents) > 3 {
+			params.Gravity = presetComponents[3]
+		}
+		if params.Validate() != nil {
+			continue
+		}
+
+		derivativePresets[presetComponents[0]] = params
+	}
+}
+
+// DerivativeParams describe how a derivative of an image is resized or cropped. A zero
+// width or height leaves that dimension to be determined by the aspect ratio, which is
+// only possible when the image is scaled to fit.
+type DerivativeParams struct {
+	Width   int
+	Height  int
+	Fit     string
+	Gravity string
+}
+
+// PresetDerivativeParams returns the parameters of a configured derivative preset.
+func PresetDerivativeParams(preset string) (DerivativeParams, bool) {
+	params, found := derivativePresets[preset]
+	return params, found
+}
+
+// DerivativePresetNames returns the names of configured derivative presets, sorted.
+func DerivativePresetNames() []string {
+	presetNames := []string{}
+	for preset := range derivativePresets {
+		presetNames = append(presetNames, preset)
+	}
+	sort.Strings(presetNames)
+
+	return presetNames
+}
+
+// Validate returns a client error if the parameters do not describe a derivative we
+// can make, and fills in defaults for any parameters not specified.
+func (p *DerivativeParams) Validate() error {
+	if p.Fit == "" {
+		p.Fit = FitContain
+	}
+	if p.Gravity == "" {
+		p.Gravity = GravityCenter
+	}
+
+	if p.Width < 0 || p.Height < 0 || p.Width > maxDerivativeDimension || p.Height > maxDerivativeDimension {
+		return terrors.BadRequest("invalid_derivative", fmt.Sprintf("Derivative dimensions must be between 0 and %d", maxDerivativeDimension), nil)
+	}
+
+	switch p.Fit {
+	case FitContain:
+		if p.Width == 0 && p.Height == 0 {
+			return terrors.BadRequest("invalid_derivative", "Derivative width or height is required", nil)
+		}
+	case FitCover, FitCrop:
+		if p.Width == 0 || p.Height == 0 {
+			return terrors.BadRequest("invalid_derivative", fmt.Sprintf("Derivative width and height are both required to %s", p.Fit), nil)
+		}
+	default:
+		return terrors.BadRequest("invalid_derivative", fmt.Sprintf("Derivative fit %s is invalid", p.Fit), nil)
+	}
+
+	if _, _, valid := gravityAnchor(p.Gravity); !valid {
+		return terrors.BadRequest("invalid_derivative", fmt.Sprintf("Derivative gravity %s is invalid", p.Gravity), nil)
+	}
+
+	return nil
+}
+
+// Canonical returns the parameters encoded in a fixed order, for signing and caching.
+func (p DerivativeParams) Canonical() string {
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&gravity=%s", p.Width, p.Height, p.Fit, p.Gravity)
+}
+
+// key identifies derivatives made with the parameters among others of the same image.
+func (p DerivativeParams) key() string {
+	paramsHash := sha256.Sum256([]byte(p.Canonical()))
+	return fmt.Sprintf("d%s", hex.EncodeToString(paramsHash[:8]))
+}
+
+// containWidth returns the width an image of the given dimensions is scaled to, when
+// scaled to fit within the width and height of the parameters.
+func (p DerivativeParams) containWidth(width, height int) int {
+	scale := p.containScale(width, height)
+	return maxInt(int(math.Round(float64(width)*scale)), 1)
+}
+
+// ContainDimensions returns the dimensions an image of the given dimensions is scaled to,
+// when scaled to fit within the width and height of the parameters.
+func (p DerivativeParams) ContainDimensions(width, height int) (int, int) {
+	scale := p.containScale(width, height)
+	return maxInt(scaleDimension(width, scale), 1), maxInt(scaleDimension(height, scale), 1)
+}
+
+func (p DerivativeParams) containScale(width, height int) float64 {
+	widthScale := float64(p.Width) / float64(width)
+	heightScale := float64(p.Height) / float64(height)
+	switch {
+	case p.Width == 0:
+		return heightScale
+	case p.Height == 0:
+		return widthScale
+	}
+
+	return math.Min(widthScale, heightScale)
+}
+
+// resizeImage makes a derivative of the image according to the parameters. The image may
+// have been decoded at a reduced size, so its dimensions as stored are given, which the
+// dimensions of the derivative follow from.
+func resizeImage(img image.Image, width, height int, params DerivativeParams) image.Image {
+	scaledWidth, scaledHeight, scaled := params.scaledDimensions(width, height)
+	if !scaled {
+		return cropImage(img, params.Width, params.Height, params.Gravity)
+	}
+
+	img = scaleImage(img, scaledWidth, scaledHeight)
+	if params.Fit == FitCover {
+		return cropImage(img, params.Width, params.Height, params.Gravity)
+	}
+
+	return img
+}
+
+// scaledDimensions returns the dimensions an image of the given dimensions is scaled to
+// when making the derivative, before any cropping, or false if it is cropped unscaled.
+func (p DerivativeParams) scaledDimensions(width, height int) (int, int, bool) {
+	switch p.Fit {
+	case FitCover:
+		scale := math.Max(float64(p.Width)/float64(width), float64(p.Height)/float64(height))
+		scaledWidth := maxInt(int(math.Ceil(float64(width)*scale)), p.Width)
+		scaledHeight := maxInt(int(math.Ceil(float64(height)*scale)), p.Height)
+		return scaledWidth, scaledHeight, true
+	case FitCrop:
+		return 0, 0, false
+	}
+
+	scaledWidth, scaledHeight := p.ContainDimensions(width, height)
+	return scaledWidth, scaledHeight, true
+}
+
+// cropImage cuts a region of the given size out of the image, positioned according to
+// the gravity. Images smaller than the region are not padded.
+func cropImage(img image.Image, width, height int, gravity string) image.Image {
+	bounds := img.Bounds()
+	width = minInt(width, bounds.Dx())
+	height = minInt(height, bounds.Dy())
+
+	anchorX, anchorY, _ := gravityAnchor(gravity)
+	offsetX := int(math.Round(float64(bounds.Dx()-width) * anchorX))
+	offsetY := int(math.Round(float64(bounds.Dy()-height) * anchorY))
+	region := image.Rect(0, 0, width, height).Add(bounds.Min).Add(image.Pt(offsetX, offsetY))
+
+	cropped := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(cropped, cropped.Bounds(), img, region.Min, draw.Src)
+
+	return cropped
+}
+
+// gravityAnchor returns the relative position of a cropped region along each axis.
+func gravityAnchor(gravity string) (float64, float64, bool) {
+	switch gravity {
+	case GravityCenter:
+		return 0.5, 0.5, true
+	case GravityNorth:
+		return 0.5, 0, true
+	case GravitySouth:
+		return 0.5, 1, true
+	case GravityEast:
+		return 1, 0.5, true
+	case GravityWest:
+		return 0, 0.5, true
+	case GravityNorthEast:
+		return 1, 0, true
+	case GravityNorthWest:
+		return 0, 0, true
+	case GravitySouthEast:
+		return 1, 1, true
+	case GravitySouthWest:
+		return 0, 1, true
+	}
+
+	return 0, 0, false
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
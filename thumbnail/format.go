@@ -0,0 +1,224 @@
+package thumbnail
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+// Images can be converted into another format as they are served, either when requested
+// explicitly or when clients say they do not accept the format the image would otherwise
+// be served in. Converted images are cached alongside thumbnails, under names ending in
+// the extension of the format they were converted into.
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+)
+
+var (
+	jpegQuality = 85
+
+	// In order of preference when clients accept several equally.
+	convertibleFormats = []string{FormatJPEG, FormatPNG, FormatGIF}
+)
+
+func init() {
+	jpegQualityParsed, err := strconv.Atoi(config.ConfigJPEGQuality)
+	if err == nil && jpegQualityParsed >= 1 && jpegQualityParsed <= 100 {
+		jpegQuality = jpegQualityParsed
+	}
+}
+
+// Rendition describes how an image is served other than as it is stored: resized,
+// watermarked or converted into another format, or any combination of these.
+type Rendition struct {
+	Params      DerivativeParams // Resizing or cropping, or empty to keep the original size
+	Thumbnail   bool             // Resized as the thumbnail, in place of Params
+	Watermarked bool
+	Format      string // Format to convert into, or empty for the format thumbnails of the image are in
+}
+
+// key identifies renditions made in the same way among others of the same image. The
+// format is not part of the key, as it is kept in the extension of cached renditions.
+func (r Rendition) key() string {
+	key := originalKey
+	switch {
+	case r.Thumbnail:
+		key = thumbnailKey
+	case r.Params != (DerivativeParams{}):
+		key = r.Params.key()
+	}
+
+	if r.Watermarked {
+		key = watermarkKey(key)
+	}
+
+	return key
+}
+
+// params returns how the rendition is resized or cropped, which is empty if it is not.
+func (r Rendition) params() DerivativeParams {
+	if r.Thumbnail {
+		return thumbnailParams
+	}
+
+	return r.Params
+}
+
+// GetRenditionForImage returns the rendition of the image, which is cached alongside
+// thumbnails once made.
+func GetRenditionForImage(ctx context.Context, fileName, storagePath, accessType string, rendition Rendition) ([]byte, error) {
+	if !rendition.Thumbnail && rendition.Params != (DerivativeParams{}) {
+		if err := rendition.Params.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if rendition.Format != "" {
+		format, err := ParseFormat(rendition.Format)
+		if err != nil {
+			return nil, err
+		}
+
+		// Renditions in the format they would be in anyway are the same as without one.
+		rendition.Format = format
+		if RenditionContentType(fileName, format) == ThumbnailContentType(fileName) {
+			rendition.Format = ""
+		}
+	}
+
+	return getDerivative(ctx, fileName, storagePath, accessType, rendition)
+}
+
+// ParseFormat returns the format images can be converted into by the given name, or a
+// client error if they cannot be converted into it.
+func ParseFormat(format string) (string, error) {
+	format = strings.ToLower(format)
+	if format == "jpg" {
+		format = FormatJPEG
+	}
+
+	for _, convertibleFormat := range convertibleFormats {
+		if format == convertibleFormat {
+			return format, nil
+		}
+	}
+
+	return "", terrors.BadRequest("invalid_format", fmt.Sprintf("Images can only be converted into %s", strings.Join(convertibleFormats, ", ")), nil)
+}
+
+// FormatContentType returns the HTTP content type of images in the format.
+func FormatContentType(format string) string {
+	return config.FileExtensionToContentType(format)
+}
+
+// RenditionContentType returns the HTTP content type of renditions of the image in the
+// format, or in the format of its thumbnails if not specified.
+func RenditionContentType(fileName, format string) string {
+	if format == "" {
+		return ThumbnailContentType(fileName)
+	}
+
+	return FormatContentType(format)
+}
+
+// renditionExtension returns the extension of the format renditions of images with the
+// given extension are encoded in.
+func renditionExtension(extension, format string) string {
+	if format != "" {
+		return format
+	}
+
+	return thumbnailExtension(extension)
+}
+
+// NegotiateFormat returns the format to convert an image into for a client sending the
+// Accept header, if the client does not accept the content type it would be served in.
+// The format the client prefers is chosen, or the first we support if several are equally
+// preferred. Nothing is returned if the client accepts none we can convert into, as
+// serving the image as it is is more useful than serving nothing.
+func NegotiateFormat(accept, contentType string) string {
+	if accept == "" {
+		return ""
+	}
+
+	type mediaRange struct {
+		mediaType string
+		quality   float64
+	}
+	mediaRanges := []mediaRange{}
+	for _, acceptedRange := range strings.Split(accept, ",") {
+		parameters := strings.Split(acceptedRange, ";")
+		accepted := mediaRange{mediaType: strings.ToLower(strings.TrimSpace(parameters[0])), quality: 1}
+		for _, parameter := range parameters[1:] {
+			name, value, found := strings.Cut(strings.TrimSpace(parameter), "=")
+			if !found || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil {
+				accepted.quality = quality
+			}
+		}
+		mediaRanges = append(mediaRanges, accepted)
+	}
+
+	// The most specific range matching a content type determines its quality.
+	qualityOf := func(contentType string) float64 {
+		quality, specificity := 0.0, -1
+		for _, accepted := range mediaRanges {
+			matched := -1
+			switch {
+			case accepted.mediaType == contentType:
+				matched = 2
+			case accepted.mediaType == strings.SplitN(contentType, "/", 2)[0]+"/*":
+				matched = 1
+			case accepted.mediaType == "*/*":
+				matched = 0
+			}
+			if matched > specificity {
+				quality, specificity = accepted.quality, matched
+			}
+		}
+		return quality
+	}
+
+	if qualityOf(contentType) > 0 {
+		return ""
+	}
+
+	candidates := []string{}
+	for _, format := range convertibleFormats {
+		if qualityOf(FormatContentType(format)) > 0 {
+			candidates = append(candidates, format)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return qualityOf(FormatContentType(candidates[i])) > qualityOf(FormatContentType(candidates[j]))
+	})
+
+	return candidates[0]
+}
+
+// isOpaque returns whether the image has no transparent pixels, so that it can be encoded
+// in formats without transparency as it is.
+func isOpaque(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return opaque.Opaque()
+	}
+
+	return false
+}
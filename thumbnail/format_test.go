@@ -0,0 +1,120 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	for _, testCase := range []struct {
+		accept      string
+		contentType string
+		expected    string
+	}{
+		{"", "image/webp", ""},
+		{"image/avif,image/webp,*/*;q=0.8", "image/webp", ""},
+		{"image/*", "image/webp", ""},
+		{"image/png,image/jpeg", "image/webp", FormatJPEG},
+		{"image/png,image/jpeg;q=0.5", "image/webp", FormatPNG},
+		{"image/webp;q=0,image/*;q=0.5", "image/webp", FormatJPEG},
+		{"image/gif", "image/png", FormatGIF},
+		{"text/html", "image/png", ""},
+		{"image/jpeg;q=0, image/png ; q=0.9", "image/jpeg", FormatPNG},
+	} {
+		if format := NegotiateFormat(testCase.accept, testCase.contentType); format != testCase.expected {
+			t.Fatalf("Expected format %q for %s accepting %q, got %q", testCase.expected, testCase.contentType, testCase.accept, format)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for name, expected := range map[string]string{"jpg": FormatJPEG, "JPEG": FormatJPEG, "png": FormatPNG, "gif": FormatGIF} {
+		if format, err := ParseFormat(name); err != nil || format != expected {
+			t.Fatalf("Expected format %s for %s, got %s, %v", expected, name, format, err)
+		}
+	}
+
+	for _, name := range []string{"webp", "svg", ""} {
+		if _, err := ParseFormat(name); err == nil {
+			t.Fatalf("Expected error parsing format %q", name)
+		}
+	}
+}
+
+func TestConvertedRenditions(t *testing.T) {
+	storagePath := t.TempDir()
+	config.ConfigStorageDirectoryThumbnail = path.Join(t.TempDir(), "thumbnail")
+
+	// Transparent on the left, red on the right.
+	original := image.NewNRGBA(image.Rect(0, 0, 1000, 500))
+	for x := 500; x < 1000; x++ {
+		for y := 0; y < 500; y++ {
+			original.Set(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, original); err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+	if err := os.WriteFile(path.Join(storagePath, "image.png"), encoded.Bytes(), 0644); err != nil {
+		t.Fatalf("Could not write test image: %v", err)
+	}
+
+	ctx := context.Background()
+	converted, err := GetRenditionForImage(ctx, "image.png", storagePath, "public", Rendition{Format: "jpg"})
+	if err != nil {
+		t.Fatalf("Unexpected error converting image: %v", err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(converted))
+	if err != nil {
+		t.Fatalf("Converted image is not a JPEG: %v", err)
+	}
+	if decoded.Bounds().Dx() != 1000 || decoded.Bounds().Dy() != 500 {
+		t.Fatalf("Expected converted image at original size, got %v", decoded.Bounds())
+	}
+
+	// Transparent pixels are flattened onto white, rather than turning black.
+	if r, g, b, _ := decoded.At(100, 100).RGBA(); r>>8 < 250 || g>>8 < 250 || b>>8 < 250 {
+		t.Fatalf("Expected transparent pixels to be white, got %v", decoded.At(100, 100))
+	}
+	if r, g, _, _ := decoded.At(900, 100).RGBA(); r>>8 < 240 || g>>8 > 15 {
+		t.Fatalf("Expected red pixels to stay red, got %v", decoded.At(900, 100))
+	}
+
+	convertedThumbnail, err := GetRenditionForImage(ctx, "image.png", storagePath, "public", Rendition{Thumbnail: true, Format: FormatJPEG})
+	if err != nil {
+		t.Fatalf("Unexpected error converting thumbnail: %v", err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(convertedThumbnail)); err != nil {
+		t.Fatalf("Converted thumbnail is not a JPEG: %v", err)
+	}
+
+	// Renditions in the format they would be in anyway are not converted again.
+	if _, err := GetRenditionForImage(ctx, "image.png", storagePath, "public", Rendition{Thumbnail: true, Format: FormatPNG}); err != nil {
+		t.Fatalf("Unexpected error making thumbnail: %v", err)
+	}
+
+	assertDirectoryContents(t, config.ConfigStorageDirectoryThumbnail,
+		"image_public_original_png.jpeg",
+		"image_public_thumb.png",
+		"image_public_thumb_png.jpeg",
+	)
+
+	if _, err := GetRenditionForImage(ctx, "image.png", storagePath, "public", Rendition{Format: "webp"}); err == nil {
+		t.Fatal("Expected error converting into a format we cannot encode")
+	}
+
+	if err := InvalidateDerivatives(ctx, "image.png", "public"); err != nil {
+		t.Fatalf("Unexpected error invalidating derivatives: %v", err)
+	}
+	assertDirectoryContents(t, config.ConfigStorageDirectoryThumbnail)
+}
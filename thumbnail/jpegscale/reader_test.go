@@ -0,0 +1,128 @@
+package jpegscale
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// testImage draws smooth gradients, which survive compression closely enough to compare
+// reduced images against the full image reduced after decoding.
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: uint8((x + y) * 255 / (width + height)),
+				A: 255,
+			})
+		}
+	}
+
+	return img
+}
+
+func encodeTestJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded.Bytes()
+}
+
+func grayImage(img image.Image) *image.Gray {
+	gray := image.NewGray(img.Bounds())
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			gray.Set(x, y, img.At(x, y))
+		}
+	}
+
+	return gray
+}
+
+func TestDecodeFullSize(t *testing.T) {
+	for _, source := range []image.Image{testImage(101, 67), grayImage(testImage(101, 67))} {
+		encoded := encodeTestJPEG(t, source)
+		expected, err := jpeg.Decode(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := Decode(bytes.NewReader(encoded), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Bounds() != expected.Bounds() {
+			t.Fatalf("Expected bounds %v decoding at full size, got %v", expected.Bounds(), decoded.Bounds())
+		}
+		for y := 0; y < expected.Bounds().Dy(); y++ {
+			for x := 0; x < expected.Bounds().Dx(); x++ {
+				if decoded.At(x, y) != expected.At(x, y) {
+					t.Fatalf("Expected %v at (%d, %d) decoding at full size, got %v", expected.At(x, y), x, y, decoded.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeReduced(t *testing.T) {
+	for _, source := range []image.Image{testImage(203, 131), grayImage(testImage(203, 131))} {
+		encoded := encodeTestJPEG(t, source)
+		full, err := jpeg.Decode(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, denominator := range []int{2, 4, 8} {
+			decoded, err := Decode(bytes.NewReader(encoded), denominator)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			width, height := (203+denominator-1)/denominator, (131+denominator-1)/denominator
+			if decoded.Bounds() != image.Rect(0, 0, width, height) {
+				t.Fatalf("Expected %dx%d decoding at 1/%d, got %v", width, height, denominator, decoded.Bounds())
+			}
+
+			// Each pixel is the mean of those it is reduced from, other than along edges
+			// reduced from fewer pixels. Only brightness is compared, as colour is also
+			// subsampled by the encoder, at half the resolution again.
+			for y := 0; y < height-1; y++ {
+				for x := 0; x < width-1; x++ {
+					sum := 0
+					for yy := y * denominator; yy < (y+1)*denominator; yy++ {
+						for xx := x * denominator; xx < (x+1)*denominator; xx++ {
+							sum += int(color.GrayModel.Convert(full.At(xx, yy)).(color.Gray).Y)
+						}
+					}
+					mean := sum / (denominator * denominator)
+					brightness := int(color.GrayModel.Convert(decoded.At(x, y)).(color.Gray).Y)
+					if difference := brightness - mean; difference < -3 || difference > 3 {
+						t.Fatalf("Expected brightness at (%d, %d) decoding at 1/%d to be about %d, got %d", x, y, denominator, mean, brightness)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	encoded := encodeTestJPEG(t, testImage(16, 16))
+	if _, err := Decode(bytes.NewReader(encoded), 3); err == nil {
+		t.Fatal("Expected decoding at 1/3 to be unsupported")
+	}
+	if _, err := Decode(bytes.NewReader(encoded[:len(encoded)/2]), 2); err == nil {
+		t.Fatal("Expected truncated image to not be decoded")
+	}
+	if _, err := Decode(bytes.NewReader([]byte("not a jpeg")), 2); err == nil {
+		t.Fatal("Expected invalid image to not be decoded")
+	}
+}
@@ -0,0 +1,228 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/yronwood/metadata"
+)
+
+// Clients show placeholders while images load: a BlurHash (https://blurha.sh) which
+// decodes into a blurred preview, and the dominant colour for a plain tile. Both are
+// made from the thumbnail rather than the image, as they only need a few pixels.
+
+const (
+	placeholderSampleWidth = 32
+	base83Characters       = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// describePlaceholders records placeholders of the image from its thumbnail, unless they
+// have been recorded already.
+func describePlaceholders(ctx context.Context, fileName, accessType string, thumbnail []byte) error {
+	record, err := metadata.Get(ctx, fileName, accessType)
+	if err != nil {
+		return err
+	}
+	if record.BlurHash != "" && record.DominantColour != "" {
+		return nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(thumbnail))
+	if err != nil {
+		slog.Debug(ctx, "Could not decode thumbnail of %s for placeholders: %v", fileName, err)
+		return err
+	}
+
+	bounds := img.Bounds()
+	sample := scaleImage(img, placeholderSampleWidth, maxInt(bounds.Dy()*placeholderSampleWidth/bounds.Dx(), 1))
+	blurHash := encodeBlurHash(sample)
+	dominantColour := findDominantColour(sample)
+
+	return metadata.Update(ctx, fileName, accessType, func(record *metadata.Record) {
+		record.BlurHash = blurHash
+		record.DominantColour = dominantColour
+	})
+}
+
+// clearPlaceholders forgets the placeholders of an image whose content has changed.
+func clearPlaceholders(ctx context.Context, fileName, accessType string) error {
+	record, err := metadata.Get(ctx, fileName, accessType)
+	if err != nil {
+		return err
+	}
+	if record.BlurHash == "" && record.DominantColour == "" && !record.PlaceholderFailed {
+		return nil
+	}
+
+	return metadata.Update(ctx, fileName, accessType, func(record *metadata.Record) {
+		record.BlurHash = ""
+		record.DominantColour = ""
+		record.PlaceholderFailed = false
+	})
+}
+
+// recordPlaceholdersFailed notes that placeholders of the image could not be made, so that
+// it is not queued for them again until its content changes.
+func recordPlaceholdersFailed(ctx context.Context, fileName, accessType string) error {
+	return metadata.Update(ctx, fileName, accessType, func(record *metadata.Record) {
+		record.PlaceholderFailed = true
+	})
+}
+
+// encodeBlurHash encodes the image into a BlurHash, with more horizontal components for
+// landscape images and more vertical components for portrait images.
+func encodeBlurHash(img image.Image) string {
+	xComponents, yComponents := 4, 3
+	if img.Bounds().Dy() > img.Bounds().Dx() {
+		xComponents, yComponents = 3, 4
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Linear RGB of every pixel, converted once rather than for every component.
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b := opaqueRGB(img, bounds.Min.X+x, bounds.Min.Y+y)
+			pixels[y*width+x] = [3]float64{srgbToLinear(r), srgbToLinear(g), srgbToLinear(b)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			factor := [3]float64{}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * pixels[y*width+x][c]
+					}
+				}
+			}
+
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximumValue := 0.0
+		for _, factor := range factors[1:] {
+			for c := 0; c < 3; c++ {
+				actualMaximumValue = math.Max(actualMaximumValue, math.Abs(factor[c]))
+			}
+		}
+		quantisedMaximumValue := int(math.Max(0, math.Min(82, math.Floor(actualMaximumValue*166-0.5))))
+		maximumValue = float64(quantisedMaximumValue+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximumValue, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+	for _, factor := range factors[1:] {
+		quantised := [3]int{}
+		for c := 0; c < 3; c++ {
+			quantised[c] = int(math.Max(0, math.Min(18, math.Floor(signedPow(factor[c]/maximumValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quantised[0]*19*19+quantised[1]*19+quantised[2], 2))
+	}
+
+	return hash.String()
+}
+
+// findDominantColour returns the most common colour of the image as #rrggbb, counting
+// similar colours together so that noise and gradients don't split them apart.
+func findDominantColour(img image.Image) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+
+	buckets := map[int]*bucket{}
+	var dominant *bucket
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b := opaqueRGB(img, x, y)
+			key := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+			if buckets[key] == nil {
+				buckets[key] = &bucket{}
+			}
+
+			current := buckets[key]
+			current.count++
+			current.r += int(r)
+			current.g += int(g)
+			current.b += int(b)
+			if dominant == nil || current.count > dominant.count {
+				dominant = current
+			}
+		}
+	}
+
+	if dominant == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", dominant.r/dominant.count, dominant.g/dominant.count, dominant.b/dominant.count)
+}
+
+// opaqueRGB returns the 8-bit colour of the pixel as it appears over a white background.
+func opaqueRGB(img image.Image, x, y int) (uint8, uint8, uint8) {
+	r, g, b, a := img.At(x, y).RGBA()
+	transparency := 0xffff - a
+
+	return uint8((r + transparency) >> 8), uint8((g + transparency) >> 8), uint8((b + transparency) >> 8)
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signedPow(value, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exponent), value)
+}
+
+func encodeBase83(value, length int) string {
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = base83Characters[value%83]
+		value /= 83
+	}
+
+	return string(encoded)
+}
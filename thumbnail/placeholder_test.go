@@ -0,0 +1,65 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestBlurHashOfSolidColour(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+
+	blurHash := encodeBlurHash(img)
+
+	// 4x3 components for landscape images, with the average colour encoded as sRGB.
+	if len(blurHash) != 28 || blurHash[0] != 'L' {
+		t.Fatalf("Expected 4x3 BlurHash, got %s", blurHash)
+	}
+	if averageColour := blurHash[2:6]; averageColour != encodeBase83(0xff0000, 4) {
+		t.Fatalf("Expected BlurHash %s to have red as average colour", blurHash)
+	}
+}
+
+func TestBlurHashComponentsFollowOrientation(t *testing.T) {
+	landscape := encodeBlurHash(gradientImage(32, 16))
+	portrait := encodeBlurHash(gradientImage(16, 32))
+
+	if len(landscape) != 28 || landscape[0] != 'L' {
+		t.Fatalf("Expected 4x3 BlurHash for landscape image, got %s", landscape)
+	}
+	if len(portrait) != 28 || portrait[0] != 'T' {
+		t.Fatalf("Expected 3x4 BlurHash for portrait image, got %s", portrait)
+	}
+}
+
+func TestDominantColour(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0, 0, 200, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 3, 10), image.NewUniform(color.RGBA{200, 0, 0, 255}), image.Point{}, draw.Src)
+
+	// Similar shades are counted together.
+	img.Set(9, 9, color.RGBA{0, 0, 204, 255})
+
+	if dominantColour := findDominantColour(img); dominantColour != "#0000c8" {
+		t.Fatalf("Expected dominant colour #0000c8, got %s", dominantColour)
+	}
+
+	// Transparent pixels are seen as over white.
+	transparent := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	if dominantColour := findDominantColour(transparent); dominantColour != "#ffffff" {
+		t.Fatalf("Expected transparent image to be white, got %s", dominantColour)
+	}
+}
+
+func gradientImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+
+	return img
+}
@@ -0,0 +1,260 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/metadata"
+)
+
+// Thumbnails are made ahead of being viewed by a small pool of workers, so that a gallery
+// view after a bulk upload does not start resizing every image at once. Making any
+// derivative, whether by a worker or on demand by a view, is also limited by an estimate
+// of the memory it needs, as decoded images are far larger than their files.
+
+var (
+	thumbnailWorkers          = 2
+	thumbnailQueue            = make(chan thumbnailJob, 1000)
+	thumbnailWorkersStartOnce = sync.Once{}
+	derivativeMemory          = newMemorySemaphore(512 * 1024 * 1024)
+
+	// Images queued and not yet made, so that images listed again while queued are not
+	// queued again.
+	queuedThumbnailsMutex sync.Mutex
+	queuedThumbnails      = map[thumbnailJob]bool{}
+)
+
+func init() {
+	thumbnailWorkersParsed, err := strconv.Atoi(config.ConfigThumbnailWorkers)
+	if err == nil && thumbnailWorkersParsed > 0 {
+		thumbnailWorkers = thumbnailWorkersParsed
+	}
+
+	thumbnailQueueSizeParsed, err := strconv.Atoi(config.ConfigThumbnailQueueSize)
+	if err == nil && thumbnailQueueSizeParsed > 0 {
+		thumbnailQueue = make(chan thumbnailJob, thumbnailQueueSizeParsed)
+	}
+
+	derivativeMemoryBudgetParsed, err := strconv.ParseInt(config.ConfigDerivativeMemoryBudget, 10, 64)
+	if err == nil && derivativeMemoryBudgetParsed > 0 {
+		derivativeMemory = newMemorySemaphore(derivativeMemoryBudgetParsed)
+	}
+}
+
+type thumbnailJob struct {
+	fileName    string
+	storagePath string
+	accessType  string
+}
+
+// StartWorkers starts the pool of workers making thumbnails of queued images. Workers stop
+// when the context is done; calling this again has no effect.
+func StartWorkers(ctx context.Context) {
+	thumbnailWorkersStartOnce.Do(func() {
+		slog.Info(ctx, "Starting %d thumbnail workers", thumbnailWorkers)
+		for i := 0; i < thumbnailWorkers; i++ {
+			go runThumbnailWorker(ctx)
+		}
+	})
+}
+
+func runThumbnailWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-thumbnailQueue:
+			makeQueuedThumbnail(ctx, job)
+			dequeued(job)
+		}
+	}
+}
+
+// makeQueuedThumbnail makes the thumbnail and placeholders of a queued image, recording
+// if placeholders could not be made so that the image is not queued for them again.
+func makeQueuedThumbnail(ctx context.Context, job thumbnailJob) {
+	thumbnail, err := GetThumbnailForImage(ctx, job.fileName, job.storagePath, job.accessType)
+	if err != nil {
+		slog.Error(ctx, "Could not make queued thumbnail of image %s of access type %s: %v", job.fileName, job.accessType, err)
+	} else if err = describePlaceholders(ctx, job.fileName, job.accessType, thumbnail); err != nil {
+		slog.Error(ctx, "Could not make placeholders of image %s of access type %s: %v", job.fileName, job.accessType, err)
+	}
+	if err == nil {
+		return
+	}
+
+	if err := recordPlaceholdersFailed(ctx, job.fileName, job.accessType); err != nil {
+		slog.Error(ctx, "Could not record placeholders of image %s of access type %s as failed: %v", job.fileName, job.accessType, err)
+	}
+}
+
+// markQueued returns whether the image is not already queued, marking it as queued if so.
+func markQueued(job thumbnailJob) bool {
+	queuedThumbnailsMutex.Lock()
+	defer queuedThumbnailsMutex.Unlock()
+
+	if queuedThumbnails[job] {
+		return false
+	}
+	queuedThumbnails[job] = true
+	return true
+}
+
+func dequeued(job thumbnailJob) {
+	queuedThumbnailsMutex.Lock()
+	defer queuedThumbnailsMutex.Unlock()
+
+	delete(queuedThumbnails, job)
+}
+
+// EnqueueThumbnail queues the image for its thumbnail and placeholders to be made in the
+// background, and returns whether it was queued. If the queue is full the image is
+// skipped, and its thumbnail will be made when it is first viewed instead.
+func EnqueueThumbnail(ctx context.Context, fileName, storagePath, accessType string) bool {
+	// Vector images are not resized, so there is nothing to make ahead.
+	if strings.ToLower(path.Ext(fileName)) == ".svg" {
+		return false
+	}
+
+	job := thumbnailJob{fileName: fileName, storagePath: storagePath, accessType: accessType}
+	if !markQueued(job) {
+		return true
+	}
+
+	select {
+	case thumbnailQueue <- job:
+		return true
+	default:
+		dequeued(job)
+		slog.Warn(ctx, "Thumbnail queue is full, image %s will be thumbnailed when viewed", fileName)
+		return false
+	}
+}
+
+// BackfillThumbnails finds images in the storage paths of each access type which have
+// no thumbnail or placeholders yet, and queues them in the background as workers become free. Returns
+// the number of images found needing thumbnails.
+func BackfillThumbnails(ctx context.Context, storagePaths map[string]string) (int, error) {
+	jobs := []thumbnailJob{}
+	for accessType, storagePath := range storagePaths {
+		pathFiles, err := ioutil.ReadDir(storagePath)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error(ctx, "Could not list images in directory %s for thumbnail backfill: %v", storagePath, err)
+			return 0, err
+		}
+
+		for _, pathFile := range pathFiles {
+			// Tagged file names are symlinks to images listed under their own name.
+			if pathFile.IsDir() || pathFile.Mode()&os.ModeSymlink != 0 {
+				continue
+			}
+			if strings.ToLower(path.Ext(pathFile.Name())) == ".svg" {
+				continue
+			}
+
+			thumbnailFilePath := path.Join(config.ConfigStorageDirectoryThumbnail, getThumbnailFileName(pathFile.Name(), accessType))
+			if _, err := os.Stat(thumbnailFilePath); err == nil {
+				// Placeholders are made by workers along with thumbnails, so images
+				// thumbnailed before placeholders were supported still need them.
+				record, err := metadata.Get(ctx, pathFile.Name(), accessType)
+				if err != nil || record.BlurHash != "" {
+					continue
+				}
+			}
+
+			jobs = append(jobs, thumbnailJob{fileName: pathFile.Name(), storagePath: storagePath, accessType: accessType})
+		}
+	}
+
+	// Unlike uploads, backfill waits for room in the queue rather than skipping images.
+	go func() {
+		for _, job := range jobs {
+			if !markQueued(job) {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				dequeued(job)
+				return
+			case thumbnailQueue <- job:
+			}
+		}
+		slog.Info(ctx, "Queued %d images for thumbnail backfill", len(jobs))
+	}()
+
+	return len(jobs), nil
+}
+
+// memorySemaphore limits the total estimated memory of derivatives being made at once.
+type memorySemaphore struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	budget int64
+	used   int64
+}
+
+func newMemorySemaphore(budget int64) *memorySemaphore {
+	semaphore := &memorySemaphore{budget: budget}
+	semaphore.cond = sync.NewCond(&semaphore.mutex)
+	return semaphore
+}
+
+// acquire waits until the memory can be used within the budget, and returns the amount
+// acquired to be released afterwards. Images estimated to need more than the whole budget
+// are made alone rather than never.
+func (s *memorySemaphore) acquire(memory int64) int64 {
+	if memory > s.budget {
+		memory = s.budget
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.used+memory > s.budget {
+		s.cond.Wait()
+	}
+	s.used += memory
+
+	return memory
+}
+
+func (s *memorySemaphore) release(memory int64) {
+	s.mutex.Lock()
+	s.used -= memory
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
+
+// estimateDerivativeMemory estimates the memory needed to make a derivative of the image
+// from its dimensions: the decoded image and the resized copy, at four bytes per pixel.
+// Animations resized with animation also hold every decoded frame, at a byte per pixel
+// of the canvas. Images which cannot be measured are assumed to be large.
+func estimateDerivativeMemory(fileName string, filePayload []byte) int64 {
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(filePayload))
+	if err != nil {
+		slog.Debug(context.Background(), "Could not measure image %s, assuming it is large: %v", fileName, err)
+		return derivativeMemory.budget / 2
+	}
+	canvasPixels := int64(imageConfig.Width) * int64(imageConfig.Height)
+	memory := canvasPixels * 4 * 2
+
+	canvas, frames, err := measureAnimation(fileName, filePayload)
+	if err != nil {
+		slog.Debug(context.Background(), "Could not count frames of image %s, assuming it is large: %v", fileName, err)
+		return derivativeMemory.budget / 2
+	}
+	if frames > 1 && animationWithinLimits(canvas, frames) {
+		memory += canvasPixels * int64(frames)
+	}
+
+	return memory
+}
@@ -0,0 +1,32 @@
+package thumbnail
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEnqueueThumbnailOnlyOnce(t *testing.T) {
+	defer func(configured chan thumbnailJob) { thumbnailQueue = configured }(thumbnailQueue)
+	thumbnailQueue = make(chan thumbnailJob, 1)
+	ctx := context.Background()
+
+	for attempt := 0; attempt < 3; attempt++ {
+		if !EnqueueThumbnail(ctx, "image.png", "/images", "public") {
+			t.Fatalf("Expected image to be queued on attempt %d", attempt)
+		}
+	}
+	if len(thumbnailQueue) != 1 {
+		t.Fatalf("Expected image to be queued once, got %d jobs", len(thumbnailQueue))
+	}
+
+	// Once made, the image can be queued again, such as when its content changes.
+	dequeued(<-thumbnailQueue)
+	if !EnqueueThumbnail(ctx, "image.png", "/images", "public") || len(thumbnailQueue) != 1 {
+		t.Fatalf("Expected image to be queued again once made")
+	}
+	dequeued(<-thumbnailQueue)
+
+	if EnqueueThumbnail(ctx, "image.svg", "/images", "public") {
+		t.Fatalf("Expected vector image not to be queued")
+	}
+}
@@ -0,0 +1,142 @@
+package thumbnail
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+const webRenditionJPEGQuality = 90
+
+// NeedsWebRendition returns whether images with the file name are stored with a
+// converted rendition for displaying in browsers. Some formats such as scanner output
+// in TIFF and BMP are not displayed well by browsers, so we keep the original as
+// uploaded, but serve a rendition converted into a web format by default.
+func NeedsWebRendition(fileName string) bool {
+	fileNameComponents := strings.Split(fileName, ".")
+	if len(fileNameComponents) < 2 {
+		return false
+	}
+
+	switch strings.ToLower(fileNameComponents[len(fileNameComponents)-1]) {
+	case "bmp", "tif", "tiff":
+		return true
+	}
+
+	return false
+}
+
+// WebRenditionContentType returns the HTTP content type of converted web renditions.
+func WebRenditionContentType() string {
+	return config.FileExtensionToContentType(webRenditionExtension())
+}
+
+// CreateWebRendition converts the stored image into a web format and stores the result
+// alongside other renditions, replacing any rendition previously made for the image.
+func CreateWebRendition(ctx context.Context, fileName, storagePath, accessType string) ([]byte, error) {
+	filePath := path.Join(storagePath, fileName)
+	file, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		slog.Debug(ctx, "Could not read file %s when making web rendition: %v", filePath, err)
+		return nil, err
+	}
+
+	img, err := decodeImage(fileName, file)
+	if err != nil {
+		slog.Debug(ctx, "Could not decode image %s when making web rendition: %v", filePath, err)
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("Could not select image %s decode method when making web rendition", filePath)
+	}
+
+	renditionPath := config.ConfigStorageDirectoryRendition
+	if err := os.MkdirAll(renditionPath, 0755); err != nil {
+		slog.Error(ctx, "Could not create rendition directory %s: %v", renditionPath, err)
+		return nil, err
+	}
+
+	renditionFilePath := path.Join(renditionPath, getWebRenditionFileName(fileName, accessType))
+	encodeErr := writeFileAtomically(renditionFilePath, func(renditionFile io.Writer) error {
+		switch webRenditionExtension() {
+		case "jpeg":
+			return jpeg.Encode(renditionFile, flattenImage(img), &jpeg.Options{Quality: webRenditionJPEGQuality})
+		}
+
+		return png.Encode(renditionFile, img)
+	})
+	if encodeErr != nil {
+		slog.Debug(ctx, "Could not encode web rendition of image %s: %v", filePath, encodeErr)
+		return nil, encodeErr
+	}
+
+	return ioutil.ReadFile(renditionFilePath)
+}
+
+// GetWebRenditionForImage returns the converted web rendition of the stored image. If no
+// rendition exists yet, such as for images uploaded before conversion was supported, it is
+// made on demand.
+func GetWebRenditionForImage(ctx context.Context, fileName, storagePath, accessType string) ([]byte, error) {
+	renditionFilePath := path.Join(config.ConfigStorageDirectoryRendition, getWebRenditionFileName(fileName, accessType))
+	if _, err := os.Stat(renditionFilePath); err == nil {
+		return ioutil.ReadFile(renditionFilePath)
+	} else if !os.IsNotExist(err) {
+		slog.Debug(ctx, "Could not check if web rendition %s exists: %v", renditionFilePath, err)
+		return nil, err
+	}
+
+	if _, err := os.Stat(path.Join(storagePath, fileName)); err != nil {
+		// Original does not exist, there is nothing to convert.
+		return nil, nil
+	}
+
+	rendition, err, _ := derivativeFlights.do(renditionFilePath, func() ([]byte, error) {
+		return CreateWebRendition(ctx, fileName, storagePath, accessType)
+	})
+
+	return rendition, err
+}
+
+func getWebRenditionFileName(fileName, accessType string) string {
+	fileNameComponents := strings.Split(fileName, ".")
+	if len(fileNameComponents) < 2 {
+		return fileName
+	}
+
+	name := strings.Join(fileNameComponents[0:len(fileNameComponents)-1], ".")
+	extension := fileNameComponents[len(fileNameComponents)-1]
+
+	return fmt.Sprintf("%s_%s_%s_%s.%s", name, accessType, "web", extension, webRenditionExtension())
+}
+
+func webRenditionExtension() string {
+	switch strings.ToLower(config.ConfigWebRenditionFormat) {
+	case "jpg", "jpeg":
+		return "jpeg"
+	}
+
+	return "png"
+}
+
+// flattenImage draws the image onto an opaque white background, for encoding into
+// formats without transparency.
+func flattenImage(img image.Image) image.Image {
+	bounds := img.Bounds()
+	flattened := image.NewRGBA(bounds)
+	draw.Draw(flattened, bounds, image.White, image.Point{}, draw.Src)
+	draw.Draw(flattened, bounds, img, bounds.Min, draw.Over)
+
+	return flattened
+}
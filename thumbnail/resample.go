@@ -0,0 +1,68 @@
+package thumbnail
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+// Most of the cost of making a derivative is resampling the full resolution image. JPEGs
+// are decoded at a reduced size where they are much larger than the derivative, and other
+// large reductions are made in two stages: the image is halved with a 2x2 box filter until
+// it is within twice the target size, which is cheap and free of aliasing, before the
+// selected kernel makes the final reduction over far fewer pixels.
+
+const prescaleRatio = 2
+
+// lanczos3 matches the kernel used before resampling moved to x/image, for deployments
+// preferring sharpness over speed.
+var lanczos3 = &draw.Kernel{
+	Support: 3,
+	At: func(t float64) float64 {
+		if t == 0 {
+			return 1
+		}
+		return 3 * math.Sin(math.Pi*t) * math.Sin(math.Pi*t/3) / (math.Pi * math.Pi * t * t)
+	},
+}
+
+var resizeKernel = selectKernel(config.ConfigResizeKernel)
+
+func selectKernel(name string) draw.Interpolator {
+	switch strings.ToLower(name) {
+	case "nearest":
+		return draw.NearestNeighbor
+	case "bilinear":
+		return draw.BiLinear
+	case "lanczos3":
+		return lanczos3
+	}
+
+	return draw.CatmullRom
+}
+
+// scaleImage resamples the image to the given width and height with the configured kernel.
+func scaleImage(img image.Image, width, height int) image.Image {
+	for img.Bounds().Dx() >= width*prescaleRatio && img.Bounds().Dy() >= height*prescaleRatio {
+		img = halveImage(img)
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	resizeKernel.Scale(scaled, scaled.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	return scaled
+}
+
+// halveImage halves both dimensions of the image. Sampling bilinearly at exactly half
+// size averages each 2x2 block of pixels.
+func halveImage(img image.Image) image.Image {
+	bounds := img.Bounds()
+	halved := image.NewRGBA(image.Rect(0, 0, bounds.Dx()/2, bounds.Dy()/2))
+	draw.ApproxBiLinear.Scale(halved, halved.Bounds(), img, image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Min.X+halved.Bounds().Dx()*2, bounds.Min.Y+halved.Bounds().Dy()*2), draw.Src, nil)
+
+	return halved
+}
@@ -0,0 +1,193 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestScaleImageDimensions(t *testing.T) {
+	for _, testCase := range []struct {
+		sourceWidth, sourceHeight int
+		width, height             int
+	}{
+		{4000, 3000, 800, 600}, // Prescaled
+		{1000, 750, 800, 600},  // Not prescaled
+		{801, 3, 7, 1},         // Extreme aspect ratio
+		{100, 100, 200, 200},   // Enlarged
+		{3001, 2001, 750, 500}, // Odd dimensions when halved
+		{6000, 100, 1500, 25},  // Only one dimension large enough to prescale
+	} {
+		source := image.NewRGBA(image.Rect(10, 10, 10+testCase.sourceWidth, 10+testCase.sourceHeight))
+		scaled := scaleImage(source, testCase.width, testCase.height)
+		if scaled.Bounds() != image.Rect(0, 0, testCase.width, testCase.height) {
+			t.Fatalf("Scaling %dx%d to %dx%d gave bounds %v", testCase.sourceWidth, testCase.sourceHeight, testCase.width, testCase.height, scaled.Bounds())
+		}
+	}
+}
+
+func TestScaleImageKeepsColour(t *testing.T) {
+	source := image.NewRGBA(image.Rect(0, 0, 2000, 1000))
+	for x := 0; x < 2000; x++ {
+		for y := 0; y < 1000; y++ {
+			// Left half red, right half blue.
+			if x < 1000 {
+				source.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				source.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+
+	scaled := scaleImage(source, 100, 50)
+	if r, _, b, _ := scaled.At(10, 25).RGBA(); r>>8 != 255 || b != 0 {
+		t.Fatalf("Expected red on the left of scaled image, got %v", scaled.At(10, 25))
+	}
+	if r, _, b, _ := scaled.At(90, 25).RGBA(); r != 0 || b>>8 != 255 {
+		t.Fatalf("Expected blue on the right of scaled image, got %v", scaled.At(90, 25))
+	}
+}
+
+func TestDecodeImageForDerivative(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 1600, 1200)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range []struct {
+		params  DerivativeParams
+		decoded image.Rectangle
+		resized image.Rectangle
+	}{
+		{DerivativeParams{Width: 200, Fit: FitContain}, image.Rect(0, 0, 200, 150), image.Rect(0, 0, 200, 150)},
+		{DerivativeParams{Width: 201, Fit: FitContain}, image.Rect(0, 0, 400, 300), image.Rect(0, 0, 201, 151)},
+		{DerivativeParams{Width: 300, Height: 300, Fit: FitCover}, image.Rect(0, 0, 400, 300), image.Rect(0, 0, 300, 300)},
+		{DerivativeParams{Width: 1000, Fit: FitContain}, image.Rect(0, 0, 1600, 1200), image.Rect(0, 0, 1000, 750)},
+		{DerivativeParams{Width: 100, Height: 100, Fit: FitCrop}, image.Rect(0, 0, 1600, 1200), image.Rect(0, 0, 100, 100)},
+	} {
+		img, width, height, err := decodeImageForDerivative("photo.jpg", encoded.Bytes(), testCase.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if width != 1600 || height != 1200 {
+			t.Fatalf("Expected stored dimensions of 1600x1200 for %s, got %dx%d", testCase.params.Canonical(), width, height)
+		}
+		if img.Bounds() != testCase.decoded {
+			t.Fatalf("Expected %s to be made from a decode of %v, got %v", testCase.params.Canonical(), testCase.decoded, img.Bounds())
+		}
+		if resized := resizeImage(img, width, height, testCase.params); resized.Bounds() != testCase.resized {
+			t.Fatalf("Expected %s to be made at %v, got %v", testCase.params.Canonical(), testCase.resized, resized.Bounds())
+		}
+	}
+}
+
+// Benchmarks make a thumbnail from representative uploads, from decoding to encoding.
+// Large JPEGs are also made from a full size decode, to compare against decoding them at
+// a reduced size.
+
+func BenchmarkThumbnailLargeJPEG(b *testing.B) {
+	benchmarkThumbnail(b, "photo.jpg", encodeBenchmarkJPEG(b, 4032, 3024), decodeForThumbnail)
+}
+
+func BenchmarkThumbnailLargeJPEGFullDecode(b *testing.B) {
+	benchmarkThumbnail(b, "photo.jpg", encodeBenchmarkJPEG(b, 4032, 3024), decodeFullSize)
+}
+
+func BenchmarkThumbnailScreenshotPNG(b *testing.B) {
+	benchmarkThumbnail(b, "screenshot.png", encodeBenchmarkPNG(b, 1920, 1080), decodeForThumbnail)
+}
+
+// Resampling alone, from a decoded JPEG as it is held in memory.
+
+func BenchmarkScaleDecodedJPEG(b *testing.B) {
+	img := decodeBenchmarkJPEG(b, 4032, 3024)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	bounds := img.Bounds()
+	for i := 0; i < b.N; i++ {
+		scaleImage(img, thumbnailWidth, bounds.Dy()*thumbnailWidth/bounds.Dx())
+	}
+}
+
+func decodeForThumbnail(fileName string, payload []byte) (image.Image, int, int, error) {
+	return decodeImageForDerivative(fileName, payload, thumbnailParams)
+}
+
+func decodeFullSize(fileName string, payload []byte) (image.Image, int, int, error) {
+	img, err := decodeImage(fileName, payload)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return img, img.Bounds().Dx(), img.Bounds().Dy(), nil
+}
+
+func benchmarkThumbnail(b *testing.B, fileName string, payload []byte, decode func(string, []byte) (image.Image, int, int, error)) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		img, width, height, err := decode(fileName, payload)
+		if err != nil {
+			b.Fatalf("Could not decode benchmark image: %v", err)
+		}
+
+		if err := jpeg.Encode(io.Discard, resizeImage(img, width, height, thumbnailParams), nil); err != nil {
+			b.Fatalf("Could not encode benchmark thumbnail: %v", err)
+		}
+	}
+}
+
+// benchmarkImage draws smooth gradients with noise, which compresses and resamples like
+// a photograph rather than a flat test pattern.
+func benchmarkImage(width, height int) *image.RGBA {
+	random := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			noise := random.Intn(32)
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8((x*255/width + noise) % 256),
+				G: uint8((y*255/height + noise) % 256),
+				B: uint8(((x+y)*255/(width+height) + noise) % 256),
+				A: 255,
+			})
+		}
+	}
+
+	return img
+}
+
+func encodeBenchmarkJPEG(b *testing.B, width, height int) []byte {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, benchmarkImage(width, height), &jpeg.Options{Quality: 90}); err != nil {
+		b.Fatalf("Could not encode benchmark image: %v", err)
+	}
+
+	return encoded.Bytes()
+}
+
+func encodeBenchmarkPNG(b *testing.B, width, height int) []byte {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, benchmarkImage(width, height)); err != nil {
+		b.Fatalf("Could not encode benchmark image: %v", err)
+	}
+
+	return encoded.Bytes()
+}
+
+func decodeBenchmarkJPEG(b *testing.B, width, height int) image.Image {
+	img, err := jpeg.Decode(bytes.NewReader(encodeBenchmarkJPEG(b, width, height)))
+	if err != nil {
+		b.Fatalf("Could not decode benchmark image: %v", err)
+	}
+
+	return img
+}
@@ -0,0 +1,100 @@
+package thumbnail
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+var errFlightAbandoned = errors.New("Derivative was abandoned while being made")
+
+// flightGroup makes sure each derivative is only made once at a time. Requests for a
+// derivative already being made wait for it and share its result, rather than decoding
+// and resizing the same image again.
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done    sync.WaitGroup
+	result  []byte
+	err     error
+	waiting int // Requests sharing the result, besides the one making it
+}
+
+// do calls fn for the key, unless a call for the key is already in progress, in which
+// case it waits for that call and returns its result. Returns whether the result was
+// shared with another call.
+func (g *flightGroup) do(key string, fn func() ([]byte, error)) (result []byte, err error, shared bool) {
+	g.mutex.Lock()
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	if existing, found := g.flights[key]; found {
+		existing.waiting++
+		g.mutex.Unlock()
+		existing.done.Wait()
+		return existing.result, existing.err, true
+	}
+
+	current := &flight{}
+	current.done.Add(1)
+	g.flights[key] = current
+	g.mutex.Unlock()
+
+	// Clean up even if fn panics, so that waiting requests are not stuck forever.
+	defer func() {
+		g.mutex.Lock()
+		delete(g.flights, key)
+		shared = current.waiting > 0
+		g.mutex.Unlock()
+		current.done.Done()
+	}()
+
+	// Waiting requests see this if fn panics before returning.
+	current.err = errFlightAbandoned
+	current.result, current.err = fn()
+	return current.result, current.err, false
+}
+
+// waiters returns how many requests are waiting for the call in progress for the key.
+func (g *flightGroup) waiters(key string) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if existing, found := g.flights[key]; found {
+		return existing.waiting
+	}
+
+	return 0
+}
+
+// writeFileAtomically writes to a temporary file next to the destination and renames it
+// into place once complete, so that readers never see a partially written file.
+func writeFileAtomically(filePath string, write func(io.Writer) error) error {
+	tempFile, err := os.CreateTemp(path.Dir(filePath), "."+path.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempFilePath := tempFile.Name()
+
+	writeErr := write(tempFile)
+	closeErr := tempFile.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(tempFilePath)
+		return writeErr
+	}
+
+	if err := os.Rename(tempFilePath, filePath); err != nil {
+		os.Remove(tempFilePath)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupSharesConcurrentCalls(t *testing.T) {
+	group := flightGroup{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+
+	fn := func() ([]byte, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return []byte("derivative"), nil
+	}
+
+	const requests = 20
+	results := make([][]byte, requests)
+	shared := make([]bool, requests)
+	wg := sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _, shared[0] = group.do("key", fn)
+	}()
+	<-started
+
+	for i := 1; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, shared[i] = group.do("key", fn)
+		}(i)
+	}
+
+	// Only release the call once every other request is waiting for it.
+	waitFor(t, func() bool { return group.waiters("key") == requests-1 })
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("Expected one call for concurrent requests, got %d", calls)
+	}
+	for i := 0; i < requests; i++ {
+		if string(results[i]) != "derivative" {
+			t.Fatalf("Request %d got unexpected result %s", i, results[i])
+		}
+		if !shared[i] {
+			t.Fatalf("Request %d result should be shared", i)
+		}
+	}
+}
+
+func TestFlightGroupSharesErrorsAndCallsAgain(t *testing.T) {
+	group := flightGroup{}
+	expectedErr := errors.New("resize failed")
+
+	_, err, shared := group.do("key", func() ([]byte, error) { return nil, expectedErr })
+	if err != expectedErr {
+		t.Fatalf("Expected error %v, got %v", expectedErr, err)
+	}
+	if shared {
+		t.Fatal("Result of a single call should not be shared")
+	}
+
+	// Once complete, a call for the same key is made again rather than reusing the result.
+	result, err, _ := group.do("key", func() ([]byte, error) { return []byte("retried"), nil })
+	if err != nil || string(result) != "retried" {
+		t.Fatalf("Expected retried call to succeed, got %s, %v", result, err)
+	}
+}
+
+func TestFlightGroupDoesNotShareAcrossKeys(t *testing.T) {
+	group := flightGroup{}
+	release := make(chan struct{})
+	var calls int32
+
+	wg := sync.WaitGroup{}
+	for _, key := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			group.do(key, func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return nil, nil
+			})
+		}(key)
+	}
+
+	// All keys are in flight at once, so none waited for another.
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 3 })
+	close(release)
+	wg.Wait()
+}
+
+func TestFlightGroupReleasesWaitersOnPanic(t *testing.T) {
+	group := flightGroup{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	go func() {
+		defer func() { recover() }()
+		group.do("key", func() ([]byte, error) {
+			close(started)
+			<-release
+			panic("decoder bug")
+		})
+	}()
+	<-started
+
+	errs := make(chan error)
+	go func() {
+		_, err, _ := group.do("key", func() ([]byte, error) { return nil, nil })
+		errs <- err
+	}()
+
+	waitFor(t, func() bool { return group.waiters("key") == 1 })
+	close(release)
+
+	select {
+	case err := <-errs:
+		if err != errFlightAbandoned {
+			t.Fatalf("Expected waiter to see abandoned flight, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiter was not released after panic")
+	}
+}
+
+func TestWriteFileAtomically(t *testing.T) {
+	directory := t.TempDir()
+	filePath := path.Join(directory, "image_public_thumb.png")
+
+	err := writeFileAtomically(filePath, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return errors.New("encode failed")
+	})
+	if err == nil {
+		t.Fatal("Expected error from failed write")
+	}
+	assertDirectoryContents(t, directory)
+
+	err = writeFileAtomically(filePath, func(w io.Writer) error {
+		_, err := w.Write([]byte("complete"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error writing file: %v", err)
+	}
+	assertDirectoryContents(t, directory, "image_public_thumb.png")
+
+	written, err := os.ReadFile(filePath)
+	if err != nil || !bytes.Equal(written, []byte("complete")) {
+		t.Fatalf("Unexpected file content %s, %v", written, err)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func assertDirectoryContents(t *testing.T, directory string, expected ...string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("Could not list directory %s: %v", directory, err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected directory to contain %v, got %v", expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("Expected directory to contain %v, got %v", expected, names)
+		}
+	}
+}
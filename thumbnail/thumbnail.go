@@ -8,23 +8,52 @@ import (
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 	"sync"
 
 	"github.com/monzo/slog"
-	"github.com/nfnt/resize"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
 
 	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/svg"
+	"github.com/chongyangshi/yronwood/thumbnail/jpegscale"
 )
 
-const thumbnailWidth = 800
+const (
+	// JPEGs can be decoded at a half, quarter or eighth of their size.
+	maxJPEGScaleDenominator = 8
 
-var thumbnailPathMutex = sync.Mutex{}
+	thumbnailWidth = 800
+	thumbnailKey   = "thumb"
+	originalKey    = "original"
+)
+
+var (
+	thumbnailPathMutex       = sync.Mutex{}
+	derivativeFlights        = flightGroup{}
+	derivativeKeyComposition = regexp.MustCompile(`^(thumb|original|[dw][0-9a-f]{16})$`)
+)
+
+// Thumbnails are the derivative of fixed width shown in the gallery grid, and are cached
+// under their own name for compatibility with thumbnails made previously.
+var thumbnailParams = DerivativeParams{
+	Width:   thumbnailWidth,
+	Fit:     FitContain,
+	Gravity: GravityCenter,
+}
 
 func GetThumbnailForImage(ctx context.Context, fileName, storagePath, accessType string) ([]byte, error) {
+	return getDerivative(ctx, fileName, storagePath, accessType, Rendition{Thumbnail: true})
+}
+
+func getDerivative(ctx context.Context, fileName, storagePath, accessType string, rendition Rendition) ([]byte, error) {
 	thumbnailPath := config.ConfigStorageDirectoryThumbnail
 	thumbnailPathMutex.Lock()
 	if _, err := os.Stat(thumbnailPath); os.IsNotExist(err) {
@@ -38,22 +67,41 @@ func GetThumbnailForImage(ctx context.Context, fileName, storagePath, accessType
 	}
 	thumbnailPathMutex.Unlock()
 
-	thumbnailFilePath := path.Join(thumbnailPath, getThumbnailFileName(fileName, accessType))
-	if _, err := os.Stat(thumbnailFilePath); err == nil {
-		thumbnail, err := ioutil.ReadFile(thumbnailFilePath)
-		if err != nil {
-			slog.Debug(ctx, "Could not read thumbnail file %s: %v", thumbnailFilePath, err)
-			return nil, err
-		}
+	derivativeFileName := getDerivativeFileName(fileName, accessType, rendition.key(), rendition.Format)
+	if thumbnail, found := derivativeCache.hotContent(derivativeFileName); found {
+		return thumbnail, nil
+	}
+
+	thumbnailFilePath := path.Join(thumbnailPath, derivativeFileName)
+	thumbnail, err := ioutil.ReadFile(thumbnailFilePath)
+	if err == nil {
 		// Found thumbnail already processed, return it.
+		derivativeCache.viewed(derivativeFileName, thumbnail)
 		return thumbnail, nil
 	} else if !os.IsNotExist(err) {
 		// Unknown thumbnail file read error, bail
-		slog.Debug(ctx, "Could not check if thumbnail file %s exists: %v", thumbnailFilePath, err)
+		slog.Debug(ctx, "Could not read thumbnail file %s: %v", thumbnailFilePath, err)
 		return nil, err
 	}
 
-	// File not thumbnailed before, we need to process and store the thumbnail.
+	// File not thumbnailed before, or evicted since, we need to process and store the
+	// thumbnail. Concurrent requests for the same thumbnail wait for the first to make it.
+	thumbnail, err, _ = derivativeFlights.do(thumbnailFilePath, func() ([]byte, error) {
+		// A previous request may have finished making it since we checked.
+		if thumbnail, err := ioutil.ReadFile(thumbnailFilePath); err == nil {
+			derivativeCache.viewed(derivativeFileName, thumbnail)
+			return thumbnail, nil
+		}
+
+		return makeDerivative(ctx, fileName, storagePath, rendition, thumbnailFilePath)
+	})
+
+	return thumbnail, err
+}
+
+// makeDerivative makes the rendition of the image and stores it at the given path, and
+// returns it.
+func makeDerivative(ctx context.Context, fileName, storagePath string, rendition Rendition, thumbnailFilePath string) ([]byte, error) {
 	filePath := path.Join(storagePath, fileName)
 	if _, err := os.Stat(filePath); err != nil {
 		slog.Debug(ctx, "Cannot read image %s storage path %s, not making thumbnail", fileName, storagePath)
@@ -66,36 +114,105 @@ func GetThumbnailForImage(ctx context.Context, fileName, storagePath, accessType
 		return nil, err
 	}
 
-	img, err := decodeImage(fileName, file)
-	if err != nil {
-		slog.Debug(ctx, "Could not decode image %s when making thumbnail: %v", filePath, err)
-		return nil, err
+	// Vector images scale by themselves, so the thumbnail is the sanitized image itself.
+	if strings.ToLower(path.Ext(fileName)) == ".svg" {
+		return svg.Sanitize(file)
 	}
-	if img == nil {
-		slog.Debug(ctx, "Could not select image %s decode method when making thumbnail: %v", filePath, err)
-		return nil, err
+
+	// Wait for enough memory to be free for decoding and resizing the image.
+	memory := derivativeMemory.acquire(estimateDerivativeMemory(fileName, file))
+	defer derivativeMemory.release(memory)
+
+	// Animated images are thumbnailed with animation if possible, otherwise we fall back to
+	// a static thumbnail from the first frame. Watermarks are only drawn over static images,
+	// and animations are only kept when served as GIF.
+	params := rendition.params()
+	animated := false
+	if !rendition.Watermarked && rendition.Format == "" {
+		animated, err = makeAnimatedDerivative(ctx, fileName, thumbnailFilePath, file, params)
+		if err != nil {
+			slog.Debug(ctx, "Could not make animated thumbnail of image %s: %v", filePath, err)
+			return nil, err
+		}
 	}
 
-	thumbnail := resize.Resize(thumbnailWidth, 0, img, resize.Lanczos3)
-	thumbnailFilePath, err = encodeImageToFile(fileName, thumbnailPath, accessType, thumbnail)
+	if !animated {
+		img, width, height, err := decodeImageForDerivative(fileName, file, params)
+		if err != nil {
+			slog.Debug(ctx, "Could not decode image %s when making thumbnail: %v", filePath, err)
+			return nil, err
+		}
+		if img == nil {
+			slog.Debug(ctx, "Could not select image %s decode method when making thumbnail: %v", filePath, err)
+			return nil, err
+		}
+
+		if params != (DerivativeParams{}) {
+			img = resizeImage(img, width, height, params)
+		}
+		if rendition.Watermarked {
+			img = applyWatermark(img)
+		}
+
+		err = encodeImageToFile(fileName, rendition.Format, thumbnailFilePath, img)
+		if err != nil {
+			slog.Debug(ctx, "Could not encode thumbnail of image %s: %v", filePath, err)
+			return nil, err
+		}
+	}
+
+	thumbnail, err := ioutil.ReadFile(thumbnailFilePath)
 	if err != nil {
-		slog.Debug(ctx, "Could not encode thumbnail of image %s: %v", filePath, err)
+		slog.Debug(ctx, "Could not read thumnnail %s: %v", thumbnailFilePath, err)
 		return nil, err
 	}
+	derivativeCache.stored(path.Base(thumbnailFilePath), int64(len(thumbnail)))
 
-	if thumbnailFilePath != "" {
-		file, err := ioutil.ReadFile(thumbnailFilePath)
-		if err != nil {
-			slog.Debug(ctx, "Could not read thumnnail %s: %v", thumbnailFilePath, err)
-			return nil, err
+	return thumbnail, nil
+}
+
+// InvalidateDerivatives removes any processed thumbnail, resized derivatives, web
+// rendition and placeholders for the image, so that they will be made again from the
+// stored image when next requested.
+func InvalidateDerivatives(ctx context.Context, fileName, accessType string) error {
+	derivativeFilePaths := []string{
+		path.Join(config.ConfigStorageDirectoryRendition, getWebRenditionFileName(fileName, accessType)),
+	}
+
+	thumbnailFiles, err := ioutil.ReadDir(config.ConfigStorageDirectoryThumbnail)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error(ctx, "Could not list thumbnail directory %s: %v", config.ConfigStorageDirectoryThumbnail, err)
+		return err
+	}
+	for _, thumbnailFile := range thumbnailFiles {
+		if isDerivativeFileName(thumbnailFile.Name(), fileName, accessType) {
+			derivativeFilePaths = append(derivativeFilePaths, path.Join(config.ConfigStorageDirectoryThumbnail, thumbnailFile.Name()))
+			derivativeCache.removed(thumbnailFile.Name())
 		}
-		return file, nil
 	}
 
-	return nil, nil
+	if err := clearPlaceholders(ctx, fileName, accessType); err != nil {
+		return err
+	}
+
+	for _, derivativeFilePath := range derivativeFilePaths {
+		err := os.Remove(derivativeFilePath)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error(ctx, "Could not remove derived image %s: %v", derivativeFilePath, err)
+			return err
+		}
+	}
+
+	return nil
 }
 
 func getThumbnailFileName(fileName, accessType string) string {
+	return getDerivativeFileName(fileName, accessType, thumbnailKey, "")
+}
+
+// getDerivativeFileName returns the name derivatives of the image are cached under, which
+// ends in the extension of the format they are encoded in.
+func getDerivativeFileName(fileName, accessType, derivativeKey, format string) string {
 	fileNameComponents := strings.Split(fileName, ".")
 	if len(fileNameComponents) < 2 {
 		return fileName
@@ -103,11 +220,68 @@ func getThumbnailFileName(fileName, accessType string) string {
 
 	name := strings.Join(fileNameComponents[0:len(fileNameComponents)-1], ".")
 	extension := fileNameComponents[len(fileNameComponents)-1]
-	thumbnailFileName := fmt.Sprintf("%s_%s_%s.%s", name, accessType, "thumb", extension)
+	thumbnailFileName := fmt.Sprintf("%s_%s_%s.%s", name, accessType, derivativeKey, extension)
+
+	// Keep the original extension in the name if the thumbnail is encoded differently,
+	// so that it won't clash with the thumbnail of an image of the same name in that format.
+	if encodedExtension := renditionExtension(extension, format); encodedExtension != extension {
+		thumbnailFileName = fmt.Sprintf("%s_%s_%s_%s.%s", name, accessType, derivativeKey, extension, encodedExtension)
+	}
 
 	return thumbnailFileName
 }
 
+// isDerivativeFileName returns whether a file in the thumbnail directory is a derivative
+// of the image, rather than of another image whose name shares the same prefix.
+func isDerivativeFileName(derivativeFileName, fileName, accessType string) bool {
+	fileNameComponents := strings.Split(fileName, ".")
+	if len(fileNameComponents) < 2 {
+		return false
+	}
+
+	name := strings.Join(fileNameComponents[0:len(fileNameComponents)-1], ".")
+	prefix := fmt.Sprintf("%s_%s_", name, accessType)
+	if !strings.HasPrefix(derivativeFileName, prefix) {
+		return false
+	}
+
+	derivativeKey := strings.SplitN(strings.TrimPrefix(derivativeFileName, prefix), "_", 2)[0]
+	derivativeKey = strings.SplitN(derivativeKey, ".", 2)[0]
+	if !derivativeKeyComposition.MatchString(derivativeKey) {
+		return false
+	}
+
+	for _, format := range []string{"", FormatJPEG, FormatPNG, FormatGIF} {
+		if derivativeFileName == getDerivativeFileName(fileName, accessType, derivativeKey, format) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// thumbnailExtension returns the extension of the format thumbnails are encoded in for
+// images with the given extension. Formats which can be decoded but not encoded fall back
+// to PNG, which is lossless and keeps any transparency of the original.
+func thumbnailExtension(extension string) string {
+	switch strings.ToLower(extension) {
+	case "webp", "bmp", "tif", "tiff":
+		return "png"
+	}
+
+	return extension
+}
+
+// ThumbnailContentType returns the HTTP content type of the thumbnail for an image.
+func ThumbnailContentType(fileName string) string {
+	fileNameComponents := strings.Split(fileName, ".")
+	if len(fileNameComponents) < 2 {
+		return "application/octet-stream"
+	}
+
+	return config.FileExtensionToContentType(thumbnailExtension(fileNameComponents[len(fileNameComponents)-1]))
+}
+
 func decodeImage(fileName string, filePayload []byte) (image.Image, error) {
 	fileNameComponents := strings.Split(fileName, ".")
 	if len(fileNameComponents) < 2 {
@@ -122,34 +296,114 @@ func decodeImage(fileName string, filePayload []byte) (image.Image, error) {
 		return png.Decode(bytes.NewReader(filePayload))
 	case "gif":
 		return gif.Decode(bytes.NewReader(filePayload))
+	case "webp":
+		return webp.Decode(bytes.NewReader(filePayload))
+	case "bmp":
+		return bmp.Decode(bytes.NewReader(filePayload))
+	case "tif", "tiff":
+		return tiff.Decode(bytes.NewReader(filePayload))
 	}
 
 	return nil, nil
 }
 
-func encodeImageToFile(fileName, storagePath, accessType string, img image.Image) (string, error) {
-	fileNameComponents := strings.Split(fileName, ".")
-	if len(fileNameComponents) < 2 {
-		return "", nil
+// decodeImageForDerivative decodes the image for making the derivative, returning it with
+// its dimensions as stored. JPEGs are decoded at the smallest reduced size which is still
+// at least as large as the derivative is scaled to, saving most of the time and memory
+// taken to decode and resample large photos.
+func decodeImageForDerivative(fileName string, filePayload []byte, params DerivativeParams) (image.Image, int, int, error) {
+	extension := strings.ToLower(strings.TrimPrefix(path.Ext(fileName), "."))
+	if (extension != "jpg" && extension != "jpeg") || params == (DerivativeParams{}) {
+		img, err := decodeImage(fileName, filePayload)
+		if img == nil || err != nil {
+			return nil, 0, 0, err
+		}
+		return img, img.Bounds().Dx(), img.Bounds().Dy(), nil
 	}
-	extension := fileNameComponents[len(fileNameComponents)-1]
 
-	thumbnailPath := path.Join(storagePath, getThumbnailFileName(fileName, accessType))
-	thumbnailFile, err := os.Create(thumbnailPath)
+	imageConfig, err := jpeg.DecodeConfig(bytes.NewReader(filePayload))
 	if err != nil {
-		return "", err
+		return nil, 0, 0, err
 	}
-	defer thumbnailFile.Close()
 
-	var encodeErr error
-	switch strings.ToLower(extension) {
+	denominator := 1
+	if scaledWidth, scaledHeight, scaled := params.scaledDimensions(imageConfig.Width, imageConfig.Height); scaled {
+		for denominator < maxJPEGScaleDenominator && imageConfig.Width/(denominator*2) >= scaledWidth && imageConfig.Height/(denominator*2) >= scaledHeight {
+			denominator *= 2
+		}
+	}
+
+	img, err := jpegscale.Decode(bytes.NewReader(filePayload), denominator)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return img, imageConfig.Width, imageConfig.Height, nil
+}
+
+// GetImageDimensions returns the intrinsic width and height of the stored image, reading
+// only as much of the file as needed. Zero dimensions are returned for formats such as
+// SVG which have no fixed size.
+func GetImageDimensions(fileName, storagePath string) (int, int, error) {
+	fileNameComponents := strings.Split(fileName, ".")
+	if len(fileNameComponents) < 2 {
+		return 0, 0, nil
+	}
+
+	var decodeConfig func(io.Reader) (image.Config, error)
+	switch strings.ToLower(fileNameComponents[len(fileNameComponents)-1]) {
 	case "jpg", "jpeg":
-		encodeErr = jpeg.Encode(thumbnailFile, img, nil)
+		decodeConfig = jpeg.DecodeConfig
 	case "png":
-		encodeErr = png.Encode(thumbnailFile, img)
+		decodeConfig = png.DecodeConfig
 	case "gif":
-		encodeErr = gif.Encode(thumbnailFile, img, nil)
+		decodeConfig = gif.DecodeConfig
+	case "webp":
+		decodeConfig = webp.DecodeConfig
+	case "bmp":
+		decodeConfig = bmp.DecodeConfig
+	case "tif", "tiff":
+		decodeConfig = tiff.DecodeConfig
+	default:
+		return 0, 0, nil
+	}
+
+	file, err := os.Open(path.Join(storagePath, fileName))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	imageConfig, err := decodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return imageConfig.Width, imageConfig.Height, nil
+}
+
+// encodeImageToFile encodes the image in the format, or in the format of thumbnails of the
+// image if not specified.
+func encodeImageToFile(fileName, format, thumbnailFilePath string, img image.Image) error {
+	fileNameComponents := strings.Split(fileName, ".")
+	if len(fileNameComponents) < 2 {
+		return nil
 	}
+	extension := fileNameComponents[len(fileNameComponents)-1]
+
+	return writeFileAtomically(thumbnailFilePath, func(thumbnailFile io.Writer) error {
+		switch strings.ToLower(renditionExtension(extension, format)) {
+		case "jpg", "jpeg":
+			if !isOpaque(img) {
+				img = flattenImage(img)
+			}
+			return jpeg.Encode(thumbnailFile, img, &jpeg.Options{Quality: jpegQuality})
+		case "png":
+			return png.Encode(thumbnailFile, img)
+		case "gif":
+			return gif.Encode(thumbnailFile, img, nil)
+		}
 
-	return thumbnailPath, encodeErr
+		return nil
+	})
 }
@@ -0,0 +1,112 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+func TestConcurrentThumbnailRequests(t *testing.T) {
+	storagePath := t.TempDir()
+	config.ConfigStorageDirectoryThumbnail = path.Join(t.TempDir(), "thumbnail")
+
+	original := image.NewRGBA(image.Rect(0, 0, 1600, 900))
+	for x := 0; x < 1600; x++ {
+		for y := 0; y < 900; y++ {
+			original.Set(x, y, color.RGBA{uint8(x), uint8(y), 100, 255})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, original); err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+	if err := os.WriteFile(path.Join(storagePath, "image.png"), encoded.Bytes(), 0644); err != nil {
+		t.Fatalf("Could not write test image: %v", err)
+	}
+
+	const requests = 16
+	thumbnails := make([][]byte, requests)
+	errs := make([]error, requests)
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			thumbnails[i], errs[i] = GetThumbnailForImage(context.Background(), "image.png", storagePath, "public")
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i := 0; i < requests; i++ {
+		if errs[i] != nil {
+			t.Fatalf("Request %d failed: %v", i, errs[i])
+		}
+		if !bytes.Equal(thumbnails[i], thumbnails[0]) {
+			t.Fatalf("Request %d got a different thumbnail", i)
+		}
+	}
+
+	thumbnail, err := png.Decode(bytes.NewReader(thumbnails[0]))
+	if err != nil {
+		t.Fatalf("Thumbnail is not a complete PNG: %v", err)
+	}
+	if thumbnail.Bounds().Dx() != thumbnailWidth || thumbnail.Bounds().Dy() != 450 {
+		t.Fatalf("Unexpected thumbnail dimensions %v", thumbnail.Bounds())
+	}
+
+	// No temporary files are left behind next to the thumbnail.
+	assertDirectoryContents(t, config.ConfigStorageDirectoryThumbnail, "image_public_thumb.png")
+}
+
+func TestConcurrentDerivativesOfDifferentParams(t *testing.T) {
+	storagePath := t.TempDir()
+	config.ConfigStorageDirectoryThumbnail = path.Join(t.TempDir(), "thumbnail")
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 400, 300))); err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+	if err := os.WriteFile(path.Join(storagePath, "image.png"), encoded.Bytes(), 0644); err != nil {
+		t.Fatalf("Could not write test image: %v", err)
+	}
+
+	widths := []int{50, 100, 150, 200}
+	wg := sync.WaitGroup{}
+	for _, width := range widths {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(width int) {
+				defer wg.Done()
+				derivative, err := GetRenditionForImage(context.Background(), "image.png", storagePath, "public", Rendition{Params: DerivativeParams{Width: width}})
+				if err != nil {
+					t.Errorf("Derivative of width %d failed: %v", width, err)
+					return
+				}
+				decoded, err := png.Decode(bytes.NewReader(derivative))
+				if err != nil || decoded.Bounds().Dx() != width {
+					t.Errorf("Unexpected derivative for width %d: %v", width, err)
+				}
+			}(width)
+		}
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(config.ConfigStorageDirectoryThumbnail)
+	if err != nil {
+		t.Fatalf("Could not list thumbnails: %v", err)
+	}
+	if len(entries) != len(widths) {
+		t.Fatalf("Expected %d derivatives, got %d", len(widths), len(entries))
+	}
+}
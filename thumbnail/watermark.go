@@ -0,0 +1,192 @@
+package thumbnail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+// Public and unlisted images can be served with a watermark drawn over them, to deter
+// reposting. Watermarks are drawn as images are served rather than when they are stored,
+// so the originals are kept as uploaded and the watermark can be changed at any time.
+// Watermarked images are cached alongside thumbnails, under keys which change with the
+// watermark so that images watermarked differently before are not served.
+
+const (
+	watermarkTextSize    = 128 // Points at 72 DPI, rendered once and scaled to each image
+	watermarkTextOutline = 4   // Pixels of dark outline keeping text legible on light images
+	watermarkMarginRatio = 0.02
+)
+
+var (
+	watermarkOverlay   image.Image // Nil if no watermark is configured
+	watermarkSignature string
+	watermarkPosition  = GravitySouthEast
+	watermarkOpacity   = 0.5
+	watermarkScale     = 0.25
+)
+
+func init() {
+	if _, _, valid := gravityAnchor(config.ConfigWatermarkPosition); valid {
+		watermarkPosition = config.ConfigWatermarkPosition
+	}
+
+	opacityParsed, err := strconv.ParseFloat(config.ConfigWatermarkOpacity, 64)
+	if err == nil && opacityParsed > 0 && opacityParsed <= 1 {
+		watermarkOpacity = opacityParsed
+	}
+
+	scaleParsed, err := strconv.ParseFloat(config.ConfigWatermarkScale, 64)
+	if err == nil && scaleParsed > 0 && scaleParsed <= 1 {
+		watermarkScale = scaleParsed
+	}
+}
+
+// LoadWatermark prepares the configured watermark image or text to be drawn over images.
+// Nothing is watermarked if neither is configured.
+func LoadWatermark() error {
+	switch {
+	case config.ConfigWatermarkImage != "":
+		file, err := ioutil.ReadFile(config.ConfigWatermarkImage)
+		if err != nil {
+			return fmt.Errorf("Could not read watermark image %s: %v", config.ConfigWatermarkImage, err)
+		}
+		overlay, err := png.Decode(bytes.NewReader(file))
+		if err != nil {
+			return fmt.Errorf("Could not decode watermark image %s: %v", config.ConfigWatermarkImage, err)
+		}
+		setWatermark(overlay, file)
+	case config.ConfigWatermarkText != "":
+		overlay, err := renderWatermarkText(config.ConfigWatermarkText)
+		if err != nil {
+			return err
+		}
+		setWatermark(overlay, []byte(config.ConfigWatermarkText))
+	}
+
+	return nil
+}
+
+func setWatermark(overlay image.Image, source []byte) {
+	signature := sha256.New()
+	signature.Write(source)
+	fmt.Fprintf(signature, "|%s|%g|%g", watermarkPosition, watermarkOpacity, watermarkScale)
+
+	watermarkOverlay = overlay
+	watermarkSignature = hex.EncodeToString(signature.Sum(nil))
+}
+
+// WatermarkApplies returns whether the image is served with a watermark to clients other
+// than admins. Animated GIFs and SVG images are not watermarked, as they cannot be drawn
+// over without losing their animation or scalability.
+func WatermarkApplies(fileName, accessType string) bool {
+	if watermarkOverlay == nil {
+		return false
+	}
+	if accessType != config.ConfigAccessTypePublic && accessType != config.ConfigAccessTypeUnlisted {
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimPrefix(path.Ext(fileName), ".")) {
+	case "jpg", "jpeg", "png", "webp", "bmp", "tif", "tiff":
+		return true
+	}
+
+	return false
+}
+
+// watermarkKey identifies the watermarked version of the derivative with the given key,
+// which changes whenever the watermark does.
+func watermarkKey(derivativeKey string) string {
+	keyHash := sha256.Sum256([]byte(fmt.Sprintf("%s|%s", derivativeKey, watermarkSignature)))
+	return fmt.Sprintf("w%s", hex.EncodeToString(keyHash[:8]))
+}
+
+// renderWatermarkText draws the text in white with a dark outline, at a size large enough
+// to be scaled down for most images.
+func renderWatermarkText(text string) (image.Image, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("Watermark text %q has nothing to draw", text)
+	}
+
+	parsedFont, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse watermark font: %v", err)
+	}
+	face, err := opentype.NewFace(parsedFont, &opentype.FaceOptions{
+		Size:    watermarkTextSize,
+		DPI:     72,
+		Hinting: font.HintingNone,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not load watermark font: %v", err)
+	}
+	defer face.Close()
+
+	drawer := font.Drawer{Face: face}
+	metrics := face.Metrics()
+	width := drawer.MeasureString(text).Ceil() + 2*watermarkTextOutline
+	height := (metrics.Ascent + metrics.Descent).Ceil() + 2*watermarkTextOutline
+
+	overlay := image.NewRGBA(image.Rect(0, 0, width, height))
+	drawer.Dst = overlay
+	baseline := watermarkTextOutline + metrics.Ascent.Ceil()
+
+	drawer.Src = image.Black
+	for offsetX := -watermarkTextOutline; offsetX <= watermarkTextOutline; offsetX += 2 {
+		for offsetY := -watermarkTextOutline; offsetY <= watermarkTextOutline; offsetY += 2 {
+			drawer.Dot = fixed.P(watermarkTextOutline+offsetX, baseline+offsetY)
+			drawer.DrawString(text)
+		}
+	}
+
+	drawer.Src = image.White
+	drawer.Dot = fixed.P(watermarkTextOutline, baseline)
+	drawer.DrawString(text)
+
+	return overlay, nil
+}
+
+// applyWatermark returns a copy of the image with the watermark drawn over it, scaled to
+// the configured fraction of the image and positioned within a small margin of its edges.
+func applyWatermark(img image.Image) image.Image {
+	bounds := img.Bounds()
+	watermarked := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(watermarked, watermarked.Bounds(), img, bounds.Min, draw.Src)
+
+	overlayBounds := watermarkOverlay.Bounds()
+	scale := math.Min(
+		watermarkScale*float64(bounds.Dx())/float64(overlayBounds.Dx()),
+		watermarkScale*float64(bounds.Dy())/float64(overlayBounds.Dy()),
+	)
+	width := maxInt(scaleDimension(overlayBounds.Dx(), scale), 1)
+	height := maxInt(scaleDimension(overlayBounds.Dy(), scale), 1)
+	overlay := scaleImage(watermarkOverlay, width, height)
+
+	margin := int(math.Round(watermarkMarginRatio * float64(minInt(bounds.Dx(), bounds.Dy()))))
+	anchorX, anchorY, _ := gravityAnchor(watermarkPosition)
+	x := margin + int(math.Round(float64(bounds.Dx()-width-2*margin)*anchorX))
+	y := margin + int(math.Round(float64(bounds.Dy()-height-2*margin)*anchorY))
+
+	opacity := image.NewUniform(color.Alpha{A: uint8(math.Round(watermarkOpacity * 255))})
+	draw.DrawMask(watermarked, image.Rect(x, y, x+width, y+height), overlay, image.Point{}, opacity, image.Point{}, draw.Over)
+
+	return watermarked
+}
@@ -0,0 +1,166 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+func TestWatermarkPositionAndOpacity(t *testing.T) {
+	useTestWatermark(t, color.RGBA{255, 255, 255, 255})
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	draw.Draw(img, img.Bounds(), image.Black, image.Point{}, draw.Src)
+	watermarked := applyWatermark(img).(*image.RGBA)
+
+	// The overlay spans a quarter of the height, as the image is wider than tall, and is
+	// within a margin of 2% of the height from the bottom right corner.
+	expectedRegion := image.Rect(346, 146, 396, 196)
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 200; y++ {
+			r, _, _, _ := watermarked.At(x, y).RGBA()
+			inside := image.Pt(x, y).In(expectedRegion)
+			if inside && (r>>8 < 126 || r>>8 > 129) {
+				t.Fatalf("Expected half opacity white at (%d, %d) of watermark, got %v", x, y, watermarked.At(x, y))
+			}
+			if !inside && r != 0 {
+				t.Fatalf("Expected black at (%d, %d) outside watermark, got %v", x, y, watermarked.At(x, y))
+			}
+		}
+	}
+
+	// The image being watermarked is left as it is.
+	if r, _, _, _ := img.At(370, 170).RGBA(); r != 0 {
+		t.Fatal("Watermarking should not modify the image watermarked")
+	}
+}
+
+func TestWatermarkText(t *testing.T) {
+	overlay, err := renderWatermarkText("Yronwood")
+	if err != nil {
+		t.Fatalf("Unexpected error rendering watermark text: %v", err)
+	}
+
+	white, black := false, false
+	bounds := overlay.Bounds()
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			r, _, _, a := overlay.At(x, y).RGBA()
+			white = white || (r == 0xFFFF && a == 0xFFFF)
+			black = black || (r == 0 && a == 0xFFFF)
+		}
+	}
+	if !white || !black {
+		t.Fatalf("Expected white text with a black outline, found white %t and black %t", white, black)
+	}
+
+	if _, err := renderWatermarkText(" "); err == nil {
+		t.Fatal("Expected error rendering watermark text with nothing to draw")
+	}
+}
+
+func TestWatermarkedImagesCachedSeparately(t *testing.T) {
+	storagePath := t.TempDir()
+	config.ConfigStorageDirectoryThumbnail = path.Join(t.TempDir(), "thumbnail")
+	useTestWatermark(t, color.RGBA{255, 0, 0, 255})
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 1600, 900))); err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+	if err := os.WriteFile(path.Join(storagePath, "image.png"), encoded.Bytes(), 0644); err != nil {
+		t.Fatalf("Could not write test image: %v", err)
+	}
+
+	if !WatermarkApplies("image.png", config.ConfigAccessTypePublic) || !WatermarkApplies("image.png", config.ConfigAccessTypeUnlisted) {
+		t.Fatal("Expected watermark to apply to public and unlisted images")
+	}
+	for _, fileName := range []string{"image.gif", "image.svg"} {
+		if WatermarkApplies(fileName, config.ConfigAccessTypePublic) {
+			t.Fatalf("Expected watermark not to apply to %s", fileName)
+		}
+	}
+	if WatermarkApplies("image.png", config.ConfigAccessTypePrivate) {
+		t.Fatal("Expected watermark not to apply to private images")
+	}
+
+	ctx := context.Background()
+	if _, err := GetThumbnailForImage(ctx, "image.png", storagePath, "public"); err != nil {
+		t.Fatalf("Unexpected error making thumbnail: %v", err)
+	}
+	watermarkedThumbnail, err := GetRenditionForImage(ctx, "image.png", storagePath, "public", Rendition{Thumbnail: true, Watermarked: true})
+	if err != nil {
+		t.Fatalf("Unexpected error making watermarked thumbnail: %v", err)
+	}
+	watermarkedOriginal, err := GetRenditionForImage(ctx, "image.png", storagePath, "public", Rendition{Watermarked: true})
+	if err != nil {
+		t.Fatalf("Unexpected error making watermarked image: %v", err)
+	}
+
+	for _, watermarked := range []struct {
+		payload []byte
+		width   int
+	}{
+		{watermarkedThumbnail, thumbnailWidth},
+		{watermarkedOriginal, 1600},
+	} {
+		decoded, err := png.Decode(bytes.NewReader(watermarked.payload))
+		if err != nil {
+			t.Fatalf("Watermarked image is not a complete PNG: %v", err)
+		}
+		if decoded.Bounds().Dx() != watermarked.width {
+			t.Fatalf("Expected watermarked image %d wide, got %v", watermarked.width, decoded.Bounds())
+		}
+		bottomRight := decoded.Bounds().Max.Sub(image.Pt(decoded.Bounds().Dx()/20, decoded.Bounds().Dy()/20))
+		if r, _, _, _ := decoded.At(bottomRight.X, bottomRight.Y).RGBA(); r == 0 {
+			t.Fatal("Expected watermark drawn near the bottom right corner")
+		}
+	}
+
+	stored, err := os.ReadFile(path.Join(storagePath, "image.png"))
+	if err != nil || !bytes.Equal(stored, encoded.Bytes()) {
+		t.Fatal("Stored image should be left as uploaded")
+	}
+
+	expectedFiles := []string{
+		"image_public_thumb.png",
+		getDerivativeFileName("image.png", "public", watermarkKey(thumbnailKey), ""),
+		getDerivativeFileName("image.png", "public", watermarkKey(originalKey), ""),
+	}
+	sort.Strings(expectedFiles)
+	assertDirectoryContents(t, config.ConfigStorageDirectoryThumbnail, expectedFiles...)
+
+	// A different watermark is not served from images watermarked before.
+	previousKey := watermarkKey(originalKey)
+	useTestWatermark(t, color.RGBA{0, 0, 255, 255})
+	if watermarkKey(originalKey) == previousKey {
+		t.Fatal("Expected watermarked images to be cached under a new key when the watermark changes")
+	}
+
+	if err := InvalidateDerivatives(ctx, "image.png", "public"); err != nil {
+		t.Fatalf("Unexpected error invalidating derivatives: %v", err)
+	}
+	assertDirectoryContents(t, config.ConfigStorageDirectoryThumbnail)
+}
+
+// useTestWatermark sets a solid square of the colour as the watermark, for the rest of
+// the test.
+func useTestWatermark(t *testing.T, overlayColour color.RGBA) {
+	previousOverlay, previousSignature := watermarkOverlay, watermarkSignature
+	t.Cleanup(func() {
+		watermarkOverlay, watermarkSignature = previousOverlay, previousSignature
+	})
+
+	overlay := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(overlay, overlay.Bounds(), image.NewUniform(overlayColour), image.Point{}, draw.Src)
+	setWatermark(overlay, overlay.Pix)
+}
@@ -14,14 +14,62 @@ type ImageMetadata struct {
 	AccessPath string   `json:"access_path"`
 	Uploaded   string   `json:"uploaded"`
 	ImageToken string   `json:"image_token"` // Pre-signed read access token for private images only
+
+	// Name the image is saved as when downloaded, which can be given when uploading it
+	// and need not be a valid file name for storage.
+	DisplayName string `json:"display_name,omitempty"`
+
+	// Details and resized sources of stored images, only set in responses. Dimensions
+	// are zero for images without a fixed size, such as SVG.
+	Width       int           `json:"width,omitempty"`
+	Height      int           `json:"height,omitempty"`
+	Size        int64         `json:"size,omitempty"` // Bytes as stored
+	ContentType string        `json:"content_type,omitempty"`
+	SHA256      string        `json:"sha256,omitempty"`
+	Sources     []ImageSource `json:"sources,omitempty"`
+	Exif        *ImageExif    `json:"exif,omitempty"`
+
+	// Placeholders to show while the image loads, once made after upload.
+	BlurHash       string `json:"blur_hash,omitempty"`
+	DominantColour string `json:"dominant_colour,omitempty"` // As #rrggbb
+}
+
+// ImageSource is a candidate for the srcset of an image, which can be described either by
+// its width or its pixel density relative to the configured base display width.
+type ImageSource struct {
+	URL     string  `json:"url"` // Relative to the API host, pre-signed for private images
+	Width   int     `json:"width"`
+	Density float64 `json:"density"`
+}
+
+// ImageExif summarises how a photo was taken, from EXIF data in the image. Only values
+// present in the image are set, and the position only for private images.
+type ImageExif struct {
+	Taken        string   `json:"taken,omitempty"` // RFC3339, in the time zone recorded by the camera if any
+	CameraMake   string   `json:"camera_make,omitempty"`
+	CameraModel  string   `json:"camera_model,omitempty"`
+	LensModel    string   `json:"lens_model,omitempty"`
+	ExposureTime string   `json:"exposure_time,omitempty"` // Seconds, such as 1/125
+	FNumber      float64  `json:"f_number,omitempty"`
+	ISO          int      `json:"iso,omitempty"`
+	FocalLength  float64  `json:"focal_length,omitempty"` // Millimetres
+	Latitude     *float64 `json:"latitude,omitempty"`
+	Longitude    *float64 `json:"longitude,omitempty"`
 }
 
 type ImageUploadRequest struct {
-	Token      string        `json:"token"`
-	Metadata   ImageMetadata `json:"metadata"`
-	Payload    string        `json:"payload"`
-	Checksum   string        `json:"checksum"` // SHA256 after encoding
-	AccessType string        `json:"access_type"`
+	Token          string        `json:"token"`
+	Metadata       ImageMetadata `json:"metadata"`
+	Payload        string        `json:"payload"`
+	Checksum       string        `json:"checksum"` // SHA256 after encoding
+	AccessType     string        `json:"access_type"`
+	ConflictPolicy string        `json:"conflict_policy"` // One of reject (default), overwrite or rename
+}
+
+type ImageUploadResponse struct {
+	FileName       string `json:"file_name"` // Final stored name, which differs from requested if renamed
+	ConflictPolicy string `json:"conflict_policy"`
+	BytesSaved     int64  `json:"bytes_saved"` // By optimizing the image as configured for its access type
 }
 
 // Auth optional for public images only.
@@ -30,6 +78,7 @@ type ImageListRequest struct {
 	AccessType string   `json:"access_type"`
 	Page       int      `json:"page"`
 	Tags       []string `json:"tags"`
+	Sort       string   `json:"sort"` // Most recent first by uploaded (default) or taken time
 }
 
 type ImageListResponse struct {
@@ -42,3 +91,218 @@ type ImageDeleteRequest struct {
 	FileName   string `json:"file_name"`
 	AccessType string `json:"access_type"`
 }
+
+// Replaces the content of an existing image while keeping its name, tags and URL.
+type ImageReplaceRequest struct {
+	Token      string `json:"token"`
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+	Payload    string `json:"payload"`
+	Checksum   string `json:"checksum"` // SHA256 after encoding
+}
+
+type ImageReplaceResponse struct {
+	FileName        string `json:"file_name"`
+	PreviousVersion string `json:"previous_version"` // Version under which the replaced content is kept
+	BytesSaved      int64  `json:"bytes_saved"`      // By optimizing the image as configured for its access type
+}
+
+type ImageVersion struct {
+	Version  string `json:"version"`
+	Uploaded string `json:"uploaded"`
+	Checksum string `json:"checksum"` // SHA256 of the version's content
+	Size     int64  `json:"size"`
+}
+
+type ImageVersionsRequest struct {
+	Token      string `json:"token"`
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+}
+
+type ImageVersionsResponse struct {
+	Versions []ImageVersion `json:"versions"` // Most recent first
+}
+
+type ImageRollbackRequest struct {
+	Token      string `json:"token"`
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+	Version    string `json:"version"`
+}
+
+type ImageRollbackResponse struct {
+	FileName        string `json:"file_name"`
+	PreviousVersion string `json:"previous_version"` // Version under which the rolled back content is kept
+}
+
+// Requests a signed URL for a resized or cropped derivative of an image. Width or height
+// may be left as zero to follow the aspect ratio when fitting within the other.
+type ImageDerivativeRequest struct {
+	Token      string `json:"token"`
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Fit        string `json:"fit"`     // One of contain (default), cover or crop
+	Gravity    string `json:"gravity"` // Position of cropped region, center (default) or a compass direction
+}
+
+type ImageDerivativeResponse struct {
+	URL string `json:"url"` // Relative to the API host
+}
+
+// Queues thumbnails to be made for images of the access type which have none yet, or of
+// all access types if not specified.
+type ThumbnailBackfillRequest struct {
+	Token      string `json:"token"`
+	AccessType string `json:"access_type"`
+}
+
+type ThumbnailBackfillResponse struct {
+	Queued int `json:"queued"`
+}
+
+type ServiceStatsRequest struct {
+	Token string `json:"token"`
+}
+
+type ServiceStatsResponse struct {
+	ThumbnailCache ThumbnailCacheStats `json:"thumbnail_cache"`
+	Hotlink        HotlinkStats        `json:"hotlink"`
+}
+
+// Requests for images blocked by hotlink rules since the service started.
+type HotlinkStats struct {
+	Denied       int64 `json:"denied"`
+	Placeholders int64 `json:"placeholders"` // Served the placeholder image in place of the one requested
+}
+
+// Usage of derivatives cached on disk, and of the most viewed kept in memory.
+type ThumbnailCacheStats struct {
+	Files     int   `json:"files"`
+	Bytes     int64 `json:"bytes"`
+	Budget    int64 `json:"budget"`
+	HotFiles  int   `json:"hot_files"`
+	HotBytes  int64 `json:"hot_bytes"`
+	HotBudget int64 `json:"hot_budget"`
+	Hits      int64 `json:"hits"`
+	HotHits   int64 `json:"hot_hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// Requests the metadata of a single image. Private images require either an admin token
+// or a pre-signed image token.
+type ImageMetadataRequest struct {
+	Token      string `json:"token"`
+	ImageToken string `json:"image_token"`
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+}
+
+// Requests all EXIF data of an image, which unlike its summary includes every tag present.
+type ImageExifRequest struct {
+	Token      string `json:"token"`
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+}
+
+type ImageExifResponse struct {
+	Tags []ImageExifTag `json:"tags"` // Empty for images without EXIF data
+}
+
+type ImageExifTag struct {
+	Directory string `json:"directory"` // One of image, photo or gps
+	ID        int    `json:"id"`
+	Name      string `json:"name"` // As given by the EXIF standard, or the ID in hex if not known
+	Value     string `json:"value"`
+}
+
+// Creates a link sharing an image until it expires, optionally limited to a number of
+// views and protected by a password.
+type ShareCreateRequest struct {
+	Token      string `json:"token"`
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+	ExpiresIn  int64  `json:"expires_in"` // Seconds
+	MaxViews   int    `json:"max_views"`  // Unlimited if zero
+	Password   string `json:"password"`   // Optional and at most 72 bytes, sent as the password query parameter or X-Share-Password header
+}
+
+type ShareLink struct {
+	ID                string `json:"id"`
+	URL               string `json:"url"` // Relative to the API host unless its public URL is configured
+	FileName          string `json:"file_name"`
+	AccessType        string `json:"access_type"`
+	Created           string `json:"created"`
+	Expires           string `json:"expires"`
+	MaxViews          int    `json:"max_views"`
+	Views             int    `json:"views"`
+	PasswordProtected bool   `json:"password_protected"`
+	Usable            bool   `json:"usable"` // False once expired or viewed as many times as allowed
+}
+
+// Lists share links, optionally only those of an image.
+type ShareListRequest struct {
+	Token      string `json:"token"`
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+}
+
+type ShareListResponse struct {
+	Links []ShareLink `json:"links"`
+}
+
+type ShareRevokeRequest struct {
+	Token string `json:"token"`
+	ID    string `json:"id"`
+}
+
+// Creates a short link resolving to an image, under a slug generated if none is given.
+type ShortLinkCreateRequest struct {
+	Token      string `json:"token"`
+	Slug       string `json:"slug"` // Optional, of letters, digits, "-" and "_"
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+	Mode       string `json:"mode"` // redirect (default) to the image, or inline to serve it under the short link
+}
+
+type ShortLink struct {
+	Slug       string `json:"slug"`
+	URL        string `json:"url"` // Relative to the API host unless its public URL is configured
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+	Mode       string `json:"mode"`
+	Created    string `json:"created"`
+	Hits       int64  `json:"hits"`
+}
+
+// Lists short links, optionally only those of an image.
+type ShortLinkListRequest struct {
+	Token      string `json:"token"`
+	FileName   string `json:"file_name"`
+	AccessType string `json:"access_type"`
+}
+
+type ShortLinkListResponse struct {
+	Links []ShortLink `json:"links"`
+}
+
+type ShortLinkDeleteRequest struct {
+	Token string `json:"token"`
+	Slug  string `json:"slug"`
+}
+
+// Describes an image for embedding in other sites, as given by the oEmbed specification.
+// Images without a fixed size, such as SVG, are described as links rather than photos.
+type OEmbedResponse struct {
+	Type         string `json:"type"` // photo or link
+	Version      string `json:"version"`
+	Title        string `json:"title"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	URL          string `json:"url,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+}
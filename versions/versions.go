@@ -0,0 +1,261 @@
+package versions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/yronwood/config"
+	"github.com/chongyangshi/yronwood/store"
+)
+
+var versionIDComposition = regexp.MustCompile(`^[0-9]+$`)
+
+// Previous versions of an image are kept in the versions directory, grouped by
+// access type and file name. Each version is stored under an identifier derived
+// from the time it was superseded, so versions sort chronologically by name.
+func versionsDirectory(fileName, accessType string) string {
+	return path.Join(config.ConfigStorageDirectoryVersions, accessType, fileName)
+}
+
+// The checksum and size of each version are recorded alongside it when it is archived, so
+// that versions can be listed without reading them. Records are named after the version,
+// so are not mistaken for versions themselves.
+type versionRecord struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+func versionRecords() *store.Store {
+	return store.New(config.ConfigStorageDirectoryVersions)
+}
+
+func versionRecordKey(fileName, accessType, versionID string) string {
+	return path.Join(accessType, fileName, versionID)
+}
+
+// ArchiveCurrentVersion copies the image currently stored under the file name into
+// the versions directory, before it gets overwritten. The original modification
+// time is retained on the copy to record when that version was uploaded.
+func ArchiveCurrentVersion(ctx context.Context, fileName, storagePath, accessType string) (string, error) {
+	filePath := path.Join(storagePath, fileName)
+	currentFile, err := os.Open(filePath)
+	if err != nil {
+		slog.Error(ctx, "Could not open current version of %s for archiving: %v", filePath, err)
+		return "", err
+	}
+	defer currentFile.Close()
+
+	currentStat, err := currentFile.Stat()
+	if err != nil {
+		slog.Error(ctx, "Could not check current version of %s for archiving: %v", filePath, err)
+		return "", err
+	}
+
+	versionsPath := versionsDirectory(fileName, accessType)
+	if err := os.MkdirAll(versionsPath, 0755); err != nil {
+		slog.Error(ctx, "Could not create versions directory %s: %v", versionsPath, err)
+		return "", err
+	}
+
+	versionID := fmt.Sprintf("%d", time.Now().UnixNano())
+	versionPath := path.Join(versionsPath, versionID)
+	versionFile, err := os.OpenFile(versionPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		slog.Error(ctx, "Could not create version file %s: %v", versionPath, err)
+		return "", err
+	}
+
+	versionHash := sha256.New()
+	versionSize, err := io.Copy(io.MultiWriter(versionFile, versionHash), currentFile)
+	if err != nil {
+		versionFile.Close()
+		os.Remove(versionPath)
+		slog.Error(ctx, "Could not copy %s into version file %s: %v", filePath, versionPath, err)
+		return "", err
+	}
+
+	if err := versionFile.Close(); err != nil {
+		os.Remove(versionPath)
+		slog.Error(ctx, "Could not write version file %s: %v", versionPath, err)
+		return "", err
+	}
+
+	if err := os.Chtimes(versionPath, currentStat.ModTime(), currentStat.ModTime()); err != nil {
+		slog.Warn(ctx, "Could not retain upload time on version file %s: %v", versionPath, err)
+	}
+
+	record := versionRecord{SHA256: hex.EncodeToString(versionHash.Sum(nil)), Size: versionSize}
+	if err := versionRecords().Put(versionRecordKey(fileName, accessType, versionID), record); err != nil {
+		// Recorded again when versions are next listed.
+		slog.Warn(ctx, "Could not record checksum of version file %s: %v", versionPath, err)
+	}
+
+	return versionID, nil
+}
+
+// Version describes a previous version of an image.
+type Version struct {
+	ID       string
+	Uploaded time.Time
+	Checksum string // SHA256 of the version's content
+	Size     int64
+}
+
+// ListVersions returns all previous versions kept for the image, most recent first.
+func ListVersions(ctx context.Context, fileName, accessType string) ([]Version, error) {
+	versionsPath := versionsDirectory(fileName, accessType)
+	versionFiles, err := ioutil.ReadDir(versionsPath)
+	if os.IsNotExist(err) {
+		return []Version{}, nil
+	} else if err != nil {
+		slog.Error(ctx, "Could not list versions directory %s: %v", versionsPath, err)
+		return nil, err
+	}
+
+	versions := []Version{}
+	for _, versionFile := range versionFiles {
+		if !validVersionID(versionFile.Name()) {
+			continue
+		}
+
+		record, err := getVersionRecord(ctx, fileName, accessType, versionFile.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, Version{
+			ID:       versionFile.Name(),
+			Uploaded: versionFile.ModTime(),
+			Checksum: record.SHA256,
+			Size:     record.Size,
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versionOrder(versions[i].ID) > versionOrder(versions[j].ID)
+	})
+
+	return versions, nil
+}
+
+// getVersionRecord returns the checksum and size recorded for the version, recording them
+// first for versions archived before they were recorded.
+func getVersionRecord(ctx context.Context, fileName, accessType, versionID string) (versionRecord, error) {
+	records := versionRecords()
+	recordKey := versionRecordKey(fileName, accessType, versionID)
+	record := versionRecord{}
+	found, err := records.Get(recordKey, &record)
+	if err != nil {
+		slog.Error(ctx, "Could not read record of version %s of %s: %v", versionID, fileName, err)
+		return versionRecord{}, err
+	}
+	if found {
+		return record, nil
+	}
+
+	versionPayload := ReadVersion(ctx, fileName, accessType, versionID)
+	if versionPayload == nil {
+		return versionRecord{}, fmt.Errorf("Could not read version %s of %s", versionID, fileName)
+	}
+	checksum := sha256.Sum256(versionPayload)
+	record = versionRecord{SHA256: hex.EncodeToString(checksum[:]), Size: int64(len(versionPayload))}
+	if err := records.Put(recordKey, record); err != nil {
+		slog.Warn(ctx, "Could not record checksum of version %s of %s: %v", versionID, fileName, err)
+	}
+
+	return record, nil
+}
+
+// ReadVersion returns the content of a previous version of the image, or nil if
+// the version does not exist.
+func ReadVersion(ctx context.Context, fileName, accessType, versionID string) []byte {
+	if !validVersionID(versionID) {
+		return nil
+	}
+
+	versionPath := path.Join(versionsDirectory(fileName, accessType), versionID)
+	versionPayload, err := ioutil.ReadFile(versionPath)
+	if err != nil {
+		slog.Debug(ctx, "Could not read version file %s: %v", versionPath, err)
+		return nil
+	}
+
+	return versionPayload
+}
+
+// OpenVersion opens a previous version of the image for reading, returning nil if the
+// version does not exist. The caller is responsible for closing the file.
+func OpenVersion(ctx context.Context, fileName, accessType, versionID string) *os.File {
+	if !validVersionID(versionID) {
+		return nil
+	}
+
+	versionPath := path.Join(versionsDirectory(fileName, accessType), versionID)
+	versionFile, err := os.Open(versionPath)
+	if err != nil {
+		slog.Debug(ctx, "Could not open version file %s: %v", versionPath, err)
+		return nil
+	}
+
+	return versionFile
+}
+
+// RestoreVersion makes a previous version the current content of the image. The
+// content being replaced is itself archived first, so a rollback can be undone,
+// and its version identifier is returned.
+func RestoreVersion(ctx context.Context, fileName, storagePath, accessType, versionID string) (string, error) {
+	versionPayload := ReadVersion(ctx, fileName, accessType, versionID)
+	if versionPayload == nil {
+		return "", terrors.NotFound("version_not_found", fmt.Sprintf("Version %s of %s is not found", versionID, fileName), nil)
+	}
+
+	archivedID, err := ArchiveCurrentVersion(ctx, fileName, storagePath, accessType)
+	if err != nil {
+		return "", err
+	}
+
+	filePath := path.Join(storagePath, fileName)
+	if err := ioutil.WriteFile(filePath, versionPayload, 0644); err != nil {
+		slog.Error(ctx, "Could not restore version %s into %s: %v", versionID, filePath, err)
+		return "", err
+	}
+
+	return archivedID, nil
+}
+
+// DeleteVersions removes all previous versions kept for the image.
+func DeleteVersions(ctx context.Context, fileName, accessType string) error {
+	versionsPath := versionsDirectory(fileName, accessType)
+	if err := os.RemoveAll(versionsPath); err != nil {
+		slog.Error(ctx, "Could not remove versions directory %s: %v", versionsPath, err)
+		return err
+	}
+
+	return nil
+}
+
+func validVersionID(versionID string) bool {
+	return versionIDComposition.MatchString(versionID)
+}
+
+func versionOrder(versionID string) int64 {
+	order, err := strconv.ParseInt(versionID, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return order
+}
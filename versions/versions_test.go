@@ -0,0 +1,189 @@
+package versions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/yronwood/config"
+)
+
+func useTestVersions(t *testing.T) string {
+	defer func(configured string) {
+		t.Cleanup(func() { config.ConfigStorageDirectoryVersions = configured })
+	}(config.ConfigStorageDirectoryVersions)
+	config.ConfigStorageDirectoryVersions = t.TempDir()
+
+	return t.TempDir()
+}
+
+func writeCurrent(t *testing.T, storagePath, content string, modTime time.Time) {
+	filePath := path.Join(storagePath, "cat.png")
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestArchiveAndListVersions(t *testing.T) {
+	storagePath := useTestVersions(t)
+	ctx := context.Background()
+
+	versions, err := ListVersions(ctx, "cat.png", config.ConfigAccessTypePublic)
+	if err != nil || len(versions) != 0 {
+		t.Fatalf("Expected no versions before archiving, got %+v and %v", versions, err)
+	}
+
+	firstUploaded := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	writeCurrent(t, storagePath, "first", firstUploaded)
+	firstID, err := ArchiveCurrentVersion(ctx, "cat.png", storagePath, config.ConfigAccessTypePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeCurrent(t, storagePath, "second version", firstUploaded.Add(time.Hour))
+	secondID, err := ArchiveCurrentVersion(ctx, "cat.png", storagePath, config.ConfigAccessTypePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err = ListVersions(ctx, "cat.png", config.ConfigAccessTypePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("Expected two versions, got %+v", versions)
+	}
+	for i, expected := range []struct {
+		id       string
+		content  string
+		uploaded time.Time
+	}{
+		{secondID, "second version", firstUploaded.Add(time.Hour)},
+		{firstID, "first", firstUploaded},
+	} {
+		version := versions[i]
+		if version.ID != expected.id || version.Checksum != checksum(expected.content) || version.Size != int64(len(expected.content)) || !version.Uploaded.Equal(expected.uploaded) {
+			t.Fatalf("Expected version %d to be %s of %q uploaded at %v, got %+v", i, expected.id, expected.content, expected.uploaded, version)
+		}
+	}
+
+	// Versions are listed from what was recorded when they were archived, rather than from
+	// their content.
+	versionPath := path.Join(config.ConfigStorageDirectoryVersions, config.ConfigAccessTypePublic, "cat.png", firstID)
+	if err := ioutil.WriteFile(versionPath, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = ListVersions(ctx, "cat.png", config.ConfigAccessTypePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions[1].Checksum != checksum("first") {
+		t.Fatalf("Expected recorded checksum of first version, got %+v", versions[1])
+	}
+
+	if versions, err := ListVersions(ctx, "cat.png", config.ConfigAccessTypePrivate); err != nil || len(versions) != 0 {
+		t.Fatalf("Expected no versions of another access type, got %+v and %v", versions, err)
+	}
+}
+
+func TestListVersionsRecordsMissingChecksums(t *testing.T) {
+	useTestVersions(t)
+	ctx := context.Background()
+
+	// Versions archived before checksums were recorded.
+	versionsPath := path.Join(config.ConfigStorageDirectoryVersions, config.ConfigAccessTypePublic, "cat.png")
+	if err := os.MkdirAll(versionsPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(versionsPath, "1000"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := ListVersions(ctx, "cat.png", config.ConfigAccessTypePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].ID != "1000" || versions[0].Checksum != checksum("old") || versions[0].Size != 3 {
+		t.Fatalf("Expected version 1000 of \"old\", got %+v", versions)
+	}
+
+	record := versionRecord{}
+	found, err := versionRecords().Get(versionRecordKey("cat.png", config.ConfigAccessTypePublic, "1000"), &record)
+	if err != nil || !found || record.SHA256 != checksum("old") {
+		t.Fatalf("Expected checksum to be recorded once listed, got %+v and %v", record, err)
+	}
+}
+
+func TestRestoreVersion(t *testing.T) {
+	storagePath := useTestVersions(t)
+	ctx := context.Background()
+
+	writeCurrent(t, storagePath, "first", time.Now())
+	firstID, err := ArchiveCurrentVersion(ctx, "cat.png", storagePath, config.ConfigAccessTypePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCurrent(t, storagePath, "second", time.Now())
+
+	archivedID, err := RestoreVersion(ctx, "cat.png", storagePath, config.ConfigAccessTypePublic, firstID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := ioutil.ReadFile(path.Join(storagePath, "cat.png"))
+	if err != nil || string(current) != "first" {
+		t.Fatalf("Expected first version to be restored, got %q and %v", current, err)
+	}
+
+	// What was replaced by the rollback is kept, so the rollback can be undone.
+	if replaced := ReadVersion(ctx, "cat.png", config.ConfigAccessTypePublic, archivedID); string(replaced) != "second" {
+		t.Fatalf("Expected replaced content to be archived, got %q", replaced)
+	}
+	versions, err := ListVersions(ctx, "cat.png", config.ConfigAccessTypePublic)
+	if err != nil || len(versions) != 2 || versions[0].ID != archivedID {
+		t.Fatalf("Expected archived version to be listed first, got %+v and %v", versions, err)
+	}
+
+	for _, versionID := range []string{"12345", "../cat.png", ""} {
+		_, err := RestoreVersion(ctx, "cat.png", storagePath, config.ConfigAccessTypePublic, versionID)
+		if !terrors.PrefixMatches(err, terrors.ErrNotFound) {
+			t.Fatalf("Expected %s restoring version %q, got %v", terrors.ErrNotFound, versionID, err)
+		}
+	}
+}
+
+func TestDeleteVersions(t *testing.T) {
+	storagePath := useTestVersions(t)
+	ctx := context.Background()
+
+	writeCurrent(t, storagePath, "first", time.Now())
+	versionID, err := ArchiveCurrentVersion(ctx, "cat.png", storagePath, config.ConfigAccessTypePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteVersions(ctx, "cat.png", config.ConfigAccessTypePublic); err != nil {
+		t.Fatal(err)
+	}
+
+	if versions, err := ListVersions(ctx, "cat.png", config.ConfigAccessTypePublic); err != nil || len(versions) != 0 {
+		t.Fatalf("Expected no versions once deleted, got %+v and %v", versions, err)
+	}
+	if version := OpenVersion(ctx, "cat.png", config.ConfigAccessTypePublic, versionID); version != nil {
+		version.Close()
+		t.Fatal("Expected deleted version to not be opened")
+	}
+}